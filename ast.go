@@ -2,6 +2,8 @@ package minilustre
 
 import (
 	"fmt"
+	"math"
+	"strconv"
 	"strings"
 )
 
@@ -33,29 +35,37 @@ func (t Type) String() string {
 
 type Expr interface {
 	fmt.Stringer
+	Pos() Pos
 }
 
 type ExprCall struct {
-	Name string
-	Args []Expr
+	Name    string
+	NamePos Pos
+	Args    []Expr
 }
 
-func (e *ExprCall) String() string {
-	l := make([]string, len(e.Args))
-	for i, e := range e.Args {
-		l[i] = e.String()
-	}
+func (e *ExprCall) Pos() Pos {
+	return e.NamePos
+}
 
-	return e.Name + "(" + strings.Join(l, ", ") + ")"
+func (e *ExprCall) String() string {
+	return formatExpr(e)
 }
 
+// ExprConst is a constant. Its value is nil for unit, or a bool, an int, a
+// float32 or a string.
 type ExprConst struct {
-	Value interface{}
+	Value    interface{}
+	ValuePos Pos
+}
+
+func (e ExprConst) Pos() Pos {
+	return e.ValuePos
 }
 
 func (e ExprConst) Type() Type {
 	switch e.Value.(type) {
-	case interface{}:
+	case nil:
 		return TypeUnit
 	case bool:
 		return TypeBool
@@ -66,22 +76,51 @@ func (e ExprConst) Type() Type {
 	case string:
 		return TypeString
 	default:
-		panic(fmt.Sprintf("unknown const type %T", e))
+		panic(fmt.Sprintf("unknown const type %T", e.Value))
 	}
 }
 
 func (e ExprConst) String() string {
-	return fmt.Sprintf("%#v", e.Value)
+	switch v := e.Value.(type) {
+	case nil:
+		return "()"
+	case float32:
+		// Infinities and NaN have no literal syntax
+		switch f := float64(v); {
+		case math.IsNaN(f):
+			return "(0.0 /. 0.0)"
+		case math.IsInf(f, 1):
+			return "(1.0 /. 0.0)"
+		case math.IsInf(f, -1):
+			return "(-1.0 /. 0.0)"
+		}
+		s := strconv.FormatFloat(float64(v), 'g', -1, 32)
+		mantissa, exp, hasExp := strings.Cut(s, "e")
+		if !strings.Contains(mantissa, ".") {
+			mantissa += ".0"
+		}
+		if hasExp {
+			return mantissa + "e" + exp
+		}
+		return mantissa
+	case string:
+		return quote(v)
+	default:
+		return fmt.Sprintf("%v", v)
+	}
 }
 
 type ExprTuple []Expr
 
-func (et ExprTuple) String() string {
-	l := make([]string, len(et))
-	for i, e := range et {
-		l[i] = e.String()
+func (et ExprTuple) Pos() Pos {
+	if len(et) == 0 {
+		return Pos{}
 	}
-	return "(" + strings.Join(l, ", ") + ")"
+	return et[0].Pos()
+}
+
+func (et ExprTuple) String() string {
+	return formatExpr(et)
 }
 
 type BinOp int
@@ -92,6 +131,18 @@ const (
 	BinOpGt
 	BinOpLt
 	BinOpFby
+	BinOpMul
+	BinOpDiv
+	BinOpFMinus
+	BinOpFPlus
+	BinOpFMul
+	BinOpFDiv
+	BinOpGe
+	BinOpLe
+	BinOpEq
+	BinOpNe
+	BinOpAnd
+	BinOpOr
 )
 
 func (op BinOp) String() string {
@@ -106,34 +157,135 @@ func (op BinOp) String() string {
 		return "<"
 	case BinOpFby:
 		return "fby"
+	case BinOpMul:
+		return "*"
+	case BinOpDiv:
+		return "/"
+	case BinOpFMinus:
+		return "-."
+	case BinOpFPlus:
+		return "+."
+	case BinOpFMul:
+		return "*."
+	case BinOpFDiv:
+		return "/."
+	case BinOpGe:
+		return ">="
+	case BinOpLe:
+		return "<="
+	case BinOpEq:
+		return "="
+	case BinOpNe:
+		return "<>"
+	case BinOpAnd:
+		return "and"
+	case BinOpOr:
+		return "or"
 	}
 	panic("unknown binary operator")
 }
 
+// Precedence returns the operator precedence. Operators with a higher
+// precedence bind tighter.
+func (op BinOp) Precedence() int {
+	switch op {
+	case BinOpFby:
+		return 1
+	case BinOpOr:
+		return 2
+	case BinOpAnd:
+		return 3
+	case BinOpGt, BinOpLt, BinOpGe, BinOpLe, BinOpEq, BinOpNe:
+		return 4
+	case BinOpMinus, BinOpPlus, BinOpFMinus, BinOpFPlus:
+		return 5
+	case BinOpMul, BinOpDiv, BinOpFMul, BinOpFDiv:
+		return 6
+	}
+	panic("unknown binary operator")
+}
+
+// RightAssoc returns true if the operator is right-associative.
+func (op BinOp) RightAssoc() bool {
+	return op == BinOpFby
+}
+
 type ExprBinOp struct {
 	Op          BinOp
+	OpPos       Pos
 	Left, Right Expr
 }
 
+func (e *ExprBinOp) Pos() Pos {
+	return e.Left.Pos()
+}
+
 func (e *ExprBinOp) String() string {
-	return e.Left.String() + " " + e.Op.String() + " " + e.Right.String()
+	return formatExpr(e)
+}
+
+type UnOp int
+
+const (
+	UnOpNot UnOp = iota
+	UnOpMinus
+	UnOpFMinus
+)
+
+func (op UnOp) String() string {
+	switch op {
+	case UnOpNot:
+		return "not"
+	case UnOpMinus:
+		return "-"
+	case UnOpFMinus:
+		return "-."
+	}
+	panic("unknown unary operator")
+}
+
+type ExprUnOp struct {
+	Op    UnOp
+	OpPos Pos
+	Expr  Expr
 }
 
-type ExprVar string
+func (e *ExprUnOp) Pos() Pos {
+	return e.OpPos
+}
+
+func (e *ExprUnOp) String() string {
+	return formatExpr(e)
+}
+
+type ExprVar struct {
+	Name    string
+	NamePos Pos
+}
+
+func (e ExprVar) Pos() Pos {
+	return e.NamePos
+}
 
 func (e ExprVar) String() string {
-	return string(e)
+	return e.Name
 }
 
 type ExprIf struct {
+	If               Pos
 	Cond, Body, Else Expr
 }
 
+func (e *ExprIf) Pos() Pos {
+	return e.If
+}
+
 func (e *ExprIf) String() string {
-	return "if " + e.Cond.String() + " then " + e.Body.String() + " else " + e.Else.String()
+	return formatExpr(e)
 }
 
 type Assign struct {
+	Pos  Pos
 	Dst  []string
 	Body Expr
 }
@@ -143,50 +295,98 @@ func (a *Assign) String() string {
 	if len(a.Dst) > 1 {
 		dst = "(" + dst + ")"
 	}
-	return dst + " = " + a.Body.String()
+	return dst + " = " + formatExpr(a.Body)
 }
 
-func assignListString(assigns []Assign) string {
-	l := make([]string, len(assigns))
-	for i, a := range assigns {
-		l[i] = "\t" + a.String() + ";"
-	}
-	return strings.Join(l, "\n") + "\n"
+type Param struct {
+	Name string
+	Type Type
+	Pos  Pos
 }
 
-func paramMapString(params map[string]Type) string {
-	l := make([]string, 0, len(params))
-	for name, typ := range params {
-		l = append(l, name+": "+typ.String())
-	}
-	return strings.Join(l, "; ")
+func (p *Param) String() string {
+	return p.Name + ": " + p.Type.String()
 }
 
 type Node struct {
+	// Pos is the position of the first keyword of the node.
+	Pos Pos
+	// Inline is true if calls to the node are inlined.
+	Inline bool
+	// Unsafe is true if the node has side effects.
+	Unsafe bool
+	// Extern is true if the node is implemented outside of the source file.
+	// Extern nodes don't have locals nor a body.
+	Extern      bool
 	Name        string
-	InParams    map[string]Type
-	OutParams   map[string]Type
-	LocalParams map[string]Type
+	InParams    []Param
+	OutParams   []Param
+	LocalParams []Param
 	Body        []Assign
+	// Positions of the let and tel keywords.
+	Let, Tel Pos
 }
 
 func (n *Node) String() string {
-	return "node " + n.Name +
-		" (" + paramMapString(n.InParams) +
-		") returns (" + paramMapString(n.OutParams) + ");\n" +
-		"let\n" +
-		assignListString(n.Body) +
-		"tel\n"
+	var p printer
+	p.node(n, 0)
+	var b strings.Builder
+	p.writeTo(&b)
+	return b.String()
 }
 
-type File struct {
+// Comment is a comment in a source file. Its text includes the delimiters.
+type Comment struct {
+	Pos  Pos
+	Text string
+	// EndOfLine is true if the comment follows another token on the same
+	// line.
+	EndOfLine bool
+}
+
+// Include is an include directive, which makes the nodes and packages of
+// another source file available.
+type Include struct {
+	Pos Pos
+	// Path of the included file, relative to the including file.
+	Path string
+}
+
+// Package is a group of nodes, in the style of Lustre V6. Nodes of a package
+// can call the nodes of the packages it uses. Nodes outside of the package
+// refer to its nodes with qualified names such as "p::f".
+type Package struct {
+	// Pos is the position of the package keyword.
+	Pos   Pos
+	Name  string
+	Uses  []string
 	Nodes []Node
+	// Positions of the body and end keywords.
+	Body, End Pos
 }
 
+// File is a source file. It contains either top-level nodes or packages.
+type File struct {
+	Includes []Include
+	Packages []Package
+	Nodes    []Node
+	Comments []Comment
+}
+
+// String formats the file. Comments are omitted.
 func (f *File) String() string {
-	nodes := make([]string, len(f.Nodes))
-	for i, n := range f.Nodes {
-		nodes[i] = n.String()
+	var p printer
+	p.file(&File{Includes: f.Includes, Packages: f.Packages, Nodes: f.Nodes})
+	var b strings.Builder
+	p.writeTo(&b)
+	return b.String()
+}
+
+// splitQualified splits a qualified name such as "p::f" into a package name
+// and a node name. The package name is empty if name isn't qualified.
+func splitQualified(name string) (pkg, node string) {
+	if i := strings.Index(name, "::"); i >= 0 {
+		return name[:i], name[i+2:]
 	}
-	return strings.Join(nodes, "\n")
+	return "", name
 }
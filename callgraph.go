@@ -0,0 +1,96 @@
+package minilustre
+
+import (
+	"strings"
+)
+
+// nodeCall is a call to a node of a file.
+type nodeCall struct {
+	callee int
+	pos    Pos
+}
+
+// callGraph returns the calls made by each node of f to other nodes of f, in
+// source order. Calls to undefined and built-in nodes are omitted.
+func callGraph(f *File) [][]nodeCall {
+	index := make(map[string]int)
+	for i := range f.Nodes {
+		if _, ok := index[f.Nodes[i].Name]; !ok {
+			index[f.Nodes[i].Name] = i
+		}
+	}
+
+	calls := make([][]nodeCall, len(f.Nodes))
+	for i := range f.Nodes {
+		for _, a := range f.Nodes[i].Body {
+			Inspect(a.Body, func(e Expr) bool {
+				if call, ok := e.(*ExprCall); ok {
+					if j, ok := index[call.Name]; ok {
+						calls[i] = append(calls[i], nodeCall{j, call.NamePos})
+					}
+				}
+				return true
+			})
+		}
+	}
+	return calls
+}
+
+// callOrder returns the indices of the nodes of f sorted so that each node
+// comes after the nodes it calls. Source order is kept when possible.
+//
+// Recursive calls have no finite-memory semantics, since each call has its
+// own state: if nodes call each other recursively, an error describing the
+// first cycle is returned.
+func callOrder(f *File) ([]int, *Error) {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+
+	calls := callGraph(f)
+	state := make([]int, len(f.Nodes))
+	order := make([]int, 0, len(f.Nodes))
+	// Nodes being visited, each one calling the next one
+	var path []int
+
+	var visit func(i int) *Error
+	visit = func(i int) *Error {
+		state[i] = visiting
+		path = append(path, i)
+		for _, call := range calls[i] {
+			switch state[call.callee] {
+			case visiting:
+				var names []string
+				for j := len(path) - 1; j >= 0; j-- {
+					if path[j] == call.callee {
+						for _, k := range path[j:] {
+							names = append(names, f.Nodes[k].Name)
+						}
+						break
+					}
+				}
+				names = append(names, f.Nodes[call.callee].Name)
+				return errorf(call.pos, "recursive call to node '%v': %v", f.Nodes[call.callee].Name, strings.Join(names, " -> "))
+			case unvisited:
+				if err := visit(call.callee); err != nil {
+					return err
+				}
+			}
+		}
+		path = path[:len(path)-1]
+		state[i] = visited
+		order = append(order, i)
+		return nil
+	}
+
+	for i := range f.Nodes {
+		if state[i] == unvisited {
+			if err := visit(i); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return order, nil
+}
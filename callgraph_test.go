@@ -0,0 +1,103 @@
+package minilustre
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCallOrder(t *testing.T) {
+	src := `node a (x: int) returns (o: int);
+let
+  o = b(x) + c(x);
+tel
+
+node b (x: int) returns (o: int);
+let
+  o = c(x) + print("b");
+tel
+
+node c (x: int) returns (o: int);
+let
+  o = x;
+tel
+
+node d (x: int) returns (o: int);
+let
+  o = a(x);
+tel
+`
+	f, err := Parse(strings.NewReader(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	order, cycle := callOrder(f)
+	if cycle != nil {
+		t.Fatalf("callOrder() = %v", cycle)
+	}
+	var names []string
+	for _, i := range order {
+		names = append(names, f.Nodes[i].Name)
+	}
+	if got, want := strings.Join(names, " "), "c b a d"; got != want {
+		t.Errorf("callOrder() = %v, want %v", got, want)
+	}
+}
+
+func TestCallOrderRecursion(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		err  string
+	}{
+		{
+			name: "self",
+			src: `node f (x: int) returns (o: int);
+let
+  o = 0 fby f(x);
+tel
+`,
+			err: "3:13: recursive call to node 'f': f -> f",
+		},
+		{
+			name: "mutual",
+			src: `node main (x: int) returns (o: int);
+let
+  o = f(x);
+tel
+
+node f (x: int) returns (o: int);
+let
+  o = g(x) + 1;
+tel
+
+node g (x: int) returns (o: int);
+let
+  o = if x > 0 then f(x - 1) else 0;
+tel
+`,
+			err: "13:21: recursive call to node 'f': f -> g -> f",
+		},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			f, err := Parse(strings.NewReader(tc.src))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := Translate(f); err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("Translate() = %v, want an error containing %q", err, tc.err)
+			}
+			if _, err := NewInterpreter(f, f.Nodes[0].Name); err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("NewInterpreter() = %v, want an error containing %q", err, tc.err)
+			}
+
+			// Recursive nodes can't be inlined
+			Inline(f, true)
+			CSE(f)
+		})
+	}
+}
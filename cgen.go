@@ -0,0 +1,618 @@
+package minilustre
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// cReserved contains C keywords, names defined by the C headers included by
+// the generated code, and the name of the state parameter.
+var cReserved = map[string]bool{
+	"auto": true, "break": true, "case": true, "char": true, "const": true,
+	"continue": true, "default": true, "do": true, "double": true,
+	"else": true, "enum": true, "extern": true, "float": true, "for": true,
+	"goto": true, "if": true, "inline": true, "int": true, "long": true,
+	"register": true, "restrict": true, "return": true, "short": true,
+	"signed": true, "sizeof": true, "static": true, "struct": true,
+	"switch": true, "typedef": true, "union": true, "unsigned": true,
+	"void": true, "volatile": true, "while": true, "bool": true,
+	"true": true, "false": true, "self": true, "int32_t": true,
+	"uint32_t": true, "uint8_t": true, "INT32_MIN": true,
+}
+
+// cLibc contains the names of the functions of the C standard library, and
+// main. Extern nodes with these names would conflict with the declarations
+// built into C compilers, and with libc and libm when linking.
+var cLibc = map[string]bool{}
+
+func init() {
+	names := `main abort abs atexit atof atoi atol bsearch calloc div exit free
+		getenv labs ldiv llabs malloc qsort rand realloc srand strtod strtof
+		strtol strtoul system
+		acos asin atan atan2 cbrt ceil copysign cos cosh erf exp exp2 expm1
+		fabs fdim floor fma fmax fmin fmod frexp hypot ldexp lgamma log log10
+		log1p log2 lrint lround modf nan nearbyint pow remainder rint round
+		scalbn sin sinh sqrt tan tanh tgamma trunc
+		fclose fflush fgetc fgets fopen fprintf fputc fputs fread fscanf
+		fwrite getc getchar gets perror printf putc putchar puts remove
+		rename scanf snprintf sprintf sscanf
+		memchr memcmp memcpy memmove memset strcat strchr strcmp strcpy
+		strlen strncat strncmp strncpy strrchr strstr strtok
+		isalnum isalpha isdigit islower isspace isupper tolower toupper
+		clock time`
+	for _, name := range strings.Fields(names) {
+		cLibc[name] = true
+		// The float and long double variants of math functions
+		cLibc[name+"f"] = true
+		cLibc[name+"l"] = true
+	}
+}
+
+// cName returns the C identifier for a name. Names ending with an underscore
+// are escaped too, so that two names never get the same identifier.
+func cName(name string) string {
+	if cReserved[name] || cLibc[name] || strings.HasPrefix(name, "ml_") || strings.HasSuffix(name, "_") {
+		return name + "_"
+	}
+	return name
+}
+
+func cType(t Type) string {
+	switch t {
+	case TypeBool:
+		return "bool"
+	case TypeInt:
+		return "int32_t"
+	case TypeFloat:
+		return "float"
+	case TypeString:
+		return "const char *"
+	}
+	panic(fmt.Sprintf("minilustre: no C type for %v", t))
+}
+
+// cDecl returns the declaration of a variable.
+func cDecl(t Type, name string) string {
+	s := cType(t)
+	if !strings.HasSuffix(s, "*") {
+		s += " "
+	}
+	return s + name
+}
+
+func cString(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c == '\n':
+			b.WriteString(`\n`)
+		case c == '\t':
+			b.WriteString(`\t`)
+		case c < 0x20 || c >= 0x7F || c == '?':
+			// Octal escapes have at most 3 digits, unlike hexadecimal
+			// ones. '?' is escaped to avoid trigraphs.
+			fmt.Fprintf(&b, `\%03o`, c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+func cConst(v interface{}) string {
+	switch v := v.(type) {
+	case bool:
+		return strconv.FormatBool(v)
+	case int:
+		if v == math.MinInt32 {
+			return "INT32_MIN"
+		} else if v < 0 {
+			return "(" + strconv.Itoa(v) + ")"
+		}
+		return strconv.Itoa(v)
+	case float32:
+		s := strconv.FormatFloat(float64(v), 'g', -1, 32)
+		if !strings.ContainsAny(s, ".e") {
+			s += ".0"
+		}
+		s += "f"
+		if math.Signbit(float64(v)) {
+			return "(" + s + ")"
+		}
+		return s
+	case string:
+		return cString(v)
+	}
+	panic(fmt.Sprintf("minilustre: no C constant for %#v", v))
+}
+
+// cHelpers implement integer operations which wrap around, like in the
+// interpreter. Signed overflow is undefined in C, so computations are done on
+// unsigned integers. Divisions by zero abort the program.
+const cHelpers = `static inline int32_t ml_add(int32_t a, int32_t b)
+{
+	return (int32_t)((uint32_t)a + (uint32_t)b);
+}
+
+static inline int32_t ml_sub(int32_t a, int32_t b)
+{
+	return (int32_t)((uint32_t)a - (uint32_t)b);
+}
+
+static inline int32_t ml_mul(int32_t a, int32_t b)
+{
+	return (int32_t)((uint32_t)a * (uint32_t)b);
+}
+
+static inline int32_t ml_neg(int32_t a)
+{
+	return (int32_t)(0U - (uint32_t)a);
+}
+
+static inline int32_t ml_div(int32_t a, int32_t b)
+{
+	int32_t q;
+	if (b == 0) {
+		abort();
+	} else if (b == -1) {
+		q = ml_neg(a);
+	} else {
+		q = a / b;
+	}
+	return q;
+}
+`
+
+type cgen struct {
+	classes map[string]*Class
+	// Identifiers declared at file scope, by the node they belong to
+	globals map[string]string
+	// C identifiers of the variables of each class
+	vars map[string]map[string]string
+	// Class being generated, and its outputs
+	class *Class
+	out   map[string]bool
+	types map[string]Type
+	mems  map[string]Type
+}
+
+// calledExterns returns the extern classes which are called, in order of
+// first use.
+func (g *cgen) calledExterns(p *Program) []*Class {
+	var externs []*Class
+	declared := make(map[string]bool)
+	for i := range p.Classes {
+		for _, s := range p.Classes[i].Step {
+			call, ok := s.(*StmtCall)
+			if !ok || call.Instance != "" || declared[call.Class] {
+				continue
+			}
+			declared[call.Class] = true
+			externs = append(externs, g.classes[call.Class])
+		}
+	}
+	return externs
+}
+
+// declare records the identifiers declared at file scope. The identifiers
+// generated for distinct nodes are distinct, but externs keep their own name,
+// so an error is returned if it conflicts with an identifier generated for
+// another node.
+func (g *cgen) declare(p *Program) error {
+	for i := range p.Classes {
+		c := &p.Classes[i]
+		if !c.Extern {
+			for _, suffix := range []string{"_state", "_reset", "_step"} {
+				g.globals[cName(c.Name)+suffix] = c.Name
+			}
+		}
+	}
+	for _, c := range g.calledExterns(p) {
+		name := cName(c.Name)
+		if node, ok := g.globals[name]; ok {
+			return fmt.Errorf("minilustre: extern node '%v' conflicts with the C identifier %v of node '%v'", c.Name, name, node)
+		}
+		g.globals[name] = c.Name
+	}
+	return nil
+}
+
+// varNames returns the C identifiers of the variables of a class. Variables
+// are declared in function scope, they are renamed if they would hide a
+// file-scope identifier.
+func (g *cgen) varNames(c *Class) map[string]string {
+	var params []Param
+	for _, l := range [][]Param{c.In, c.Out, c.Locals} {
+		params = append(params, l...)
+	}
+
+	used := make(map[string]bool)
+	for _, param := range params {
+		used[cName(param.Name)] = true
+	}
+	names := make(map[string]string)
+	for _, param := range params {
+		name := cName(param.Name)
+		if _, ok := g.globals[name]; ok {
+			for ok || used[name] {
+				name += "_"
+				_, ok = g.globals[name]
+			}
+			used[name] = true
+		}
+		names[param.Name] = name
+	}
+	return names
+}
+
+func (g *cgen) varName(name string) string {
+	return g.vars[g.class.Name][name]
+}
+
+func (g *cgen) varRef(name string) string {
+	if g.out[name] {
+		return "*" + g.varName(name)
+	}
+	return g.varName(name)
+}
+
+// expr returns the C expression for a simple expression. Binary operators
+// and conditionals are parenthesized unless top is true.
+func (g *cgen) expr(e Expr, top bool) string {
+	paren := func(s string) string {
+		if top {
+			return s
+		}
+		return "(" + s + ")"
+	}
+
+	switch e := e.(type) {
+	case ExprConst:
+		return cConst(e.Value)
+	case ExprVar:
+		return g.varRef(e.Name)
+	case *ExprBinOp:
+		l, r := g.expr(e.Left, false), g.expr(e.Right, false)
+		switch e.Op {
+		case BinOpPlus:
+			return "ml_add(" + l + ", " + r + ")"
+		case BinOpMinus:
+			return "ml_sub(" + l + ", " + r + ")"
+		case BinOpMul:
+			return "ml_mul(" + l + ", " + r + ")"
+		case BinOpDiv:
+			return "ml_div(" + l + ", " + r + ")"
+		case BinOpFPlus:
+			return paren(l + " + " + r)
+		case BinOpFMinus:
+			return paren(l + " - " + r)
+		case BinOpFMul:
+			return paren(l + " * " + r)
+		case BinOpFDiv:
+			return paren(l + " / " + r)
+		case BinOpAnd:
+			return paren(l + " && " + r)
+		case BinOpOr:
+			return paren(l + " || " + r)
+		case BinOpEq:
+			return paren(l + " == " + r)
+		case BinOpNe:
+			return paren(l + " != " + r)
+		case BinOpLt, BinOpGt, BinOpLe, BinOpGe:
+			return paren(l + " " + e.Op.String() + " " + r)
+		}
+	case *ExprUnOp:
+		v := g.expr(e.Expr, false)
+		switch e.Op {
+		case UnOpNot:
+			return paren("!" + v)
+		case UnOpMinus:
+			return "ml_neg(" + v + ")"
+		case UnOpFMinus:
+			return paren("-" + v)
+		}
+	case *ExprIf:
+		return paren(g.expr(e.Cond, false) + " ? " + g.expr(e.Body, false) + " : " + g.expr(e.Else, false))
+	}
+	panic(fmt.Sprintf("minilustre: unexpected expression %T in Obc", e))
+}
+
+// isUnit returns true if a variable of the current class has the unit type.
+// Unit values aren't represented in C.
+func (g *cgen) isUnit(name string) bool {
+	return g.types[name] == TypeUnit
+}
+
+func (g *cgen) stmt(w io.Writer, s Stmt) {
+	switch s := s.(type) {
+	case *StmtAssign:
+		if !g.isUnit(s.Dst) {
+			fmt.Fprintf(w, "\t%v = %v;\n", g.varRef(s.Dst), g.expr(s.Expr, true))
+		}
+	case *StmtMemRead:
+		if !g.isUnit(s.Dst) {
+			fmt.Fprintf(w, "\t%v = self->%v;\n", g.varRef(s.Dst), cName(s.Mem))
+		}
+	case *StmtMemWrite:
+		if g.mems[s.Mem] != TypeUnit {
+			fmt.Fprintf(w, "\tself->%v = %v;\n", cName(s.Mem), g.expr(s.Expr, true))
+		}
+	case *StmtCall:
+		callee := g.classes[s.Class]
+		var args []string
+		if s.Instance != "" {
+			args = append(args, "&self->"+cName(s.Instance))
+		}
+		for _, arg := range s.Args {
+			if v, ok := arg.(ExprVar); ok && g.isUnit(v.Name) {
+				continue
+			}
+			if c, ok := arg.(ExprConst); ok && c.Value == nil {
+				continue
+			}
+			args = append(args, g.expr(arg, true))
+		}
+
+		name := cName(s.Class)
+		if s.Instance != "" {
+			name += "_step"
+		}
+
+		// Extern nodes return their output if they have a single one
+		if ret := cReturned(callee); s.Instance == "" && ret >= 0 {
+			fmt.Fprintf(w, "\t%v = %v(%v);\n", g.varRef(s.Dst[ret]), name, strings.Join(args, ", "))
+			return
+		}
+		for i, dst := range s.Dst {
+			if callee.Out[i].Type == TypeUnit {
+				continue
+			}
+			if g.out[dst] {
+				args = append(args, g.varName(dst))
+			} else {
+				args = append(args, "&"+g.varName(dst))
+			}
+		}
+		fmt.Fprintf(w, "\t%v(%v);\n", name, strings.Join(args, ", "))
+	case *StmtReset:
+		var class string
+		for _, inst := range g.class.Instances {
+			if inst.Name == s.Instance {
+				class = inst.Class
+			}
+		}
+		fmt.Fprintf(w, "\t%v_reset(&self->%v);\n", cName(class), cName(s.Instance))
+	default:
+		panic(fmt.Sprintf("unknown statement %T", s))
+	}
+}
+
+// cReturned returns the index of the output returned by an extern function,
+// or -1 if its outputs are written through pointers.
+func cReturned(c *Class) int {
+	ret := -1
+	n := 0
+	for i, param := range c.Out {
+		if param.Type != TypeUnit {
+			ret = i
+			n++
+		}
+	}
+	if !c.Extern || n > 1 {
+		return -1
+	}
+	return ret
+}
+
+// cParams returns the parameters of a function with the provided inputs and
+// outputs, given the C identifiers of the variables. Outputs are passed as
+// pointers, except the returned one.
+func cParams(in, out []Param, ret int, names map[string]string) []string {
+	var params []string
+	for _, param := range in {
+		if param.Type != TypeUnit {
+			params = append(params, cDecl(param.Type, names[param.Name]))
+		}
+	}
+	for i, param := range out {
+		if param.Type != TypeUnit && i != ret {
+			params = append(params, cDecl(param.Type, "*"+names[param.Name]))
+		}
+	}
+	return params
+}
+
+func (g *cgen) prototype(c *Class, method string) string {
+	self := cName(c.Name) + "_state *self"
+	if method == "reset" {
+		return fmt.Sprintf("void %v_reset(%v)", cName(c.Name), self)
+	}
+	params := append([]string{self}, cParams(c.In, c.Out, -1, g.vars[c.Name])...)
+	return fmt.Sprintf("void %v_step(%v)", cName(c.Name), strings.Join(params, ", "))
+}
+
+func (g *cgen) externPrototype(c *Class) string {
+	ret := cReturned(c)
+	params := cParams(c.In, c.Out, ret, g.vars[c.Name])
+	if len(params) == 0 {
+		params = []string{"void"}
+	}
+	decl := cName(c.Name) + "(" + strings.Join(params, ", ") + ")"
+	if ret < 0 {
+		return "void " + decl
+	}
+	return cDecl(c.Out[ret].Type, decl)
+}
+
+func (g *cgen) header(w io.Writer, p *Program, guard string) {
+	fmt.Fprintf(w, "/* Generated by minilustre, do not edit. */\n\n")
+	fmt.Fprintf(w, "#ifndef %v\n#define %v\n\n", guard, guard)
+	fmt.Fprintf(w, "#include <stdbool.h>\n#include <stdint.h>\n\n")
+
+	// Only declare the extern nodes which are called
+	externs := g.calledExterns(p)
+	if len(externs) > 0 {
+		fmt.Fprintf(w, "/* Implemented outside of the generated code */\n")
+		for _, c := range externs {
+			fmt.Fprintf(w, "%v;\n", g.externPrototype(c))
+		}
+		fmt.Fprintf(w, "\n")
+	}
+
+	for i := range p.Classes {
+		c := &p.Classes[i]
+		if c.Extern {
+			continue
+		}
+
+		fmt.Fprintf(w, "/* Node %v */\n", c.Name)
+		fmt.Fprintf(w, "typedef struct %v_state {\n", cName(c.Name))
+		n := 0
+		for _, param := range c.Mems {
+			if param.Type != TypeUnit {
+				fmt.Fprintf(w, "\t%v;\n", cDecl(param.Type, cName(param.Name)))
+				n++
+			}
+		}
+		for _, inst := range c.Instances {
+			fmt.Fprintf(w, "\t%v_state %v;\n", cName(inst.Class), cName(inst.Name))
+			n++
+		}
+		if n == 0 {
+			// C doesn't allow empty structs
+			fmt.Fprintf(w, "\tuint8_t unused;\n")
+		}
+		fmt.Fprintf(w, "} %v_state;\n\n", cName(c.Name))
+		fmt.Fprintf(w, "%v;\n", g.prototype(c, "reset"))
+		fmt.Fprintf(w, "%v;\n\n", g.prototype(c, "step"))
+	}
+
+	fmt.Fprintf(w, "#endif\n")
+}
+
+func (g *cgen) define(w io.Writer, c *Class) {
+	g.class = c
+	g.out = make(map[string]bool)
+	g.types = make(map[string]Type)
+	g.mems = make(map[string]Type)
+	for _, param := range c.Mems {
+		g.mems[param.Name] = param.Type
+	}
+	for _, params := range [][]Param{c.In, c.Out, c.Locals} {
+		for _, param := range params {
+			g.types[param.Name] = param.Type
+		}
+	}
+	for _, param := range c.Out {
+		g.out[param.Name] = true
+	}
+
+	fmt.Fprintf(w, "\n%v\n{\n", g.prototype(c, "reset"))
+	if len(c.Reset) == 0 {
+		fmt.Fprintf(w, "\t(void)self;\n")
+	}
+	for _, s := range c.Reset {
+		g.stmt(w, s)
+	}
+	fmt.Fprintf(w, "}\n")
+
+	fmt.Fprintf(w, "\n%v\n{\n", g.prototype(c, "step"))
+	n := 0
+	for _, param := range c.Locals {
+		if param.Type != TypeUnit {
+			fmt.Fprintf(w, "\t%v;\n", cDecl(param.Type, g.vars[c.Name][param.Name]))
+			n++
+		}
+	}
+	if n > 0 {
+		fmt.Fprintf(w, "\n")
+	}
+	if c.Stateless() {
+		fmt.Fprintf(w, "\t(void)self;\n")
+	}
+	for _, s := range c.Step {
+		g.stmt(w, s)
+	}
+	fmt.Fprintf(w, "}\n")
+}
+
+// CompileC compiles a file to C99. The header is written to h and the source
+// to c. The source includes the header with the provided name.
+//
+// Each node f is compiled to a state struct f_state, and functions f_reset
+// and f_step taking a pointer to the state as their first argument. The
+// outputs of f_step are written through pointers. Extern nodes which are
+// called are declared in the header: they return their output if they have a
+// single one, otherwise their outputs are written through pointers like
+// f_step. Names which are reserved in C, including the functions of the C
+// standard library, and names ending with an underscore get a trailing
+// underscore. Variables are renamed if they would hide a function or a type.
+// Extern nodes whose name is also generated for another node, such as a_step
+// for a node a, are rejected.
+//
+// Integer divisions by zero abort the program.
+func CompileC(f *File, header string, h, c io.Writer) error {
+	p, err := Translate(f)
+	if err != nil {
+		return err
+	}
+
+	g := cgen{
+		globals: make(map[string]string),
+		vars:    make(map[string]map[string]string),
+		classes: map[string]*Class{
+			"print": {
+				Name:   "print",
+				Extern: true,
+				In:     []Param{{Name: "str", Type: TypeString}},
+				Out:    []Param{{Name: "u", Type: TypeUnit}},
+			},
+		},
+	}
+	for i := range p.Classes {
+		g.classes[p.Classes[i].Name] = &p.Classes[i]
+	}
+	if err := g.declare(p); err != nil {
+		return err
+	}
+	for _, c := range g.classes {
+		g.vars[c.Name] = g.varNames(c)
+	}
+
+	guard := strings.ToUpper(header)
+	guard = strings.Map(func(r rune) rune {
+		if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, guard)
+	if guard == "" || (guard[0] >= '0' && guard[0] <= '9') {
+		guard = "ML_" + guard
+	}
+
+	var hb strings.Builder
+	g.header(&hb, p, guard)
+	if _, err := io.WriteString(h, hb.String()); err != nil {
+		return err
+	}
+
+	var cb strings.Builder
+	fmt.Fprintf(&cb, "/* Generated by minilustre, do not edit. */\n\n")
+	fmt.Fprintf(&cb, "#include <stdlib.h>\n\n#include %v\n\n", cString(header))
+	cb.WriteString(cHelpers)
+	for i := range p.Classes {
+		if !p.Classes[i].Extern {
+			g.define(&cb, &p.Classes[i])
+		}
+	}
+	_, err = io.WriteString(c, cb.String())
+	return err
+}
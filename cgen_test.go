@@ -0,0 +1,153 @@
+package minilustre
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCompileCExterns(t *testing.T) {
+	src := `extern node sin (x: float) returns (y: float);
+extern node other (x: int) returns (y: int);
+
+node f (x: float) returns (o: float);
+let
+  o = sin(x);
+tel
+`
+	f, err := Parse(strings.NewReader(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var h, c strings.Builder
+	if err := CompileC(f, "node.h", &h, &c); err != nil {
+		t.Fatalf("CompileC() = %v", err)
+	}
+	if !strings.Contains(h.String(), "float sin_(float x);\n") {
+		t.Errorf("header doesn't declare sin_:\n%v", h.String())
+	}
+	for _, name := range []string{"print", "other", " sin("} {
+		if strings.Contains(h.String(), name) {
+			t.Errorf("header declares %q:\n%v", name, h.String())
+		}
+	}
+
+	run := cRunner()
+	if run == nil {
+		t.Skip("no C compiler available")
+	}
+	// The generated code must not conflict with the C standard library
+	main := `#include <math.h>
+#include <stdio.h>
+#include "node.h"
+
+float sin_(float x)
+{
+	return x * 2.0f;
+}
+
+int main(void)
+{
+	f_state s;
+	float o;
+	f_reset(&s);
+	f_step(&s, 1.5f, &o);
+	printf("%g\n", (double)o);
+	return 0;
+}
+`
+	stdout, err := run(t, map[string]string{"node.h": h.String(), "node.c": c.String(), "main.c": main})
+	if err != nil {
+		t.Fatalf("failed to run C code: %v", err)
+	}
+	if stdout != "3\n" {
+		t.Errorf("got output %q, want %q", stdout, "3\n")
+	}
+}
+
+func TestCompileCNames(t *testing.T) {
+	// Variables named after functions, and nodes whose generated names look
+	// like the ones of other nodes
+	src := `extern node sq (x: int) returns (y: int);
+
+node a (x: int) returns (y: int);
+let
+  y = 0 fby x;
+tel
+
+node a_step (x: int) returns (y: int);
+let
+  y = x;
+tel
+
+node f (x: int) returns (sq, a_step, self, sq_: int);
+var a_state: int;
+let
+  sq = sq(x);
+  a_state = a(x);
+  a_step = a_step(a_state);
+  self = sq + 1;
+  sq_ = self + 1;
+tel
+`
+	f, err := Parse(strings.NewReader(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var h, c strings.Builder
+	if err := CompileC(f, "node.h", &h, &c); err != nil {
+		t.Fatalf("CompileC() = %v", err)
+	}
+
+	run := cRunner()
+	if run == nil {
+		t.Skip("no C compiler available")
+	}
+	main := `#include <stdio.h>
+#include "node.h"
+
+int32_t sq(int32_t x)
+{
+	return x * x;
+}
+
+int main(void)
+{
+	f_state s;
+	int32_t o1, o2, o3, o4;
+	f_reset(&s);
+	f_step(&s, 3, &o1, &o2, &o3, &o4);
+	f_step(&s, 4, &o1, &o2, &o3, &o4);
+	printf("%d %d %d %d\n", o1, o2, o3, o4);
+	return 0;
+}
+`
+	stdout, err := run(t, map[string]string{"node.h": h.String(), "node.c": c.String(), "main.c": main})
+	if err != nil {
+		t.Fatalf("failed to run C code: %v\n%v", err, c.String())
+	}
+	if want := "16 3 17 18\n"; stdout != want {
+		t.Errorf("got output %q, want %q", stdout, want)
+	}
+}
+
+func TestCompileCExternConflict(t *testing.T) {
+	src := `extern node a_step (x: int) returns (y: int);
+
+node a (x: int) returns (y: int);
+let
+  y = a_step(x);
+tel
+`
+	f, err := Parse(strings.NewReader(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var h, c strings.Builder
+	err = CompileC(f, "node.h", &h, &c)
+	if want := "extern node 'a_step' conflicts with the C identifier a_step of node 'a'"; err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("CompileC() = %v, want an error containing %q", err, want)
+	}
+}
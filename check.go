@@ -0,0 +1,330 @@
+package minilustre
+
+import (
+	"strings"
+)
+
+// formatTypes formats the types of the values of an expression.
+func formatTypes(typs []Type) string {
+	if len(typs) == 1 {
+		return typs[0].String()
+	}
+	l := make([]string, len(typs))
+	for i, t := range typs {
+		l[i] = t.String()
+	}
+	return "(" + strings.Join(l, ", ") + ")"
+}
+
+func equalTypes(a, b []Type) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// binOpType returns the type of the result of a binary operator other than
+// fby, if its operands have valid types.
+func binOpType(op BinOp, left, right Type) (Type, bool) {
+	if left != right {
+		return 0, false
+	}
+	switch op {
+	case BinOpPlus, BinOpMinus, BinOpMul, BinOpDiv:
+		return TypeInt, left == TypeInt
+	case BinOpFPlus, BinOpFMinus, BinOpFMul, BinOpFDiv:
+		return TypeFloat, left == TypeFloat
+	case BinOpGt, BinOpLt, BinOpGe, BinOpLe:
+		return TypeBool, left == TypeInt || left == TypeFloat
+	case BinOpEq, BinOpNe:
+		return TypeBool, left == TypeInt || left == TypeFloat || left == TypeBool
+	case BinOpAnd, BinOpOr:
+		return TypeBool, left == TypeBool
+	}
+	return 0, false
+}
+
+// unOpType returns the type of the result of a unary operator, if its operand
+// has a valid type.
+func unOpType(op UnOp, t Type) (Type, bool) {
+	switch op {
+	case UnOpNot:
+		return TypeBool, t == TypeBool
+	case UnOpMinus:
+		return TypeInt, t == TypeInt
+	case UnOpFMinus:
+		return TypeFloat, t == TypeFloat
+	}
+	return 0, false
+}
+
+// printNode is the declaration of the built-in print node.
+var printNode = Node{
+	Extern:    true,
+	Unsafe:    true,
+	Name:      "print",
+	InParams:  []Param{{Name: "str", Type: TypeString}},
+	OutParams: []Param{{Name: "u", Type: TypeUnit}},
+}
+
+type checker struct {
+	// Nodes which can be called from the node being checked
+	defs   map[string]*Node
+	vars   map[string]Type
+	used   map[string]Pos
+	errors ErrorList
+}
+
+// single checks an expression which must have exactly one value.
+func (c *checker) single(e Expr) (Type, bool) {
+	typs, ok := c.expr(e)
+	if !ok {
+		return 0, false
+	}
+	if len(typs) != 1 {
+		c.errors = append(c.errors, errorf(e.Pos(), "expected a single value, got %v", len(typs)))
+		return 0, false
+	}
+	return typs[0], true
+}
+
+// expr checks an expression, and returns the types of its values. Errors are
+// only reported once: if false is returned, an error has been recorded.
+func (c *checker) expr(e Expr) ([]Type, bool) {
+	switch e := e.(type) {
+	case ExprConst:
+		return []Type{e.Type()}, true
+	case ExprVar:
+		t, ok := c.vars[e.Name]
+		if !ok {
+			c.errors = append(c.errors, errorf(e.NamePos, "undefined variable '%v'", e.Name))
+			return nil, false
+		}
+		if _, ok := c.used[e.Name]; !ok {
+			c.used[e.Name] = e.NamePos
+		}
+		return []Type{t}, true
+	case ExprTuple:
+		var typs []Type
+		ok := true
+		for _, ee := range e {
+			l, eeOk := c.expr(ee)
+			typs = append(typs, l...)
+			ok = ok && eeOk
+		}
+		return typs, ok
+	case *ExprCall:
+		var args []Type
+		ok := true
+		for _, arg := range e.Args {
+			l, argOk := c.expr(arg)
+			args = append(args, l...)
+			ok = ok && argOk
+		}
+
+		callee, defined := c.defs[e.Name]
+		if !defined {
+			c.errors = append(c.errors, errorf(e.NamePos, "undefined node '%v'", e.Name))
+			return nil, false
+		}
+		if !ok {
+			return nil, false
+		}
+
+		if len(args) != len(callee.InParams) {
+			c.errors = append(c.errors, errorf(e.NamePos, "node '%v' expects %v inputs, got %v", e.Name, len(callee.InParams), len(args)))
+			return nil, false
+		}
+		for i, param := range callee.InParams {
+			if args[i] != param.Type {
+				c.errors = append(c.errors, errorf(e.NamePos, "input '%v' of node '%v' has type %v, got %v", param.Name, e.Name, param.Type, args[i]))
+				ok = false
+			}
+		}
+		if !ok {
+			return nil, false
+		}
+
+		typs := make([]Type, len(callee.OutParams))
+		for i, param := range callee.OutParams {
+			typs[i] = param.Type
+		}
+		return typs, true
+	case *ExprBinOp:
+		if e.Op == BinOpFby {
+			left, leftOk := c.expr(e.Left)
+			right, rightOk := c.expr(e.Right)
+			if !leftOk || !rightOk {
+				return nil, false
+			}
+			if !equalTypes(left, right) {
+				c.errors = append(c.errors, errorf(e.OpPos, "fby operands have different types %v and %v", formatTypes(left), formatTypes(right)))
+				return nil, false
+			}
+			return left, true
+		}
+
+		left, leftOk := c.single(e.Left)
+		right, rightOk := c.single(e.Right)
+		if !leftOk || !rightOk {
+			return nil, false
+		}
+		t, ok := binOpType(e.Op, left, right)
+		if !ok {
+			c.errors = append(c.errors, errorf(e.OpPos, "invalid operands of types %v and %v for operator %v", left, right, e.Op))
+			return nil, false
+		}
+		return []Type{t}, true
+	case *ExprUnOp:
+		operand, ok := c.single(e.Expr)
+		if !ok {
+			return nil, false
+		}
+		t, ok := unOpType(e.Op, operand)
+		if !ok {
+			c.errors = append(c.errors, errorf(e.OpPos, "invalid operand of type %v for operator %v", operand, e.Op))
+			return nil, false
+		}
+		return []Type{t}, true
+	case *ExprIf:
+		cond, condOk := c.single(e.Cond)
+		if condOk && cond != TypeBool {
+			c.errors = append(c.errors, errorf(e.Cond.Pos(), "if condition has type %v, expected bool", cond))
+			condOk = false
+		}
+		body, bodyOk := c.expr(e.Body)
+		els, elseOk := c.expr(e.Else)
+		if !condOk || !bodyOk || !elseOk {
+			return nil, false
+		}
+		if !equalTypes(body, els) {
+			c.errors = append(c.errors, errorf(e.If, "if branches have different types %v and %v", formatTypes(body), formatTypes(els)))
+			return nil, false
+		}
+		return body, true
+	}
+	return nil, false
+}
+
+// node checks the declarations and equations of a node.
+func (c *checker) node(n *Node) {
+	c.vars = make(map[string]Type)
+	c.used = make(map[string]Pos)
+	declared := make(map[string]Param)
+	inputs := make(map[string]bool)
+	for _, params := range [][]Param{n.InParams, n.OutParams, n.LocalParams} {
+		for _, param := range params {
+			if prev, ok := declared[param.Name]; ok {
+				c.errors = append(c.errors, errorf(param.Pos, "variable '%v' already declared at %v", param.Name, prev.Pos))
+				continue
+			}
+			declared[param.Name] = param
+			c.vars[param.Name] = param.Type
+		}
+	}
+	for _, param := range n.InParams {
+		inputs[param.Name] = true
+	}
+	if n.Extern {
+		return
+	}
+
+	assigned := make(map[string]Pos)
+	for _, a := range n.Body {
+		ok := true
+		for _, dst := range a.Dst {
+			if _, declared := c.vars[dst]; !declared {
+				c.errors = append(c.errors, errorf(a.Pos, "undefined variable '%v'", dst))
+				ok = false
+			} else if inputs[dst] {
+				c.errors = append(c.errors, errorf(a.Pos, "cannot assign input '%v'", dst))
+				ok = false
+			} else if prev, dup := assigned[dst]; dup {
+				c.errors = append(c.errors, errorf(a.Pos, "variable '%v' already assigned at %v", dst, prev))
+			} else {
+				assigned[dst] = a.Pos
+			}
+		}
+
+		typs, bodyOk := c.expr(a.Body)
+		if !ok || !bodyOk {
+			continue
+		}
+		if len(typs) != len(a.Dst) {
+			c.errors = append(c.errors, errorf(a.Pos, "cannot assign %v values to %v variables", len(typs), len(a.Dst)))
+			continue
+		}
+		for i, dst := range a.Dst {
+			if t := c.vars[dst]; typs[i] != t {
+				c.errors = append(c.errors, errorf(a.Pos, "cannot assign %v to variable '%v' of type %v", typs[i], dst, t))
+			}
+		}
+	}
+
+	for _, param := range n.OutParams {
+		if _, ok := assigned[param.Name]; !ok {
+			pos := param.Pos
+			if !pos.IsValid() {
+				pos = n.Pos
+			}
+			c.errors = append(c.errors, errorf(pos, "output '%v' of node '%v' is never assigned", param.Name, n.Name))
+		}
+	}
+	for _, param := range n.LocalParams {
+		_, ok := assigned[param.Name]
+		if pos, used := c.used[param.Name]; used && !ok {
+			c.errors = append(c.errors, errorf(pos, "variable '%v' is used but never assigned", param.Name))
+		}
+	}
+}
+
+// checkNodeNames reports nodes defined more than once, and nodes which
+// redefine built-in ones.
+func checkNodeNames(f *File) ErrorList {
+	var errs ErrorList
+	defs := make(map[string]*Node)
+	for i := range f.Nodes {
+		n := &f.Nodes[i]
+		if prev, ok := defs[n.Name]; ok {
+			errs = append(errs, errorf(n.Pos, "node '%v' already defined at %v", n.Name, prev.Pos))
+		} else if n.Name == "print" {
+			errs = append(errs, errorf(n.Pos, "node '%v' redefines a built-in node", n.Name))
+		} else {
+			defs[n.Name] = n
+		}
+	}
+	return errs
+}
+
+// Check reports semantic errors in a file: duplicate nodes and variables,
+// calls to undefined nodes, recursive calls, references to undefined
+// variables, variables assigned more than once or never assigned, and type
+// errors. Errors are returned in an ErrorList.
+//
+// Checking a file doesn't modify it. Files which pass the check can be
+// translated by all backends.
+func Check(f *File) error {
+	errs := checkNodeNames(f)
+	if _, err := callOrder(f); err != nil {
+		errs = append(errs, err)
+	}
+
+	c := checker{defs: map[string]*Node{printNode.Name: &printNode}}
+	for i := range f.Nodes {
+		if _, ok := c.defs[f.Nodes[i].Name]; !ok {
+			c.defs[f.Nodes[i].Name] = &f.Nodes[i]
+		}
+	}
+	for i := range f.Nodes {
+		c.node(&f.Nodes[i])
+	}
+
+	errs = append(errs, c.errors...)
+	sortErrors(errs)
+	return errs.Err()
+}
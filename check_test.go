@@ -0,0 +1,176 @@
+package minilustre
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		err  string
+	}{
+		{
+			name: "undefined variable",
+			src:  "node f (x: int) returns (o: int);\nlet\n  o = y;\ntel\n",
+			err:  "3:7: undefined variable 'y'",
+		},
+		{
+			name: "undeclared output",
+			src:  "node f (x: int) returns (o: int);\nlet\n  o = x;\n  p = x;\ntel\n",
+			err:  "4:3: undefined variable 'p'",
+		},
+		{
+			name: "duplicate equation",
+			src:  "node f (x: int) returns (o: int);\nlet\n  o = x;\n  o = 2;\ntel\n",
+			err:  "4:3: variable 'o' already assigned at 3:3",
+		},
+		{
+			name: "duplicate declaration",
+			src:  "node f (x: int) returns (o: int);\nvar x: int;\nlet\n  o = x;\ntel\n",
+			err:  "2:5: variable 'x' already declared at 1:9",
+		},
+		{
+			name: "assigned input",
+			src:  "node f (x: int) returns (o: int);\nlet\n  x = 1;\n  o = x;\ntel\n",
+			err:  "3:3: cannot assign input 'x'",
+		},
+		{
+			name: "unassigned output",
+			src:  "node f (x: int) returns (o, p: int);\nlet\n  o = x;\ntel\n",
+			err:  "1:29: output 'p' of node 'f' is never assigned",
+		},
+		{
+			name: "unassigned local",
+			src:  "node f (x: int) returns (o: int);\nvar a: int;\nlet\n  o = a;\ntel\n",
+			err:  "4:7: variable 'a' is used but never assigned",
+		},
+		{
+			name: "operand types",
+			src:  "node f (x: int) returns (o: int);\nlet\n  o = x + true;\ntel\n",
+			err:  "3:9: invalid operands of types int and bool for operator +",
+		},
+		{
+			name: "float operator",
+			src:  "node f (x: int) returns (o: int);\nlet\n  o = -.x;\ntel\n",
+			err:  "3:7: invalid operand of type int for operator -.",
+		},
+		{
+			name: "if condition",
+			src:  "node f (x: int) returns (o: int);\nlet\n  o = if x then 1 else 2;\ntel\n",
+			err:  "3:10: if condition has type int, expected bool",
+		},
+		{
+			name: "if branches",
+			src:  "node f (x: int) returns (o: int);\nlet\n  o = if true then x else 1.0;\ntel\n",
+			err:  "3:7: if branches have different types int and float",
+		},
+		{
+			name: "fby operands",
+			src:  "node f (x: int) returns (o: int);\nlet\n  o = 0.0 fby x;\ntel\n",
+			err:  "3:11: fby operands have different types float and int",
+		},
+		{
+			name: "assigned type",
+			src:  "node f (x: int) returns (o: bool);\nlet\n  o = x;\ntel\n",
+			err:  "3:3: cannot assign int to variable 'o' of type bool",
+		},
+		{
+			name: "call inputs",
+			src:  "node g (a: int; b: bool) returns (o: int);\nlet\n  o = a;\ntel\n\nnode f (x: int) returns (o: int);\nlet\n  o = g(x, x);\ntel\n",
+			err:  "8:7: input 'b' of node 'g' has type bool, got int",
+		},
+		{
+			name: "call arity",
+			src:  "node f (x: int) returns (o: int);\nlet\n  o = print(\"a\", \"b\");\ntel\n",
+			err:  "3:7: node 'print' expects 1 inputs, got 2",
+		},
+		{
+			name: "tuple size",
+			src:  "node f (x: int) returns (o, p: int);\nlet\n  (o, p) = x + (x, x);\ntel\n",
+			err:  "3:17: expected a single value, got 2",
+		},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			f, err := Parse(strings.NewReader(tc.src))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := Check(f); err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("Check() = %v, want an error containing %q", err, tc.err)
+			}
+
+			// Backends must reject the file too
+			var b bytes.Buffer
+			if err := CompileC(f, "f.h", &b, &b); err == nil {
+				t.Errorf("CompileC() succeeded")
+			}
+			if err := CompileGo(f, "f", &b); err == nil {
+				t.Errorf("CompileGo() succeeded")
+			}
+			if err := CompileWasm(f, &b); err == nil {
+				t.Errorf("CompileWasm() succeeded")
+			}
+		})
+	}
+}
+
+func TestCheckValid(t *testing.T) {
+	src := `node g (x: int; u: unit) returns (a, b: int);
+let
+  (a, b) = (x, -x);
+tel
+
+node f (x: float; c: bool) returns (o: float; n: int);
+var a, b: int; p: unit;
+let
+  (a, b) = if c then g(1, ()) else (0, 0) fby (b, a);
+  n = a * b;
+  o = if n <> 0 and c = false then x *. 2.0 else -.x;
+  p = print("hi");
+tel
+`
+	f, err := Parse(strings.NewReader(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Check(f); err != nil {
+		t.Errorf("Check() = %v", err)
+	}
+}
+
+func TestCheckOrder(t *testing.T) {
+	src := `node f (x: int) returns (o: int);
+let
+  o = y;
+tel
+
+node f (x: int) returns (o: int);
+let
+  o = x + true;
+tel
+`
+	f, err := Parse(strings.NewReader(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = Check(f)
+	l, ok := err.(ErrorList)
+	if !ok {
+		t.Fatalf("Check() = %v, want an ErrorList", err)
+	}
+	var got []string
+	for _, err := range l {
+		got = append(got, err.Pos.String())
+	}
+	if want := []string{"3:7", "6:1", "8:9"}; strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("Check() reported errors at %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/llir/llvm/ir"
+
+	"github.com/emersion/minilustre"
+)
+
+func buildMain(args []string) int {
+	fs := flag.NewFlagSet("build", flag.ExitOnError)
+	noop := fs.Bool("n", false, "don't compile, just print AST")
+	inline := fs.Bool("inline", false, "inline all node calls")
+	noCSE := fs.Bool("no-cse", false, "disable common subexpression elimination")
+	obc := fs.Bool("obc", false, "don't compile, just print the Obc translation")
+	emit := fs.String("emit", "llvm", "output format: llvm, asm, obj, c, go or wasm")
+	target := fs.String("target", "", "LLVM target triple, e.g. thumbv7em-none-eabi")
+	dataLayout := fs.String("datalayout", "", "LLVM data layout")
+	output := fs.String("o", "", "output file, required for obj and C (the header is written next to it)")
+	pkg := fs.String("package", "lustre", "Go package name")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: minilustre build [flags] [file...]\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	isLLVM := *emit == "llvm" || *emit == "asm" || *emit == "obj"
+	if !isLLVM && (*target != "" || *dataLayout != "") {
+		fmt.Fprintf(os.Stderr, "minilustre: -target and -datalayout don't apply to -emit %v\n", *emit)
+		return 2
+	}
+	if (*emit == "obj" || *emit == "c") && *output == "" {
+		fmt.Fprintf(os.Stderr, "minilustre: -emit %v requires -o\n", *emit)
+		return 2
+	}
+	switch *emit {
+	case "llvm", "asm", "obj", "c", "go", "wasm":
+		// Supported
+	default:
+		fmt.Fprintf(os.Stderr, "minilustre: unknown output format %q\n", *emit)
+		return 2
+	}
+
+	f, status := load(fs.Args())
+	if status != 0 {
+		return status
+	}
+	if !prepare(f, *inline, !*noCSE) {
+		return 1
+	}
+
+	if *noop {
+		fmt.Print(f)
+		return 0
+	}
+
+	if *obc {
+		p, err := minilustre.Translate(f)
+		if err != nil {
+			printError("", err)
+			return 1
+		}
+		fmt.Print(p)
+		return 0
+	}
+
+	var out []byte
+	switch *emit {
+	case "llvm", "asm", "obj":
+		m := ir.NewModule()
+		m.TargetTriple = *target
+		m.DataLayout = *dataLayout
+		if err := minilustre.Compile(f, m); err != nil {
+			printError("", err)
+			return 1
+		}
+
+		if *emit != "llvm" {
+			if err := runLLC(m, *emit, *output); err != nil {
+				fmt.Fprintf(os.Stderr, "minilustre: llc: %v\n", err)
+				return 1
+			}
+			return 0
+		}
+		out = []byte(m.String() + "\n")
+	case "c":
+		if err := compileC(f, *output); err != nil {
+			printError("", err)
+			return 1
+		}
+		return 0
+	case "go":
+		var b strings.Builder
+		if err := minilustre.CompileGo(f, *pkg, &b); err != nil {
+			printError("", err)
+			return 1
+		}
+		out = []byte(b.String())
+	case "wasm":
+		var b strings.Builder
+		if err := minilustre.CompileWasm(f, &b); err != nil {
+			printError("", err)
+			return 1
+		}
+		out = []byte(b.String())
+	}
+
+	if err := writeOutput(*output, out); err != nil {
+		fmt.Fprintf(os.Stderr, "minilustre: %v\n", err)
+		return 2
+	}
+	return 0
+}
+
+// writeOutput writes b to a file, or to stdout if filename is empty.
+func writeOutput(filename string, b []byte) error {
+	if filename == "" {
+		_, err := os.Stdout.Write(b)
+		return err
+	}
+	return os.WriteFile(filename, b, 0644)
+}
+
+// runLLC compiles a module to an assembly or object file with llc. The target
+// is the one of the module, or the host if it has none. The output is written
+// to stdout if filename is empty.
+func runLLC(m *ir.Module, filetype, filename string) error {
+	if filename == "" {
+		filename = "-"
+	}
+	cmd := exec.Command("llc", "-filetype="+filetype, "-o", filename)
+	cmd.Stdin = strings.NewReader(m.String())
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// compileC writes the C source to filename, and the header to the same path
+// with a .h extension.
+func compileC(f *minilustre.File, filename string) error {
+	header := strings.TrimSuffix(filename, filepath.Ext(filename)) + ".h"
+
+	h, err := os.Create(header)
+	if err != nil {
+		return err
+	}
+	defer h.Close()
+
+	c, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if err := minilustre.CompileC(f, filepath.Base(header), h, c); err != nil {
+		return err
+	}
+	if err := h.Close(); err != nil {
+		return err
+	}
+	return c.Close()
+}
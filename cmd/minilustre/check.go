@@ -0,0 +1,32 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/emersion/minilustre"
+)
+
+func checkMain(args []string) int {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: minilustre check [file...]\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	f, status := load(fs.Args())
+	if status != 0 {
+		return status
+	}
+	if !prepare(f, false, false) {
+		return 1
+	}
+
+	// Translation reports causality loops
+	if _, err := minilustre.Translate(f); err != nil {
+		printError("", err)
+		return 1
+	}
+	return 0
+}
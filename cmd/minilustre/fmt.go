@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+
+	"github.com/emersion/minilustre"
+)
+
+func fmtMain(args []string) int {
+	fs := flag.NewFlagSet("fmt", flag.ExitOnError)
+	write := fs.Bool("w", false, "write result to source files instead of stdout")
+	diff := fs.Bool("d", false, "display diffs instead of rewriting files")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: minilustre fmt [-w] [-d] [file...]\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		if *write {
+			fmt.Fprintln(os.Stderr, "minilustre: cannot use -w with standard input")
+			return 2
+		}
+		if err := fmtFile("<stdin>", os.Stdin, false, *diff); err != nil {
+			printError("<stdin>", err)
+			return 2
+		}
+		return 0
+	}
+
+	status := 0
+	for _, filename := range fs.Args() {
+		f, err := os.Open(filename)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "minilustre: %v\n", err)
+			status = 2
+			continue
+		}
+		err = fmtFile(filename, f, *write, *diff)
+		f.Close()
+		if err != nil {
+			printError(filename, err)
+			status = 2
+		}
+	}
+	return status
+}
+
+func fmtFile(filename string, r io.Reader, write, diff bool) error {
+	src, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	out, err := minilustre.Format(src)
+	if err != nil {
+		return err
+	}
+
+	if bytes.Equal(src, out) && (write || diff) {
+		return nil
+	}
+
+	if diff {
+		d, err := diffBytes(filename, src, out)
+		if err != nil {
+			return err
+		}
+		os.Stdout.Write(d)
+	}
+	if write {
+		fi, err := os.Stat(filename)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(filename, out, fi.Mode().Perm())
+	}
+	if !diff {
+		os.Stdout.Write(out)
+	}
+	return nil
+}
+
+// diffBytes returns the unified diff between a and b, using diff(1).
+func diffBytes(filename string, a, b []byte) ([]byte, error) {
+	fa, err := writeTempFile(a)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(fa)
+
+	fb, err := writeTempFile(b)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(fb)
+
+	out, err := exec.Command("diff", "-u", "--label", filename+".orig", "--label", filename, fa, fb).Output()
+	if len(out) > 0 {
+		// diff exits with status 1 if the files differ
+		err = nil
+	}
+	return out, err
+}
+
+func writeTempFile(b []byte) (string, error) {
+	f, err := os.CreateTemp("", "minilustre")
+	if err != nil {
+		return "", err
+	}
+	_, err = f.Write(b)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/emersion/minilustre"
+)
+
+func graphMain(args []string) int {
+	fs := flag.NewFlagSet("graph", flag.ExitOnError)
+	calls := fs.Bool("calls", false, "print the call graph instead of the dataflow graph")
+	node := fs.String("node", "", "only print the dataflow graph of this node")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: minilustre graph [-calls] [-node name] [file...]\n\n")
+		fmt.Fprintf(fs.Output(), "The graph is printed in the Graphviz DOT format.\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if *calls && *node != "" {
+		fmt.Fprintf(os.Stderr, "minilustre: -calls and -node are mutually exclusive\n")
+		return 2
+	}
+
+	f, status := load(fs.Args())
+	if status != 0 {
+		return status
+	}
+
+	var err error
+	switch {
+	case *calls:
+		err = minilustre.WriteCallGraph(os.Stdout, f)
+	case *node != "":
+		err = minilustre.WriteDataflowGraph(os.Stdout, f, *node)
+	default:
+		err = minilustre.WriteDataflowGraph(os.Stdout, f)
+	}
+	if err != nil {
+		printError("", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,999 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/emersion/minilustre"
+)
+
+func lspMain(args []string) int {
+	fs := flag.NewFlagSet("lsp", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: minilustre lsp\n\n")
+		fmt.Fprintf(fs.Output(), "Runs a Language Server Protocol server over the standard input and output.\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	s := newLSPServer(os.Stdin, os.Stdout)
+	if err := s.serve(); err != nil {
+		fmt.Fprintf(os.Stderr, "minilustre: lsp: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// JSON-RPC and LSP error codes
+const (
+	lspParseError     = -32700
+	lspInvalidRequest = -32600
+	lspInvalidParams  = -32602
+	lspMethodNotFound = -32601
+	lspRequestFailed  = -32803
+)
+
+// LSP symbol kinds and diagnostic severities
+const (
+	lspSymbolPackage  = 4
+	lspSymbolFunction = 12
+	lspSymbolVariable = 13
+
+	lspSeverityError   = 1
+	lspSeverityWarning = 2
+)
+
+type lspError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (err *lspError) Error() string {
+	return err.Message
+}
+
+type lspMessage struct {
+	JSONRPC string           `json:"jsonrpc"`
+	ID      *json.RawMessage `json:"id,omitempty"`
+	Method  string           `json:"method,omitempty"`
+	Params  json.RawMessage  `json:"params,omitempty"`
+	Result  json.RawMessage  `json:"result,omitempty"`
+	Error   *lspError        `json:"error,omitempty"`
+}
+
+type lspPosition struct {
+	Line      int `json:"line"`
+	Character int `json:"character"`
+}
+
+type lspRange struct {
+	Start lspPosition `json:"start"`
+	End   lspPosition `json:"end"`
+}
+
+type lspLocation struct {
+	URI   string   `json:"uri"`
+	Range lspRange `json:"range"`
+}
+
+type lspDiagnostic struct {
+	Range    lspRange `json:"range"`
+	Severity int      `json:"severity"`
+	Source   string   `json:"source"`
+	Message  string   `json:"message"`
+}
+
+type lspTextDocumentIdentifier struct {
+	URI string `json:"uri"`
+}
+
+type lspTextDocumentPositionParams struct {
+	TextDocument lspTextDocumentIdentifier `json:"textDocument"`
+	Position     lspPosition               `json:"position"`
+}
+
+type lspReferenceParams struct {
+	lspTextDocumentPositionParams
+	Context struct {
+		IncludeDeclaration bool `json:"includeDeclaration"`
+	} `json:"context"`
+}
+
+type lspDidOpenParams struct {
+	TextDocument struct {
+		URI  string `json:"uri"`
+		Text string `json:"text"`
+	} `json:"textDocument"`
+}
+
+type lspDidChangeParams struct {
+	TextDocument   lspTextDocumentIdentifier `json:"textDocument"`
+	ContentChanges []struct {
+		Text string `json:"text"`
+	} `json:"contentChanges"`
+}
+
+type lspDocumentParams struct {
+	TextDocument lspTextDocumentIdentifier `json:"textDocument"`
+}
+
+type lspMarkupContent struct {
+	Kind  string `json:"kind"`
+	Value string `json:"value"`
+}
+
+type lspHover struct {
+	Contents lspMarkupContent `json:"contents"`
+	Range    lspRange         `json:"range"`
+}
+
+type lspDocumentSymbol struct {
+	Name           string              `json:"name"`
+	Detail         string              `json:"detail,omitempty"`
+	Kind           int                 `json:"kind"`
+	Range          lspRange            `json:"range"`
+	SelectionRange lspRange            `json:"selectionRange"`
+	Children       []lspDocumentSymbol `json:"children,omitempty"`
+}
+
+type lspTextEdit struct {
+	Range   lspRange `json:"range"`
+	NewText string   `json:"newText"`
+}
+
+// lspMaxMessageSize is the maximum size of a message, to avoid allocating
+// arbitrary amounts of memory on invalid headers.
+const lspMaxMessageSize = 64 << 20
+
+// readMessage reads a message prefixed with a Content-Length header.
+func readMessage(r *bufio.Reader) ([]byte, error) {
+	length := -1
+	for {
+		line, err := r.ReadString('\n')
+		if err == io.EOF && line == "" {
+			return nil, err
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to read message header: %v", err)
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+
+		k, v, ok := strings.Cut(line, ":")
+		if ok && strings.EqualFold(k, "Content-Length") {
+			if length, err = strconv.Atoi(strings.TrimSpace(v)); err != nil || length < 0 {
+				return nil, fmt.Errorf("invalid Content-Length header: %q", v)
+			} else if length > lspMaxMessageSize {
+				return nil, fmt.Errorf("message too large: %v bytes", length)
+			}
+		}
+	}
+	if length < 0 {
+		return nil, fmt.Errorf("missing Content-Length header")
+	}
+
+	b := make([]byte, length)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, fmt.Errorf("failed to read message: %v", err)
+	}
+	return b, nil
+}
+
+func writeMessage(w io.Writer, msg *lspMessage) error {
+	msg.JSONRPC = "2.0"
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "Content-Length: %v\r\n\r\n", len(b)); err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// lspDocument is a source file, either open in the client or read from disk.
+type lspDocument struct {
+	uri      string
+	filename string
+	text     string
+	// Offsets of the start of each line
+	lines  []int
+	tokens []minilustre.Token
+
+	// The document alone, and linked with the files it includes. Only set for
+	// open documents.
+	parsed, linked *minilustre.File
+}
+
+func newLSPDocument(uri, filename, text string) *lspDocument {
+	d := &lspDocument{uri: uri, filename: filename, text: text, lines: []int{0}}
+	for i := 0; i < len(text); i++ {
+		if text[i] == '\n' {
+			d.lines = append(d.lines, i+1)
+		}
+	}
+
+	s := minilustre.NewScanner(strings.NewReader(text))
+	// Scanner errors consume at least one rune
+	for i := 0; i <= len(text); i++ {
+		tok, err := s.Next()
+		if _, ok := err.(*minilustre.Error); ok {
+			continue
+		} else if err != nil || tok.Kind == minilustre.TokenEOF {
+			break
+		}
+		if tok.Kind != minilustre.TokenComment {
+			d.tokens = append(d.tokens, tok)
+		}
+	}
+	return d
+}
+
+// position converts a byte offset to an LSP position, which counts UTF-16
+// code units.
+func (d *lspDocument) position(offset int) lspPosition {
+	if offset > len(d.text) {
+		offset = len(d.text)
+	}
+	line := sort.Search(len(d.lines), func(i int) bool {
+		return d.lines[i] > offset
+	}) - 1
+	n := 0
+	for _, r := range d.text[d.lines[line]:offset] {
+		n += utf16Len(r)
+	}
+	return lspPosition{line, n}
+}
+
+// offset converts an LSP position to a byte offset.
+func (d *lspDocument) offset(pos lspPosition) int {
+	if pos.Line < 0 {
+		return 0
+	} else if pos.Line >= len(d.lines) {
+		return len(d.text)
+	}
+	offset := d.lines[pos.Line]
+	n := 0
+	for _, r := range d.text[offset:] {
+		if n >= pos.Character || r == '\n' {
+			break
+		}
+		n += utf16Len(r)
+		offset += utf8.RuneLen(r)
+	}
+	return offset
+}
+
+// utf16Len returns the number of UTF-16 code units needed to encode r.
+func utf16Len(r rune) int {
+	if r >= 0x10000 {
+		return 2
+	}
+	return 1
+}
+
+// tokenAt returns the index of the token at offset, or -1. Identifiers are
+// preferred if the offset is between two tokens.
+func (d *lspDocument) tokenAt(offset int) int {
+	index := -1
+	for i, tok := range d.tokens {
+		if tok.Pos.Offset > offset {
+			break
+		}
+		if offset <= tok.Pos.Offset+len(tok.Value) && (index < 0 || tok.Kind == minilustre.TokenIdent) {
+			index = i
+		}
+	}
+	return index
+}
+
+// tokenRange returns the range of the token starting at offset.
+func (d *lspDocument) tokenRange(offset int) lspRange {
+	end := offset
+	for _, tok := range d.tokens {
+		if tok.Pos.Offset == offset {
+			end += len(tok.Value)
+			break
+		}
+	}
+	return lspRange{d.position(offset), d.position(end)}
+}
+
+// nameToken returns the index of the token containing the name of a node.
+func (d *lspDocument) nameToken(n *minilustre.Node) int {
+	for i, tok := range d.tokens {
+		if tok.Pos.Offset >= n.Pos.Offset && tok.Kind == minilustre.TokenIdent {
+			return i
+		}
+	}
+	return -1
+}
+
+// nodeEnd returns the offset following a node.
+func (d *lspDocument) nodeEnd(n *minilustre.Node) int {
+	if n.Tel.IsValid() {
+		return n.Tel.Offset + len("tel")
+	}
+	returns, depth := false, 0
+	end := n.Pos.Offset
+	for _, tok := range d.tokens {
+		if tok.Pos.Offset < n.Pos.Offset {
+			continue
+		}
+		end = tok.Pos.Offset + len(tok.Value)
+		switch tok.Kind {
+		case minilustre.TokenKeyword:
+			returns = returns || tok.Value == "returns"
+		case minilustre.TokenLparen:
+			depth++
+		case minilustre.TokenRparen:
+			depth--
+		case minilustre.TokenSemi:
+			if returns && depth == 0 {
+				return end
+			}
+		}
+	}
+	return end
+}
+
+// nodeAt returns the node of the document containing offset.
+func (d *lspDocument) nodeAt(offset int) *minilustre.Node {
+	if d.linked == nil {
+		return nil
+	}
+	var found *minilustre.Node
+	for i := range d.linked.Nodes {
+		n := &d.linked.Nodes[i]
+		if n.Pos.Filename == d.filename && n.Pos.Offset <= offset && (found == nil || n.Pos.Offset > found.Pos.Offset) {
+			found = n
+		}
+	}
+	if found != nil && offset > d.nodeEnd(found) {
+		return nil
+	}
+	return found
+}
+
+func uriToFilename(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "file" {
+		return uri
+	}
+	return filepath.Clean(filepath.FromSlash(u.Path))
+}
+
+func filenameToURI(filename string) string {
+	if abs, err := filepath.Abs(filename); err == nil {
+		filename = abs
+	}
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(filename)}).String()
+}
+
+type lspServer struct {
+	in       *bufio.Reader
+	out      io.Writer
+	docs     map[string]*lspDocument
+	shutdown bool
+}
+
+func newLSPServer(in io.Reader, out io.Writer) *lspServer {
+	return &lspServer{
+		in:   bufio.NewReader(in),
+		out:  out,
+		docs: make(map[string]*lspDocument),
+	}
+}
+
+// serve handles messages until the exit notification is received.
+func (s *lspServer) serve() error {
+	for {
+		b, err := readMessage(s.in)
+		if err == io.EOF {
+			return fmt.Errorf("unexpected end of input")
+		} else if err != nil {
+			return err
+		}
+
+		var msg lspMessage
+		if err := json.Unmarshal(b, &msg); err != nil {
+			null := json.RawMessage("null")
+			if err := writeMessage(s.out, &lspMessage{ID: &null, Error: &lspError{lspParseError, err.Error()}}); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if msg.Method == "exit" {
+			if !s.shutdown {
+				return fmt.Errorf("exit notification received before shutdown")
+			}
+			return nil
+		} else if s.shutdown {
+			// Only exit is allowed after shutdown, notifications are dropped
+			if msg.ID != nil {
+				resp := lspMessage{ID: msg.ID, Error: &lspError{lspInvalidRequest, "server is shut down"}}
+				if err := writeMessage(s.out, &resp); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		result, err := s.handle(msg.Method, msg.Params)
+		if msg.ID == nil {
+			// Notifications don't have a response
+			continue
+		}
+
+		resp := lspMessage{ID: msg.ID}
+		var lspErr *lspError
+		if errors.As(err, &lspErr) {
+			resp.Error = lspErr
+		} else if err != nil {
+			resp.Error = &lspError{lspRequestFailed, err.Error()}
+		} else if resp.Result, err = json.Marshal(result); err != nil {
+			return err
+		}
+		if err := writeMessage(s.out, &resp); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *lspServer) notify(method string, params interface{}) error {
+	b, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	return writeMessage(s.out, &lspMessage{Method: method, Params: b})
+}
+
+func decodeParams(b json.RawMessage, v interface{}) error {
+	if err := json.Unmarshal(b, v); err != nil {
+		return &lspError{lspInvalidParams, err.Error()}
+	}
+	return nil
+}
+
+func (s *lspServer) handle(method string, params json.RawMessage) (interface{}, error) {
+	switch method {
+	case "initialize":
+		return map[string]interface{}{
+			"capabilities": map[string]interface{}{
+				"textDocumentSync":           1, // Full
+				"hoverProvider":              true,
+				"definitionProvider":         true,
+				"referencesProvider":         true,
+				"documentSymbolProvider":     true,
+				"documentFormattingProvider": true,
+			},
+			"serverInfo": map[string]string{"name": "minilustre"},
+		}, nil
+	case "initialized":
+		return nil, nil
+	case "shutdown":
+		s.shutdown = true
+		return nil, nil
+	case "textDocument/didOpen":
+		var p lspDidOpenParams
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		s.docs[p.TextDocument.URI] = newLSPDocument(p.TextDocument.URI, uriToFilename(p.TextDocument.URI), p.TextDocument.Text)
+		return nil, s.publishDiagnostics()
+	case "textDocument/didChange":
+		var p lspDidChangeParams
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		d, ok := s.docs[p.TextDocument.URI]
+		if !ok || len(p.ContentChanges) == 0 {
+			return nil, nil
+		}
+		text := p.ContentChanges[len(p.ContentChanges)-1].Text
+		s.docs[d.uri] = newLSPDocument(d.uri, d.filename, text)
+		return nil, s.publishDiagnostics()
+	case "textDocument/didClose":
+		var p lspDocumentParams
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		delete(s.docs, p.TextDocument.URI)
+		if err := s.notify("textDocument/publishDiagnostics", map[string]interface{}{
+			"uri":         p.TextDocument.URI,
+			"diagnostics": []lspDiagnostic{},
+		}); err != nil {
+			return nil, err
+		}
+		return nil, s.publishDiagnostics()
+	case "textDocument/hover":
+		var p lspTextDocumentPositionParams
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		return s.hover(&p)
+	case "textDocument/definition":
+		var p lspTextDocumentPositionParams
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		return s.definition(&p)
+	case "textDocument/references":
+		var p lspReferenceParams
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		return s.references(&p)
+	case "textDocument/documentSymbol":
+		var p lspDocumentParams
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		return s.documentSymbols(&p)
+	case "textDocument/formatting":
+		var p lspDocumentParams
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		return s.formatting(&p)
+	default:
+		return nil, &lspError{lspMethodNotFound, fmt.Sprintf("unknown method %q", method)}
+	}
+}
+
+func (s *lspServer) document(uri string) (*lspDocument, error) {
+	d, ok := s.docs[uri]
+	if !ok {
+		return nil, &lspError{lspInvalidParams, fmt.Sprintf("document %q isn't open", uri)}
+	}
+	return d, nil
+}
+
+// readFile reads a source file, using the text of open documents.
+func (s *lspServer) readFile(filename string) ([]byte, error) {
+	filename = filepath.Clean(filename)
+	for _, d := range s.docs {
+		if d.filename == filename {
+			return []byte(d.text), nil
+		}
+	}
+	return os.ReadFile(filename)
+}
+
+// documentFor returns the document of a source file. Files which aren't open
+// are read from disk.
+func (s *lspServer) documentFor(filename string) (*lspDocument, error) {
+	for _, d := range s.docs {
+		if d.filename == filename {
+			return d, nil
+		}
+	}
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return newLSPDocument(filenameToURI(filename), filename, string(b)), nil
+}
+
+// location returns the location of the token at a position.
+func (s *lspServer) location(pos minilustre.Pos) (lspLocation, error) {
+	d, err := s.documentFor(pos.Filename)
+	if err != nil {
+		return lspLocation{}, err
+	}
+	return lspLocation{d.uri, d.tokenRange(pos.Offset)}, nil
+}
+
+// nodeLocation returns the location of the name of a node.
+func (s *lspServer) nodeLocation(n *minilustre.Node) (lspLocation, error) {
+	d, err := s.documentFor(n.Pos.Filename)
+	if err != nil {
+		return lspLocation{}, err
+	}
+	offset := n.Pos.Offset
+	if i := d.nameToken(n); i >= 0 {
+		offset = d.tokens[i].Pos.Offset
+	}
+	return lspLocation{d.uri, d.tokenRange(offset)}, nil
+}
+
+// publishDiagnostics checks all open documents, and sends the errors and
+// warnings found in each document.
+func (s *lspServer) publishDiagnostics() error {
+	uris := make([]string, 0, len(s.docs))
+	for uri := range s.docs {
+		uris = append(uris, uri)
+	}
+	sort.Strings(uris)
+
+	for _, uri := range uris {
+		d := s.docs[uri]
+		diags := s.check(d)
+		if err := s.notify("textDocument/publishDiagnostics", map[string]interface{}{
+			"uri":         d.uri,
+			"diagnostics": diags,
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// check analyzes a document, and returns the errors and warnings it contains.
+// These are the same as the ones reported by the check command.
+func (s *lspServer) check(d *lspDocument) []lspDiagnostic {
+	d.parsed, _ = minilustre.ParseFile(d.filename, strings.NewReader(d.text))
+
+	l := minilustre.Loader{ReadFile: s.readFile}
+	f, err := l.Load(d.filename)
+	d.linked = f
+	if err != nil {
+		return d.diagnostics(err, lspSeverityError)
+	}
+
+	// The passes below modify the file, so check a copy
+	f, err = l.Load(d.filename)
+	if err != nil {
+		return d.diagnostics(err, lspSeverityError)
+	}
+	if err := minilustre.Check(f); err != nil {
+		return d.diagnostics(err, lspSeverityError)
+	}
+	if err := minilustre.Fold(f); err != nil {
+		return d.diagnostics(err, lspSeverityError)
+	}
+	diags := d.diagnostics(minilustre.EliminateDeadCode(f), lspSeverityWarning)
+	if _, err := minilustre.Translate(f); err != nil {
+		diags = append(diags, d.diagnostics(err, lspSeverityError)...)
+	}
+	return diags
+}
+
+// diagnostics converts an error to diagnostics. Errors located in other
+// files are reported at the start of the document.
+func (d *lspDocument) diagnostics(err error, severity int) []lspDiagnostic {
+	diags := []lspDiagnostic{}
+
+	var l minilustre.ErrorList
+	switch err := err.(type) {
+	case nil:
+		return diags
+	case minilustre.ErrorList:
+		l = err
+	case *minilustre.Error:
+		l = minilustre.ErrorList{err}
+	default:
+		return append(diags, lspDiagnostic{
+			Severity: severity,
+			Source:   "minilustre",
+			Message:  strings.TrimPrefix(err.Error(), "minilustre: "),
+		})
+	}
+
+	for _, e := range l {
+		diag := lspDiagnostic{Severity: severity, Source: "minilustre", Message: e.Msg}
+		if e.Pos.IsValid() && e.Pos.Filename == d.filename {
+			diag.Range = d.tokenRange(e.Pos.Offset)
+		} else if e.Pos.IsValid() {
+			diag.Message = e.Pos.String() + ": " + e.Msg
+		}
+		diags = append(diags, diag)
+	}
+	return diags
+}
+
+// lspTarget is the construct under the cursor.
+type lspTarget struct {
+	tok  minilustre.Token
+	node *minilustre.Node
+	// One of the fields below is set
+	variable *minilustre.Param
+	callee   *minilustre.Node
+	expr     minilustre.Expr
+}
+
+// target returns the construct at a position of a document.
+func (s *lspServer) target(d *lspDocument, pos lspPosition) (*lspTarget, bool) {
+	i := d.tokenAt(d.offset(pos))
+	if i < 0 {
+		return nil, false
+	}
+	tok := d.tokens[i]
+	n := d.nodeAt(tok.Pos.Offset)
+	if n == nil {
+		return nil, false
+	}
+	t := &lspTarget{tok: tok, node: n}
+
+	if tok.Kind != minilustre.TokenIdent {
+		t.expr = exprAt(n, tok.Pos.Offset)
+		return t, t.expr != nil
+	}
+
+	if i > 0 && d.tokens[i-1].Kind == minilustre.TokenKeyword && d.tokens[i-1].Value == "node" {
+		t.callee = n
+		return t, true
+	}
+
+	if call, ok := exprAt(n, tok.Pos.Offset).(*minilustre.ExprCall); ok {
+		for j := range d.linked.Nodes {
+			if d.linked.Nodes[j].Name == call.Name {
+				t.callee = &d.linked.Nodes[j]
+				return t, true
+			}
+		}
+		return nil, false
+	}
+
+	for _, params := range [][]minilustre.Param{n.InParams, n.OutParams, n.LocalParams} {
+		for j := range params {
+			if params[j].Name == tok.Value {
+				t.variable = &params[j]
+				return t, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// exprAt returns the call or operator located at offset in a node.
+func exprAt(n *minilustre.Node, offset int) minilustre.Expr {
+	var found minilustre.Expr
+	for _, a := range n.Body {
+		minilustre.Inspect(a.Body, func(e minilustre.Expr) bool {
+			var pos minilustre.Pos
+			switch e := e.(type) {
+			case *minilustre.ExprCall:
+				pos = e.NamePos
+			case *minilustre.ExprBinOp:
+				pos = e.OpPos
+			case *minilustre.ExprUnOp:
+				pos = e.OpPos
+			case *minilustre.ExprIf:
+				pos = e.If
+			default:
+				return found == nil
+			}
+			if pos.IsValid() && pos.Offset == offset {
+				found = e
+			}
+			return found == nil
+		})
+	}
+	return found
+}
+
+func (s *lspServer) hover(p *lspTextDocumentPositionParams) (interface{}, error) {
+	d, err := s.document(p.TextDocument.URI)
+	if err != nil {
+		return nil, err
+	}
+	t, ok := s.target(d, p.Position)
+	if !ok {
+		return nil, nil
+	}
+
+	// There are no sampling operators: all flows are on the base clock
+	var code, doc string
+	switch {
+	case t.variable != nil:
+		code = t.variable.Name + ": " + t.variable.Type.String()
+		kind := "Local variable"
+		for _, param := range t.node.InParams {
+			if param.Name == t.variable.Name {
+				kind = "Input"
+			}
+		}
+		for _, param := range t.node.OutParams {
+			if param.Name == t.variable.Name {
+				kind = "Output"
+			}
+		}
+		doc = fmt.Sprintf("%v of node `%v`, on the base clock.", kind, t.node.Name)
+	case t.callee != nil:
+		n := t.callee
+		header := "node "
+		if n.Extern {
+			header = "extern " + header
+		}
+		if n.Unsafe {
+			header = "unsafe " + header
+		}
+		if n.Inline {
+			header = "inline " + header
+		}
+		code = header + t.tok.Value + " (" + minilustre.FormatParams(n.InParams) + ") returns (" + minilustre.FormatParams(n.OutParams) + ")"
+	default:
+		typ, ok := minilustre.ExprType(d.linked, t.node, t.expr)
+		if !ok {
+			return nil, nil
+		}
+		code = typ.String()
+		doc = "Expression on the base clock."
+		if e, ok := t.expr.(*minilustre.ExprBinOp); ok && e.Op == minilustre.BinOpFby {
+			doc = "Expression on the base clock, delayed by one cycle."
+		}
+	}
+
+	value := "```lustre\n" + code + "\n```"
+	if doc != "" {
+		value += "\n\n" + doc
+	}
+	return &lspHover{
+		Contents: lspMarkupContent{"markdown", value},
+		Range:    d.tokenRange(t.tok.Pos.Offset),
+	}, nil
+}
+
+func (s *lspServer) definition(p *lspTextDocumentPositionParams) (interface{}, error) {
+	d, err := s.document(p.TextDocument.URI)
+	if err != nil {
+		return nil, err
+	}
+	t, ok := s.target(d, p.Position)
+	switch {
+	case !ok || t.expr != nil:
+		return nil, nil
+	case t.variable != nil:
+		return s.location(t.variable.Pos)
+	default:
+		return s.nodeLocation(t.callee)
+	}
+}
+
+func (s *lspServer) references(p *lspReferenceParams) (interface{}, error) {
+	d, err := s.document(p.TextDocument.URI)
+	if err != nil {
+		return nil, err
+	}
+	t, ok := s.target(d, p.Position)
+	if !ok || t.expr != nil {
+		return nil, nil
+	}
+
+	locs := []lspLocation{}
+	if t.variable != nil {
+		end := d.nodeEnd(t.node)
+		for i, tok := range d.tokens {
+			if tok.Pos.Offset < t.node.Pos.Offset || tok.Pos.Offset >= end {
+				continue
+			}
+			if tok.Kind != minilustre.TokenIdent || tok.Value != t.variable.Name {
+				continue
+			}
+			// Skip node names
+			if i+1 < len(d.tokens) && d.tokens[i+1].Kind == minilustre.TokenLparen {
+				continue
+			}
+			if !p.Context.IncludeDeclaration && tok.Pos.Offset == t.variable.Pos.Offset {
+				continue
+			}
+			locs = append(locs, lspLocation{d.uri, d.tokenRange(tok.Pos.Offset)})
+		}
+		return locs, nil
+	}
+
+	if p.Context.IncludeDeclaration {
+		loc, err := s.nodeLocation(t.callee)
+		if err != nil {
+			return nil, err
+		}
+		locs = append(locs, loc)
+	}
+	for _, n := range d.linked.Nodes {
+		for _, a := range n.Body {
+			minilustre.Inspect(a.Body, func(e minilustre.Expr) bool {
+				if call, ok := e.(*minilustre.ExprCall); ok && call.Name == t.callee.Name {
+					if loc, err := s.location(call.NamePos); err == nil {
+						locs = append(locs, loc)
+					}
+				}
+				return true
+			})
+		}
+	}
+	return locs, nil
+}
+
+func (s *lspServer) documentSymbols(p *lspDocumentParams) (interface{}, error) {
+	d, err := s.document(p.TextDocument.URI)
+	if err != nil {
+		return nil, err
+	}
+
+	symbols := []lspDocumentSymbol{}
+	if d.parsed == nil {
+		return symbols, nil
+	}
+	for i := range d.parsed.Packages {
+		pkg := &d.parsed.Packages[i]
+		end := pkg.Pos.Offset
+		if pkg.End.IsValid() {
+			end = pkg.End.Offset + len("end")
+		}
+		nameRange := d.tokenRange(pkg.Pos.Offset)
+		for _, tok := range d.tokens {
+			if tok.Pos.Offset > pkg.Pos.Offset && tok.Kind == minilustre.TokenIdent {
+				nameRange = d.tokenRange(tok.Pos.Offset)
+				break
+			}
+		}
+		symbols = append(symbols, lspDocumentSymbol{
+			Name:           pkg.Name,
+			Kind:           lspSymbolPackage,
+			Range:          lspRange{d.position(pkg.Pos.Offset), d.position(end)},
+			SelectionRange: nameRange,
+			Children:       d.nodeSymbols(pkg.Nodes),
+		})
+	}
+	return append(symbols, d.nodeSymbols(d.parsed.Nodes)...), nil
+}
+
+func (d *lspDocument) nodeSymbols(nodes []minilustre.Node) []lspDocumentSymbol {
+	var symbols []lspDocumentSymbol
+	for i := range nodes {
+		n := &nodes[i]
+		nameRange := d.tokenRange(n.Pos.Offset)
+		if j := d.nameToken(n); j >= 0 {
+			nameRange = d.tokenRange(d.tokens[j].Pos.Offset)
+		}
+
+		var children []lspDocumentSymbol
+		for _, params := range [][]minilustre.Param{n.InParams, n.OutParams, n.LocalParams} {
+			for _, param := range params {
+				r := d.tokenRange(param.Pos.Offset)
+				children = append(children, lspDocumentSymbol{
+					Name:           param.Name,
+					Detail:         param.Type.String(),
+					Kind:           lspSymbolVariable,
+					Range:          r,
+					SelectionRange: r,
+				})
+			}
+		}
+
+		symbols = append(symbols, lspDocumentSymbol{
+			Name:           n.Name,
+			Detail:         "(" + minilustre.FormatParams(n.InParams) + ") returns (" + minilustre.FormatParams(n.OutParams) + ")",
+			Kind:           lspSymbolFunction,
+			Range:          lspRange{d.position(n.Pos.Offset), d.position(d.nodeEnd(n))},
+			SelectionRange: nameRange,
+			Children:       children,
+		})
+	}
+	return symbols
+}
+
+func (s *lspServer) formatting(p *lspDocumentParams) (interface{}, error) {
+	d, err := s.document(p.TextDocument.URI)
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := minilustre.Format([]byte(d.text))
+	if err != nil {
+		return nil, fmt.Errorf("cannot format a document containing errors")
+	}
+	edits := []lspTextEdit{}
+	if string(out) != d.text {
+		edits = append(edits, lspTextEdit{
+			Range:   lspRange{lspPosition{0, 0}, d.position(len(d.text))},
+			NewText: string(out),
+		})
+	}
+	return edits, nil
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// lspClient is a scripted LSP client talking to an in-process server.
+type lspClient struct {
+	t      *testing.T
+	in     *bufio.Reader
+	out    io.Writer
+	nextID int
+	// Notifications received while waiting for responses
+	notifications []lspMessage
+	done          chan error
+}
+
+func newLSPClient(t *testing.T) *lspClient {
+	serverIn, clientOut := io.Pipe()
+	clientIn, serverOut := io.Pipe()
+
+	c := &lspClient{
+		t:    t,
+		in:   bufio.NewReader(clientIn),
+		out:  clientOut,
+		done: make(chan error, 1),
+	}
+	go func() {
+		err := newLSPServer(serverIn, serverOut).serve()
+		serverOut.Close()
+		c.done <- err
+	}()
+	return c
+}
+
+func (c *lspClient) send(msg *lspMessage, params interface{}) {
+	b, err := json.Marshal(params)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	msg.Params = b
+	if err := writeMessage(c.out, msg); err != nil {
+		c.t.Fatalf("failed to send %v: %v", msg.Method, err)
+	}
+}
+
+func (c *lspClient) read() lspMessage {
+	b, err := readMessage(c.in)
+	if err != nil {
+		c.t.Fatalf("failed to read message: %v", err)
+	}
+	var msg lspMessage
+	if err := json.Unmarshal(b, &msg); err != nil {
+		c.t.Fatal(err)
+	}
+	return msg
+}
+
+// call sends a request and decodes the result into result.
+func (c *lspClient) call(method string, params, result interface{}) *lspError {
+	c.nextID++
+	id := json.RawMessage(strings.TrimSpace(string(mustMarshal(c.t, c.nextID))))
+	c.send(&lspMessage{ID: &id, Method: method}, params)
+
+	for {
+		msg := c.read()
+		if msg.ID == nil {
+			c.notifications = append(c.notifications, msg)
+			continue
+		}
+		if string(*msg.ID) != string(id) {
+			c.t.Fatalf("%v: got response with ID %s, want %s", method, *msg.ID, id)
+		}
+		if msg.Error != nil {
+			return msg.Error
+		}
+		if result != nil {
+			if err := json.Unmarshal(msg.Result, result); err != nil {
+				c.t.Fatalf("%v: failed to decode result %s: %v", method, msg.Result, err)
+			}
+		}
+		return nil
+	}
+}
+
+func (c *lspClient) notify(method string, params interface{}) {
+	c.send(&lspMessage{Method: method}, params)
+}
+
+// diagnostics waits for the diagnostics of a document.
+func (c *lspClient) diagnostics(uri string) []lspDiagnostic {
+	for {
+		var msg lspMessage
+		if len(c.notifications) > 0 {
+			msg, c.notifications = c.notifications[0], c.notifications[1:]
+		} else {
+			msg = c.read()
+		}
+		if msg.Method != "textDocument/publishDiagnostics" {
+			continue
+		}
+		var params struct {
+			URI         string          `json:"uri"`
+			Diagnostics []lspDiagnostic `json:"diagnostics"`
+		}
+		if err := json.Unmarshal(msg.Params, &params); err != nil {
+			c.t.Fatal(err)
+		}
+		if params.URI == uri {
+			return params.Diagnostics
+		}
+	}
+}
+
+func mustMarshal(t *testing.T, v interface{}) []byte {
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func textDocument(uri string) map[string]interface{} {
+	return map[string]interface{}{"textDocument": map[string]string{"uri": uri}}
+}
+
+func textDocumentPosition(uri string, line, character int) map[string]interface{} {
+	params := textDocument(uri)
+	params["position"] = lspPosition{line, character}
+	return params
+}
+
+func TestLSP(t *testing.T) {
+	dir := t.TempDir()
+	lib := `package lib
+body
+node incr (x: int) returns (y: int);
+let
+  y = x + 1;
+tel
+end
+`
+	if err := os.WriteFile(filepath.Join(dir, "lib.mls"), []byte(lib), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	filename := filepath.Join(dir, "main.mls")
+	uri := filenameToURI(filename)
+	libURI := filenameToURI(filepath.Join(dir, "lib.mls"))
+	broken := `include "lib.mls";
+
+node main (x: int) returns (o: int);
+let
+  o = lib::incr(x) +;
+tel
+`
+	src := `include "lib.mls";
+
+node main (x: int) returns (o: int);
+var c, unused: int;
+let
+  c = 0 fby c + lib::incr(x);
+  o = c;
+  unused = c;
+tel
+`
+
+	c := newLSPClient(t)
+
+	var init struct {
+		Capabilities map[string]interface{} `json:"capabilities"`
+	}
+	if err := c.call("initialize", map[string]interface{}{"capabilities": map[string]interface{}{}}, &init); err != nil {
+		t.Fatalf("initialize: %v", err)
+	}
+	if init.Capabilities["hoverProvider"] != true {
+		t.Errorf("initialize: missing hover capability: %v", init.Capabilities)
+	}
+	c.notify("initialized", map[string]interface{}{})
+
+	c.notify("textDocument/didOpen", map[string]interface{}{
+		"textDocument": map[string]interface{}{"uri": uri, "languageId": "lustre", "version": 1, "text": broken},
+	})
+	diags := c.diagnostics(uri)
+	if len(diags) != 1 || diags[0].Severity != lspSeverityError || diags[0].Range.Start != (lspPosition{4, 20}) {
+		t.Errorf("didOpen: got diagnostics %+v, want a syntax error at 4:20", diags)
+	}
+
+	c.notify("textDocument/didChange", map[string]interface{}{
+		"textDocument":   map[string]interface{}{"uri": uri, "version": 2},
+		"contentChanges": []map[string]string{{"text": src}},
+	})
+	diags = c.diagnostics(uri)
+	if len(diags) != 1 || diags[0].Severity != lspSeverityWarning || !strings.Contains(diags[0].Message, "unused") {
+		t.Errorf("didChange: got diagnostics %+v, want an unused variable warning", diags)
+	}
+
+	var hover lspHover
+	if err := c.call("textDocument/hover", textDocumentPosition(uri, 5, 2), &hover); err != nil {
+		t.Fatalf("hover: %v", err)
+	}
+	if want := "c: int"; !strings.Contains(hover.Contents.Value, want) || !strings.Contains(hover.Contents.Value, "base clock") {
+		t.Errorf("hover: got %q, want %q on the base clock", hover.Contents.Value, want)
+	}
+	if err := c.call("textDocument/hover", textDocumentPosition(uri, 5, 9), &hover); err != nil {
+		t.Fatalf("hover: %v", err)
+	}
+	if want := "```lustre\nint\n```"; !strings.Contains(hover.Contents.Value, want) || !strings.Contains(hover.Contents.Value, "delayed") {
+		t.Errorf("hover on fby: got %q, want %q", hover.Contents.Value, want)
+	}
+	if err := c.call("textDocument/hover", textDocumentPosition(uri, 5, 20), &hover); err != nil {
+		t.Fatalf("hover: %v", err)
+	}
+	if want := "node lib::incr (x: int) returns (y: int)"; !strings.Contains(hover.Contents.Value, want) {
+		t.Errorf("hover on call: got %q, want %q", hover.Contents.Value, want)
+	}
+
+	var loc lspLocation
+	if err := c.call("textDocument/definition", textDocumentPosition(uri, 6, 6), &loc); err != nil {
+		t.Fatalf("definition: %v", err)
+	}
+	if want := (lspLocation{uri, lspRange{lspPosition{3, 4}, lspPosition{3, 5}}}); loc != want {
+		t.Errorf("definition of c: got %+v, want %+v", loc, want)
+	}
+	if err := c.call("textDocument/definition", textDocumentPosition(uri, 5, 18), &loc); err != nil {
+		t.Fatalf("definition: %v", err)
+	}
+	if want := (lspLocation{libURI, lspRange{lspPosition{2, 5}, lspPosition{2, 9}}}); loc != want {
+		t.Errorf("definition of lib::incr: got %+v, want %+v", loc, want)
+	}
+
+	var refs []lspLocation
+	params := textDocumentPosition(uri, 3, 4)
+	params["context"] = map[string]bool{"includeDeclaration": true}
+	if err := c.call("textDocument/references", params, &refs); err != nil {
+		t.Fatalf("references: %v", err)
+	}
+	if len(refs) != 5 {
+		t.Errorf("references of c: got %v locations, want 5: %+v", len(refs), refs)
+	}
+
+	var symbols []lspDocumentSymbol
+	if err := c.call("textDocument/documentSymbol", textDocument(uri), &symbols); err != nil {
+		t.Fatalf("documentSymbol: %v", err)
+	}
+	if len(symbols) != 1 || symbols[0].Name != "main" || symbols[0].Kind != lspSymbolFunction || len(symbols[0].Children) != 4 {
+		t.Errorf("documentSymbol: got %+v", symbols)
+	} else if r := symbols[0].Range; r.Start != (lspPosition{2, 0}) || r.End != (lspPosition{8, 3}) {
+		t.Errorf("documentSymbol: got range %+v", r)
+	}
+
+	var edits []lspTextEdit
+	if err := c.call("textDocument/formatting", textDocument(uri), &edits); err != nil {
+		t.Fatalf("formatting: %v", err)
+	}
+	if len(edits) != 1 || !strings.Contains(edits[0].NewText, "\tc      = 0 fby c + lib::incr(x);\n") {
+		t.Errorf("formatting: got %+v", edits)
+	}
+
+	if err := c.call("unknown/method", nil, nil); err == nil || err.Code != lspMethodNotFound {
+		t.Errorf("unknown method: got %v, want a method not found error", err)
+	}
+
+	if err := c.call("shutdown", nil, nil); err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+	c.notify("textDocument/didClose", textDocument(uri))
+	if err := c.call("textDocument/documentSymbol", textDocument(uri), nil); err == nil || err.Code != lspInvalidRequest {
+		t.Errorf("request after shutdown: got %v, want an invalid request error", err)
+	}
+	c.notify("exit", nil)
+	// Drain notifications until the server closes its output
+	for {
+		if _, err := readMessage(c.in); err != nil {
+			break
+		}
+	}
+	if err := <-c.done; err != nil {
+		t.Errorf("serve() = %v", err)
+	}
+}
+
+func TestReadMessage(t *testing.T) {
+	tests := []struct {
+		in, err string
+	}{
+		{"Content-Length: 2\r\n\r\n{}", ""},
+		{"Content-Length: 99999999999\r\n\r\n{}", "message too large"},
+		{"Content-Length: -1\r\n\r\n{}", "invalid Content-Length header"},
+		{"\r\n{}", "missing Content-Length header"},
+	}
+	for _, tc := range tests {
+		b, err := readMessage(bufio.NewReader(strings.NewReader(tc.in)))
+		if tc.err == "" && (err != nil || string(b) != "{}") {
+			t.Errorf("readMessage(%q) = %q, %v", tc.in, b, err)
+		} else if tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)) {
+			t.Errorf("readMessage(%q) = %v, want an error containing %q", tc.in, err, tc.err)
+		}
+	}
+}
@@ -1,36 +1,165 @@
 package main
 
 import (
-	"flag"
 	"fmt"
+	"io"
 	"os"
-
-	"github.com/llir/llvm/ir"
+	"strings"
 
 	"github.com/emersion/minilustre"
 )
 
-var (
-	noop = flag.Bool("n", false, "don't compile, just print AST")
-)
+const usage = `usage: minilustre <command> [arguments]
+
+Commands:
+	parse   parse source files and print the AST
+	check   check source files for errors
+	build   compile source files
+	run     run a node with the interpreter
+	fmt     format source files
+	graph   print the dataflow or call graph of source files in DOT format
+	sim     run a node interactively with the interpreter
+	lsp     run a Language Server Protocol server over stdio
+
+Commands read the standard input if no source file is provided. Running
+minilustre with flags only is the same as running minilustre build.
+
+The exit status is 0 on success, 1 if the source files contain errors and 2
+on usage or I/O errors.
+`
 
 func main() {
-	flag.Parse()
+	os.Exit(run(os.Args[1:]))
+}
 
-	f, err := minilustre.Parse(os.Stdin)
-	if err != nil {
-		panic(err)
+func run(args []string) int {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		if len(args) > 0 && (args[0] == "-h" || args[0] == "-help" || args[0] == "--help") {
+			fmt.Print(usage)
+			return 0
+		}
+		return buildMain(args)
 	}
 
-	if *noop {
-		fmt.Println(f)
-		return
+	cmd, args := args[0], args[1:]
+	switch cmd {
+	case "parse", "ast":
+		return parseMain(cmd, args)
+	case "check":
+		return checkMain(args)
+	case "build":
+		return buildMain(args)
+	case "run":
+		return runMain(args)
+	case "fmt":
+		return fmtMain(args)
+	case "graph":
+		return graphMain(args)
+	case "sim":
+		return simMain(args)
+	case "lsp":
+		return lspMain(args)
+	case "help":
+		fmt.Print(usage)
+		return 0
+	default:
+		fmt.Fprintf(os.Stderr, "minilustre: unknown command %q\n\n%v", cmd, usage)
+		return 2
+	}
+}
+
+// load parses source files along with the files they include, and links
+// them. The standard input is read if no file is provided, or for the file
+// "-". Errors are printed, and the returned exit status is non-zero on
+// failure.
+func load(filenames []string) (*minilustre.File, int) {
+	if len(filenames) == 0 {
+		filenames = []string{"-"}
 	}
 
-	m := ir.NewModule()
-	if err := minilustre.Compile(f, m); err != nil {
-		panic(err)
+	names := make([]string, len(filenames))
+	for i, filename := range filenames {
+		names[i] = filename
+		if filename == "-" {
+			names[i] = stdinName
+		}
 	}
 
-	fmt.Println(m)
+	l := minilustre.Loader{ReadFile: readFile}
+	f, err := l.Load(names...)
+	if _, ok := err.(minilustre.ErrorList); ok {
+		printError("", err)
+		return f, 1
+	} else if err != nil {
+		printError("", err)
+		return nil, 2
+	}
+	return f, 0
+}
+
+// stdinName is the file name used for the standard input.
+const stdinName = "<stdin>"
+
+func readFile(filename string) ([]byte, error) {
+	if filename == stdinName {
+		return io.ReadAll(os.Stdin)
+	}
+	return os.ReadFile(filename)
+}
+
+// prepare checks a file and applies the passes run before compilation, and
+// prints warnings. It returns false if the file contains errors.
+func prepare(f *minilustre.File, inline, cse bool) bool {
+	// Passes below may remove invalid equations, check the file first
+	if err := minilustre.Check(f); err != nil {
+		printError("", err)
+		return false
+	}
+	minilustre.Inline(f, inline)
+	if err := minilustre.Fold(f); err != nil {
+		printError("", err)
+		return false
+	}
+	for _, w := range minilustre.EliminateDeadCode(f) {
+		fmt.Fprintf(os.Stderr, "%v: warning: %v\n", w.Pos, w.Msg)
+	}
+	if cse {
+		minilustre.CSE(f)
+	}
+	return true
+}
+
+// printError prints an error which occurred while processing a file. Errors
+// in source files are printed one per line, prefixed with their position.
+// filename is used for positions which don't have one.
+func printError(filename string, err error) {
+	var l minilustre.ErrorList
+	switch err := err.(type) {
+	case minilustre.ErrorList:
+		l = err
+	case *minilustre.Error:
+		l = minilustre.ErrorList{err}
+	default:
+		msg := strings.TrimPrefix(err.Error(), "minilustre: ")
+		if filename != "" {
+			msg = filename + ": " + msg
+		}
+		fmt.Fprintf(os.Stderr, "minilustre: %v\n", msg)
+		return
+	}
+
+	for _, e := range l {
+		pos := e.Pos
+		if pos.Filename == "" {
+			pos.Filename = filename
+		}
+		switch {
+		case pos.IsValid():
+			fmt.Fprintf(os.Stderr, "%v: %v\n", pos, e.Msg)
+		case pos.Filename != "":
+			fmt.Fprintf(os.Stderr, "%v: %v\n", pos.Filename, e.Msg)
+		default:
+			fmt.Fprintf(os.Stderr, "minilustre: %v\n", e.Msg)
+		}
+	}
 }
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExitStatus(t *testing.T) {
+	dir := t.TempDir()
+	loop := filepath.Join(dir, "loop.mls")
+	src := "node f (x: int) returns (y: int);\nlet\n  y = y + x;\ntel\n"
+	if err := os.WriteFile(loop, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	illTyped := filepath.Join(dir, "ill.mls")
+	src = "node f (x: int) returns (y: int);\nlet\n  y = x + true;\ntel\n"
+	if err := os.WriteFile(illTyped, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	seq := "../../testdata/seq.mls"
+	tests := []struct {
+		args   []string
+		status int
+	}{
+		{[]string{"check", seq}, 0},
+		{[]string{"check", seq, "../../testdata/comb.mls"}, 0},
+		{[]string{"build", "-emit", "go", "-o", filepath.Join(dir, "seq.go"), seq}, 0},
+		{[]string{"-o", filepath.Join(dir, "seq.ll"), seq}, 0},
+		{[]string{"graph", seq}, 0},
+		{[]string{"graph", "-calls", seq}, 0},
+		{[]string{"graph", "-node", "minmax", seq}, 0},
+		{[]string{"graph", "-node", "undefined", seq}, 1},
+		{[]string{"check", loop}, 1},
+		{[]string{"check", illTyped}, 1},
+		{[]string{"build", "-emit", "go", "-o", filepath.Join(dir, "ill.go"), illTyped}, 1},
+		{[]string{"build", loop}, 1},
+		{[]string{"run", "-node", "undefined", seq}, 1},
+		{[]string{"sim", "-node", "undefined", seq}, 1},
+		{[]string{"sim", seq, "-node", "undefined"}, 1},
+		{[]string{"sim"}, 2},
+		{[]string{"check", filepath.Join(dir, "missing.mls")}, 2},
+		{[]string{"build", "-emit", "c", seq}, 2},
+		{[]string{"build", "-emit", "go", "-target", "x86_64", seq}, 2},
+		{[]string{"unknown"}, 2},
+	}
+
+	stdout, stderr := os.Stdout, os.Stderr
+	defer func() {
+		os.Stdout, os.Stderr = stdout, stderr
+	}()
+	null, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer null.Close()
+	os.Stdout, os.Stderr = null, null
+
+	for _, tc := range tests {
+		if status := run(tc.args); status != tc.status {
+			t.Errorf("run(%q) = %v, want %v", tc.args, status, tc.status)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	dir := t.TempDir()
+	lib := "package m\nbody\nnode acc (x: int) returns (o: int);\nlet\n  o = x;\ntel\nend\n"
+	if err := os.WriteFile(filepath.Join(dir, "lib.mls"), []byte(lib), 0644); err != nil {
+		t.Fatal(err)
+	}
+	main := filepath.Join(dir, "main.mls")
+	src := "include \"lib.mls\"\n\nnode f (x: int) returns (o: int);\nlet\n  o = m::acc(x);\ntel\n"
+	if err := os.WriteFile(main, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		args           []string
+		want, unwanted []string
+	}{
+		{[]string{"parse", main}, []string{`include "lib.mls"`, "m::acc(x)"}, []string{"m__acc"}},
+		{[]string{"parse", "-json", main}, []string{`"includes"`, `"file": "` + main + `"`}, []string{"m__acc"}},
+		{[]string{"parse", "-link", main}, []string{"node m__acc", "m__acc(x)"}, []string{"include", "::"}},
+		{[]string{"parse", "-link", "-json", main}, []string{`"file": "` + filepath.Join(dir, "lib.mls") + `"`}, []string{`"includes"`}},
+	}
+
+	stdout := os.Stdout
+	defer func() {
+		os.Stdout = stdout
+	}()
+
+	for _, tc := range tests {
+		out := filepath.Join(dir, "out")
+		w, err := os.Create(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		os.Stdout = w
+		status := run(tc.args)
+		os.Stdout = stdout
+		w.Close()
+		if status != 0 {
+			t.Errorf("run(%q) = %v, want 0", tc.args, status)
+			continue
+		}
+
+		b, err := os.ReadFile(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range tc.want {
+			if !strings.Contains(string(b), s) {
+				t.Errorf("run(%q) doesn't print %q:\n%s", tc.args, s, b)
+			}
+		}
+		for _, s := range tc.unwanted {
+			if strings.Contains(string(b), s) {
+				t.Errorf("run(%q) prints %q:\n%s", tc.args, s, b)
+			}
+		}
+	}
+}
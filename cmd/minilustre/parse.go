@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/emersion/minilustre"
+)
+
+func parseMain(name string, args []string) int {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print the AST as JSON (see docs/json.md)")
+	link := fs.Bool("link", false, "print the program linked from the files and the files they include")
+	normalize := fs.Bool("normalize", false, "put equations in normal form (implies -link)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: minilustre %v [-json] [-link] [-normalize] [file...]\n\n", name)
+		fmt.Fprintf(fs.Output(), "Prints the syntax tree of each file, as written. With -link, prints a\n")
+		fmt.Fprintf(fs.Output(), "single file holding the nodes of all files and included files, with\n")
+		fmt.Fprintf(fs.Output(), "the nodes of packages renamed to package__node.\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if !*link && !*normalize {
+		filenames := fs.Args()
+		if len(filenames) == 0 {
+			filenames = []string{"-"}
+		}
+		for _, filename := range filenames {
+			name := filename
+			if filename == "-" {
+				name = stdinName
+			}
+			b, err := readFile(name)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "minilustre: %v\n", err)
+				return 2
+			}
+			f, err := minilustre.ParseFile(name, bytes.NewReader(b))
+			if _, ok := err.(minilustre.ErrorList); ok {
+				printError("", err)
+				return 1
+			} else if err != nil {
+				printError(name, err)
+				return 2
+			}
+			if status := printFile(f, *asJSON); status != 0 {
+				return status
+			}
+		}
+		return 0
+	}
+
+	f, status := load(fs.Args())
+	if status != 0 {
+		return status
+	}
+
+	if *normalize {
+		if err := minilustre.Normalize(f); err != nil {
+			printError("", err)
+			return 1
+		}
+	}
+
+	return printFile(f, *asJSON)
+}
+
+// printFile prints a file as source code or as JSON.
+func printFile(f *minilustre.File, asJSON bool) int {
+	if !asJSON {
+		fmt.Print(f)
+		return 0
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(f); err != nil {
+		fmt.Fprintf(os.Stderr, "minilustre: %v\n", err)
+		return 2
+	}
+	return 0
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/minilustre"
+)
+
+func runMain(args []string) int {
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	node := fs.String("node", "", "node to run (defaults to the last one)")
+	cycles := fs.Int("cycles", 1, "number of cycles to run, for nodes without inputs")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: minilustre run [-node name] [-cycles n] file...\n\n")
+		fmt.Fprintf(fs.Output(), "Inputs are read from the standard input, one line per cycle with one\n")
+		fmt.Fprintf(fs.Output(), "whitespace-separated value per input. Lines starting with '#' are\n")
+		fmt.Fprintf(fs.Output(), "ignored. Outputs are printed one line per cycle.\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	f, status := load(fs.Args())
+	if status != 0 {
+		return status
+	}
+
+	name := *node
+	if name == "" {
+		name = mainNode(f)
+	}
+	it, err := minilustre.NewInterpreter(f, name)
+	if err != nil {
+		printError("", err)
+		return 1
+	}
+	n := it.Node()
+
+	hasInputs := false
+	for _, param := range n.InParams {
+		if param.Type != minilustre.TypeUnit {
+			hasInputs = true
+		}
+	}
+
+	if !hasInputs {
+		for i := 0; i < *cycles; i++ {
+			if status := step(it, make([]interface{}, len(n.InParams))); status != 0 {
+				return status
+			}
+		}
+		return 0
+	}
+
+	scanner := bufio.NewScanner(os.Stdin)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		in, err := parseInputs(n, fields)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "<stdin>:%v: %v\n", line, err)
+			return 1
+		}
+		if status := step(it, in); status != 0 {
+			return status
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		fmt.Fprintf(os.Stderr, "minilustre: %v\n", err)
+		return 2
+	}
+	return 0
+}
+
+// mainNode returns the name of the node run by default: the last one which
+// isn't extern.
+func mainNode(f *minilustre.File) string {
+	var name string
+	for _, n := range f.Nodes {
+		if !n.Extern {
+			name = n.Name
+		}
+	}
+	return name
+}
+
+// step runs one cycle and prints the outputs.
+func step(it *minilustre.Interpreter, in []interface{}) int {
+	out, err := it.Step(in)
+	if err != nil {
+		printError("", err)
+		return 1
+	}
+
+	var l []string
+	for i, param := range it.Node().OutParams {
+		if param.Type != minilustre.TypeUnit {
+			l = append(l, formatValue(out[i]))
+		}
+	}
+	if len(l) > 0 {
+		fmt.Println(strings.Join(l, " "))
+	}
+	return 0
+}
+
+// parseInputs parses one value per non-unit input of a node.
+func parseInputs(n *minilustre.Node, fields []string) ([]interface{}, error) {
+	in := make([]interface{}, len(n.InParams))
+	for i, param := range n.InParams {
+		if param.Type == minilustre.TypeUnit {
+			continue
+		}
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("missing value for input '%v'", param.Name)
+		}
+		s := fields[0]
+		fields = fields[1:]
+
+		var err error
+		switch param.Type {
+		case minilustre.TypeBool:
+			in[i], err = strconv.ParseBool(s)
+		case minilustre.TypeInt:
+			var v int64
+			v, err = strconv.ParseInt(s, 10, 32)
+			in[i] = int(v)
+		case minilustre.TypeFloat:
+			var v float64
+			v, err = strconv.ParseFloat(s, 32)
+			in[i] = float32(v)
+		case minilustre.TypeString:
+			in[i] = s
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for input '%v': %q", param.Name, s)
+		}
+	}
+	if len(fields) > 0 {
+		return nil, fmt.Errorf("too many values")
+	}
+	return in, nil
+}
+
+func formatValue(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "()"
+	case float32:
+		return strconv.FormatFloat(float64(v), 'g', -1, 32)
+	case []interface{}:
+		l := make([]string, len(v))
+		for i, vv := range v {
+			l[i] = formatValue(vv)
+		}
+		return "(" + strings.Join(l, ", ") + ")"
+	}
+	return fmt.Sprint(v)
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/minilustre"
+)
+
+const simHelp = `Type one whitespace-separated value per input to run a cycle, or a command:
+	:reset        go back to the initial state
+	:rewind [n]   undo the last n cycles (defaults to 1)
+	:load file    run one cycle per line of file, in the format of minilustre run
+	:help         print this message
+	:quit         exit the simulator
+`
+
+func simMain(args []string) int {
+	fs := flag.NewFlagSet("sim", flag.ExitOnError)
+	node := fs.String("node", "", "node to simulate (defaults to the last one)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: minilustre sim [-node name] file...\n\n")
+		fmt.Fprintf(fs.Output(), "Runs a node interactively, reading inputs and commands from the\n")
+		fmt.Fprintf(fs.Output(), "standard input. After each cycle, the outputs, the locals and the fby\n")
+		fmt.Fprintf(fs.Output(), "memories are printed.\n\n")
+		fmt.Fprint(fs.Output(), simHelp)
+		fmt.Fprintln(fs.Output())
+		fs.PrintDefaults()
+	}
+
+	// Flags are accepted after file names, as in "sim file.mls -node f"
+	var filenames []string
+	for {
+		fs.Parse(args)
+		if fs.NArg() == 0 {
+			break
+		}
+		filenames = append(filenames, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+
+	// The standard input is used for commands
+	if len(filenames) == 0 {
+		fs.Usage()
+		return 2
+	}
+	for _, filename := range filenames {
+		if filename == "-" {
+			fmt.Fprintf(os.Stderr, "minilustre: sim cannot read source files from the standard input\n")
+			return 2
+		}
+	}
+
+	f, status := load(filenames)
+	if status != 0 {
+		return status
+	}
+
+	name := *node
+	if name == "" {
+		name = mainNode(f)
+	}
+	it, err := minilustre.NewInterpreter(f, name)
+	if err != nil {
+		printError("", err)
+		return 1
+	}
+
+	sim := &simulator{it: it, out: os.Stdout}
+	if err := sim.run(os.Stdin); err != nil {
+		fmt.Fprintf(os.Stderr, "minilustre: %v\n", err)
+		return 2
+	}
+	return 0
+}
+
+// simulator runs a node interactively. It records the inputs of each cycle,
+// so that cycles can be undone by replaying the inputs from the initial
+// state.
+type simulator struct {
+	it      *minilustre.Interpreter
+	out     io.Writer
+	history []simCycle
+}
+
+// simCycle holds the inputs and outputs of a cycle.
+type simCycle struct {
+	in, out []interface{}
+}
+
+func (sim *simulator) run(r io.Reader) error {
+	sim.it.Stdout = sim.out
+	n := sim.it.Node()
+
+	fmt.Fprintf(sim.out, "node %v (%v) returns (%v)\n", n.Name, minilustre.FormatParams(n.InParams), minilustre.FormatParams(n.OutParams))
+	fmt.Fprintf(sim.out, "Type :help for help.\n")
+
+	scanner := bufio.NewScanner(r)
+	for {
+		fmt.Fprintf(sim.out, "%v> ", len(sim.history)+1)
+		if !scanner.Scan() {
+			fmt.Fprintln(sim.out)
+			return scanner.Err()
+		}
+		line := strings.TrimSpace(scanner.Text())
+
+		if !strings.HasPrefix(line, ":") {
+			if line == "" && sim.hasInputs() {
+				continue
+			}
+			in, err := parseInputs(n, strings.Fields(line))
+			if err != nil {
+				fmt.Fprintf(sim.out, "error: %v\n", err)
+				continue
+			}
+			if sim.step(in) {
+				sim.printState()
+			}
+			continue
+		}
+
+		cmd, arg, _ := strings.Cut(line[1:], " ")
+		arg = strings.TrimSpace(arg)
+		switch cmd {
+		case "reset":
+			sim.it.Reset()
+			sim.history = nil
+			fmt.Fprintf(sim.out, "back to the initial state\n")
+		case "rewind":
+			count := 1
+			if arg != "" {
+				var err error
+				if count, err = strconv.Atoi(arg); err != nil || count < 0 {
+					fmt.Fprintf(sim.out, "error: invalid number of cycles %q\n", arg)
+					continue
+				}
+			}
+			if count > len(sim.history) {
+				fmt.Fprintf(sim.out, "error: cannot rewind %v cycles, only %v have been run\n", count, len(sim.history))
+				continue
+			}
+			sim.rewind(len(sim.history) - count)
+			if len(sim.history) == 0 {
+				fmt.Fprintf(sim.out, "back to the initial state\n")
+			} else {
+				sim.printOutputs()
+				sim.printState()
+			}
+		case "load":
+			if arg == "" {
+				fmt.Fprintf(sim.out, "error: missing file name\n")
+				continue
+			}
+			if sim.load(arg) {
+				sim.printState()
+			}
+		case "help":
+			fmt.Fprint(sim.out, simHelp)
+		case "quit", "q":
+			return nil
+		default:
+			fmt.Fprintf(sim.out, "error: unknown command %q, type :help for help\n", cmd)
+		}
+	}
+}
+
+func (sim *simulator) hasInputs() bool {
+	for _, param := range sim.it.Node().InParams {
+		if param.Type != minilustre.TypeUnit {
+			return true
+		}
+	}
+	return false
+}
+
+// step runs one cycle and prints the outputs. On error, the state before the
+// cycle is restored and false is returned.
+func (sim *simulator) step(in []interface{}) bool {
+	out, err := sim.it.Step(in)
+	if err != nil {
+		fmt.Fprintf(sim.out, "error: %v\n", err)
+		sim.rewind(len(sim.history))
+		return false
+	}
+	sim.history = append(sim.history, simCycle{in, out})
+	sim.printOutputs()
+	return true
+}
+
+// printOutputs prints the outputs of the last cycle.
+func (sim *simulator) printOutputs() {
+	cycle := sim.history[len(sim.history)-1]
+	var l []string
+	for i, param := range sim.it.Node().OutParams {
+		l = append(l, fmt.Sprintf("%v = %v", param.Name, formatValue(cycle.out[i])))
+	}
+	fmt.Fprintf(sim.out, "cycle %v: %v\n", len(sim.history), strings.Join(l, ", "))
+}
+
+// rewind goes back to the state after the first n cycles of the history.
+// Side effects of the replayed cycles are discarded. If a cycle fails to be
+// replayed, the error is printed and the simulator stays at the state after
+// the previous cycle.
+func (sim *simulator) rewind(n int) {
+	history := sim.history[:n]
+
+	sim.it.Stdout = io.Discard
+	defer func() {
+		sim.it.Stdout = sim.out
+	}()
+	for {
+		sim.it.Reset()
+		sim.history = nil
+		err := sim.replay(history)
+		if err == nil {
+			return
+		}
+		fmt.Fprintf(sim.out, "error: failed to replay cycle %v: %v\n", len(sim.history)+1, err)
+		// The failed cycle may have left a partial state, replay the cycles
+		// before it again
+		history = sim.history
+	}
+}
+
+// replay runs the cycles of a history, until one of them fails.
+func (sim *simulator) replay(history []simCycle) error {
+	for _, cycle := range history {
+		if _, err := sim.it.Step(cycle.in); err != nil {
+			return err
+		}
+		sim.history = append(sim.history, cycle)
+	}
+	return nil
+}
+
+// load runs one cycle per line of an input file. It returns false if no
+// cycle was run.
+func (sim *simulator) load(filename string) bool {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		fmt.Fprintf(sim.out, "error: %v\n", err)
+		return false
+	}
+
+	ran := false
+	for i, line := range strings.Split(string(b), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		in, err := parseInputs(sim.it.Node(), fields)
+		if err != nil {
+			fmt.Fprintf(sim.out, "error: %v:%v: %v\n", filename, i+1, err)
+			break
+		}
+		if !sim.step(in) {
+			break
+		}
+		ran = true
+	}
+	return ran
+}
+
+// printState prints the locals and the fby memories after a cycle.
+func (sim *simulator) printState() {
+	n := sim.it.Node()
+	vals := sim.it.Values()
+	for _, param := range n.LocalParams {
+		fmt.Fprintf(sim.out, "  %v = %v\n", param.Name, formatValue(vals[param.Name]))
+	}
+
+	for _, mem := range sim.it.Memories() {
+		var path []string
+		for _, call := range mem.Calls {
+			pos := call.Pos()
+			path = append(path, fmt.Sprintf("%v@%v:%v", call.Name, pos.Line, pos.Column))
+		}
+		path = append(path, strings.Join(mem.Vars, ", "))
+		fmt.Fprintf(sim.out, "  [%v] %v: next %v\n", strings.Join(path, " > "), mem.Expr, formatValue(mem.Value))
+	}
+}
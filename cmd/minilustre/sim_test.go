@@ -0,0 +1,124 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/emersion/minilustre"
+)
+
+func TestSim(t *testing.T) {
+	f, err := minilustre.Load("../../testdata/seq.mls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	it, err := minilustre.NewInterpreter(f, "minmax")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inputs := filepath.Join(t.TempDir(), "inputs")
+	if err := os.WriteFile(inputs, []byte("# x\n7\n-2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	script := []string{
+		"3",
+		"-1",
+		"4",
+		":rewind 2",
+		"abc",
+		":load " + inputs,
+		":reset",
+		"5",
+		":rewind 2",
+	}
+	var out strings.Builder
+	sim := &simulator{it: it, out: &out}
+	if err := sim.run(strings.NewReader(strings.Join(script, "\n"))); err != nil {
+		t.Fatalf("run() = %v", err)
+	}
+
+	for _, want := range []string{
+		"node minmax (x: int) returns (min, max: int)\n",
+		"cycle 2: min = -1, max = 3\n",
+		"cycle 3: min = -1, max = 4\n  pmin = -1\n  pmax = 3\n  first = false\n",
+		"[aux1, aux2] (0, 0) fby (min, max): next (-1, 4)\n",
+		"4> cycle 1: min = 3, max = 3\n  pmin = 3\n",
+		"error: invalid value for input 'x': \"abc\"\n",
+		"cycle 2: min = 3, max = 7\ncycle 3: min = -2, max = 7\n",
+		"back to the initial state\n1> cycle 1: min = 5, max = 5\n",
+		"error: cannot rewind 2 cycles, only 1 have been run\n",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output doesn't contain %q:\n%v", want, out.String())
+		}
+	}
+}
+
+func TestSimCalls(t *testing.T) {
+	f, err := minilustre.Load("../../testdata/seq.mls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	it, err := minilustre.NewInterpreter(f, "ramp")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out strings.Builder
+	sim := &simulator{it: it, out: &out}
+	if err := sim.run(strings.NewReader("true\nfalse\n:quit\ntrue\n")); err != nil {
+		t.Fatalf("run() = %v", err)
+	}
+
+	for _, want := range []string{
+		"cycle 2: n = 2, e = 1\n",
+		"[edge_count@7:7 > edge@44:18 > e] false fby b: next false\n",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output doesn't contain %q:\n%v", want, out.String())
+		}
+	}
+	if strings.Contains(out.String(), "cycle 3") {
+		t.Errorf("inputs after :quit were run:\n%v", out.String())
+	}
+}
+
+func TestSimRewindError(t *testing.T) {
+	src := "node f (x: int) returns (o: int);\nlet\n  o = 0 fby (o + 10 / x);\ntel\n"
+	f, err := minilustre.Parse(strings.NewReader(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	it, err := minilustre.NewInterpreter(f, "f")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out strings.Builder
+	sim := &simulator{it: it, out: &out}
+	for _, x := range []int{2, 5, 1} {
+		if !sim.step([]interface{}{x}) {
+			t.Fatalf("step(%v) failed:\n%v", x, out.String())
+		}
+	}
+	// Replaying the second cycle fails
+	sim.history[1].in = []interface{}{0}
+	out.Reset()
+
+	if err := sim.run(strings.NewReader(":rewind 1\n3\n:quit\n")); err != nil {
+		t.Fatalf("run() = %v", err)
+	}
+	for _, want := range []string{
+		"error: failed to replay cycle 2: minilustre: ",
+		"cycle 1: o = 0\n",
+		"cycle 2: o = 5\n",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output doesn't contain %q:\n%v", want, out.String())
+		}
+	}
+}
@@ -2,6 +2,9 @@ package minilustre
 
 import (
 	"fmt"
+	"math"
+	"strconv"
+	"strings"
 
 	"github.com/llir/llvm/ir"
 	"github.com/llir/llvm/ir/constant"
@@ -10,14 +13,96 @@ import (
 	"github.com/llir/llvm/ir/value"
 )
 
+// compiledInstance is an instance held in the state of a class.
+type compiledInstance struct {
+	index int
+	class *compiledClass
+}
+
+// compiledClass holds the LLVM definitions of a class.
+type compiledClass struct {
+	class *Class
+	// State type, and indices of memories and instances in it
+	typ   types.Type
+	mems  map[string]int
+	insts map[string]compiledInstance
+	// Functions implementing the reset and step methods. Extern classes only
+	// have a step function.
+	reset, step *ir.Func
+}
+
 type compiler struct {
-	m     *ir.Module
-	funcs map[string]*ir.Func
+	m       *ir.Module
+	classes map[string]*compiledClass
+	// Integer type as wide as pointers, used for array indices
+	index *types.IntType
+	// Integer division helper, defined on first use
+	div *ir.Func
+}
+
+// divFunc returns the function implementing integer division. Divisions by
+// zero trap, and INT32_MIN / -1 wraps around like in the interpreter. Its name
+// can't conflict with nodes.
+func (c *compiler) divFunc() *ir.Func {
+	if c.div != nil {
+		return c.div
+	}
+
+	a := ir.NewParam("a", types.I32)
+	b := ir.NewParam("b", types.I32)
+	c.div = c.m.NewFunc("minilustre.div", types.I32, a, b)
+	c.div.Linkage = enum.LinkagePrivate
+	trap := c.m.NewFunc("llvm.trap", types.Void)
+
+	entry := c.div.NewBlock("")
+	zero := c.div.NewBlock("zero")
+	nonzero := c.div.NewBlock("nonzero")
+	neg := c.div.NewBlock("neg")
+	div := c.div.NewBlock("div")
+	entry.NewCondBr(entry.NewICmp(enum.IPredEQ, b, constant.NewInt(types.I32, 0)), zero, nonzero)
+	zero.NewCall(trap)
+	zero.NewUnreachable()
+	nonzero.NewCondBr(nonzero.NewICmp(enum.IPredEQ, b, constant.NewInt(types.I32, -1)), neg, div)
+	neg.NewRet(neg.NewSub(constant.NewInt(types.I32, 0), a))
+	div.NewRet(div.NewSDiv(a, b))
+	return c.div
+}
+
+// pointerSize returns the size of pointers in bits for a module. It's read
+// from the data layout if any, otherwise guessed from the target triple.
+// Unknown targets are assumed to have 64-bit pointers.
+func pointerSize(m *ir.Module) int {
+	for _, spec := range strings.Split(m.DataLayout, "-") {
+		l := strings.Split(spec, ":")
+		if len(l) < 2 || (l[0] != "p" && l[0] != "p0") {
+			continue
+		}
+		if size, err := strconv.Atoi(l[1]); err == nil {
+			return size
+		}
+	}
+
+	arch := strings.SplitN(m.TargetTriple, "-", 2)[0]
+	switch {
+	case arch == "avr" || arch == "msp430":
+		return 16
+	case arch == "arm64" || arch == "aarch64" || strings.HasPrefix(arch, "aarch64_"):
+		return 64
+	case strings.HasPrefix(arch, "arm") || strings.HasPrefix(arch, "thumb"),
+		len(arch) == 4 && arch[0] == 'i' && strings.HasSuffix(arch, "86"),
+		arch == "riscv32", arch == "wasm32", arch == "mips", arch == "mipsel",
+		arch == "powerpc", arch == "ppc", arch == "sparc", arch == "xtensa",
+		arch == "hexagon":
+		return 32
+	}
+	return 64
 }
 
 type context struct {
 	b    *ir.Block
 	f    *ir.Func
+	cc   *compiledClass
+	self value.Value
 	vars map[string]value.Value
 	glob int
 }
@@ -38,6 +123,43 @@ func (c *compiler) typ(t Type) types.Type {
 	panic(fmt.Sprintf("unknown type %v", t))
 }
 
+// retTypes returns the types of the values returned by a function with the
+// provided outputs. Unit outputs are omitted.
+func (c *compiler) retTypes(out []Param) []types.Type {
+	var typs []types.Type
+	for _, param := range out {
+		if param.Type != TypeUnit {
+			typs = append(typs, c.typ(param.Type))
+		}
+	}
+	return typs
+}
+
+// retType returns the return type of a function with the provided outputs.
+// Multiple outputs are returned as a pointer to a struct.
+func (c *compiler) retType(out []Param) types.Type {
+	typs := c.retTypes(out)
+	switch len(typs) {
+	case 0:
+		return types.Void
+	case 1:
+		return typs[0]
+	default:
+		return types.NewPointer(types.NewStruct(typs...))
+	}
+}
+
+func (c *compiler) params(in []Param) []*ir.Param {
+	params := make([]*ir.Param, 0, len(in))
+	for _, param := range in {
+		// Unit parameters are omitted
+		if param.Type != TypeUnit {
+			params = append(params, ir.NewParam(param.Name, c.typ(param.Type)))
+		}
+	}
+	return params
+}
+
 func (ctx *context) freshGlobal() string {
 	ctx.glob++
 	return fmt.Sprintf("_%v_%v", ctx.f.GlobalName, ctx.glob)
@@ -45,22 +167,10 @@ func (ctx *context) freshGlobal() string {
 
 func (c *compiler) expr(e Expr, ctx *context) (value.Value, error) {
 	switch e := e.(type) {
-	case *ExprCall:
-		f, ok := c.funcs[e.Name]
-		if !ok {
-			return nil, fmt.Errorf("minilustre: undefined node '%v'", e.Name)
-		}
-		args := make([]value.Value, len(e.Args))
-		for i, arg := range e.Args {
-			var err error
-			args[i], err = c.expr(arg, ctx)
-			if err != nil {
-				return nil, err
-			}
-		}
-		return ctx.b.NewCall(f, args...), nil
 	case ExprConst:
 		switch v := e.Value.(type) {
+		case nil:
+			return constant.NewUndef(types.Void), nil
 		case bool:
 			var i int64 = 0
 			if v {
@@ -69,47 +179,25 @@ func (c *compiler) expr(e Expr, ctx *context) (value.Value, error) {
 			return constant.NewInt(types.I1, i), nil
 		case int:
 			return constant.NewInt(types.I32, int64(v)), nil
+		case float32:
+			return constant.NewFloat(types.Float, float64(v)), nil
 		case string:
 			b := append([]byte(v), 0)
 			glob := c.m.NewGlobalDef(ctx.freshGlobal(), constant.NewCharArray(b))
 			glob.Immutable = true
 			glob.Linkage = enum.LinkagePrivate
-			zero := constant.NewInt(types.I64, 0)
+			zero := constant.NewInt(c.index, 0)
 			ptr := ctx.b.NewGetElementPtr(glob, zero, zero)
 			return ptr, nil
 		default:
 			panic(fmt.Sprintf("unknown const type %T", v))
 		}
 	case ExprVar:
-		v, ok := ctx.vars[string(e)]
+		v, ok := ctx.vars[e.Name]
 		if !ok {
-			//panic(fmt.Sprintf("referring to undefined variable '%v'", string(e)))
-			return nil, fmt.Errorf("minilustre: referring to unknown variable '%v'", string(e))
+			return nil, fmt.Errorf("minilustre: referring to unknown variable '%v'", e.Name)
 		}
-		// if _, ok := v.(*constant.Undef); ok {
-		// 	return nil, fmt.Errorf("minilustre: referring to undefined variable '%v'", string(e))
-		// }
 		return v, nil
-	case ExprTuple:
-		values := make([]value.Value, len(e))
-		typs := make([]types.Type, len(e))
-		for i, ee := range e {
-			var err error
-			values[i], err = c.expr(ee, ctx)
-			if err != nil {
-				return nil, err
-			}
-			typs[i] = values[i].Type()
-		}
-
-		s := ctx.b.NewAlloca(types.NewStruct(typs...))
-		for i, v := range values {
-			ptr := ctx.b.NewGetElementPtr(s, constant.NewInt(types.I32, 0), constant.NewInt(types.I32, int64(i)))
-			ptr.InBounds = true
-			ctx.b.NewStore(v, ptr)
-		}
-
-		return s, nil
 	case *ExprBinOp:
 		left, err := c.expr(e.Left, ctx)
 		if err != nil {
@@ -121,25 +209,86 @@ func (c *compiler) expr(e Expr, ctx *context) (value.Value, error) {
 			return nil, err
 		}
 
+		isFloat := types.IsFloat(left.Type())
 		switch e.Op {
 		case BinOpMinus:
 			return ctx.b.NewSub(left, right), nil
 		case BinOpPlus:
 			return ctx.b.NewAdd(left, right), nil
+		case BinOpMul:
+			return ctx.b.NewMul(left, right), nil
+		case BinOpDiv:
+			return ctx.b.NewCall(c.divFunc(), left, right), nil
+		case BinOpFMinus:
+			return ctx.b.NewFSub(left, right), nil
+		case BinOpFPlus:
+			return ctx.b.NewFAdd(left, right), nil
+		case BinOpFMul:
+			return ctx.b.NewFMul(left, right), nil
+		case BinOpFDiv:
+			return ctx.b.NewFDiv(left, right), nil
 		case BinOpGt:
+			if isFloat {
+				return ctx.b.NewFCmp(enum.FPredOGT, left, right), nil
+			}
 			return ctx.b.NewICmp(enum.IPredSGT, left, right), nil
 		case BinOpLt:
+			if isFloat {
+				return ctx.b.NewFCmp(enum.FPredOLT, left, right), nil
+			}
 			return ctx.b.NewICmp(enum.IPredSLT, left, right), nil
-		case BinOpFby:
-			return left, nil // TODO
+		case BinOpGe:
+			if isFloat {
+				return ctx.b.NewFCmp(enum.FPredOGE, left, right), nil
+			}
+			return ctx.b.NewICmp(enum.IPredSGE, left, right), nil
+		case BinOpLe:
+			if isFloat {
+				return ctx.b.NewFCmp(enum.FPredOLE, left, right), nil
+			}
+			return ctx.b.NewICmp(enum.IPredSLE, left, right), nil
+		case BinOpEq:
+			if isFloat {
+				return ctx.b.NewFCmp(enum.FPredOEQ, left, right), nil
+			}
+			return ctx.b.NewICmp(enum.IPredEQ, left, right), nil
+		case BinOpNe:
+			if isFloat {
+				return ctx.b.NewFCmp(enum.FPredUNE, left, right), nil
+			}
+			return ctx.b.NewICmp(enum.IPredNE, left, right), nil
+		case BinOpAnd:
+			return ctx.b.NewAnd(left, right), nil
+		case BinOpOr:
+			return ctx.b.NewOr(left, right), nil
 		}
 		panic(fmt.Sprintf("unknown binary operation %v", e.Op))
+	case *ExprUnOp:
+		v, err := c.expr(e.Expr, ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		switch e.Op {
+		case UnOpNot:
+			return ctx.b.NewXor(v, constant.NewInt(types.I1, 1)), nil
+		case UnOpMinus:
+			return ctx.b.NewSub(constant.NewInt(types.I32, 0), v), nil
+		case UnOpFMinus:
+			// -0.0 - v negates v, including zeros
+			return ctx.b.NewFSub(constant.NewFloat(types.Float, math.Copysign(0, -1)), v), nil
+		}
+		panic(fmt.Sprintf("unknown unary operation %v", e.Op))
 	case *ExprIf:
 		cond, err := c.expr(e.Cond, ctx)
 		if err != nil {
 			return nil, err
 		}
 
+		if ctx.isUnit(e) {
+			return c.unitIf(cond, e, ctx)
+		}
+
 		body, err := c.expr(e.Body, ctx)
 		if err != nil {
 			return nil, err
@@ -150,122 +299,323 @@ func (c *compiler) expr(e Expr, ctx *context) (value.Value, error) {
 			return nil, err
 		}
 
-		return ctx.b.NewSelect(cond, body, els), nil
+		// Block.NewSelect drops the else operand, build the instruction by
+		// hand
+		inst := ir.NewSelect(cond, body, els)
+		ctx.b.Insts = append(ctx.b.Insts, inst)
+		return inst, nil
 	default:
-		panic(fmt.Sprintf("unknown expression %T", e))
+		// Calls, tuples and fby operators are turned into statements
+		panic(fmt.Sprintf("unexpected expression %T in Obc", e))
+	}
+}
+
+// isUnit returns true if a simple expression has the unit type.
+func (ctx *context) isUnit(e Expr) bool {
+	switch e := e.(type) {
+	case ExprConst:
+		return e.Value == nil
+	case ExprVar:
+		v, ok := ctx.vars[e.Name]
+		return ok && types.IsVoid(v.Type())
+	case *ExprIf:
+		return ctx.isUnit(e.Body)
 	}
+	return false
 }
 
-func (ctx *context) setVar(name string, v value.Value) error {
-	if v, ok := ctx.vars[name]; ok {
-		if _, ok := v.(*constant.Undef); !ok {
-			return fmt.Errorf("minilustre: cannot write variable '%v' twice", name)
+// unitIf compiles an if expression of unit type. Void values can't be
+// selected, so each branch is evaluated in its own block.
+func (c *compiler) unitIf(cond value.Value, e *ExprIf, ctx *context) (value.Value, error) {
+	body := ctx.f.NewBlock("")
+	els := ctx.f.NewBlock("")
+	end := ctx.f.NewBlock("")
+	ctx.b.NewCondBr(cond, body, els)
+
+	for _, branch := range []struct {
+		b *ir.Block
+		e Expr
+	}{{body, e.Body}, {els, e.Else}} {
+		ctx.b = branch.b
+		if _, err := c.expr(branch.e, ctx); err != nil {
+			return nil, err
 		}
+		ctx.b.NewBr(end)
 	}
 
-	ctx.vars[name] = v
-	return nil
+	ctx.b = end
+	return constant.NewUndef(types.Void), nil
 }
 
-func (c *compiler) assign(assign *Assign, ctx *context) error {
-	v, err := c.expr(assign.Body, ctx)
-	if err != nil {
-		return err
+// field returns a pointer to a field of the state of the current instance.
+func (ctx *context) field(i int) value.Value {
+	ptr := ctx.b.NewGetElementPtr(ctx.self, constant.NewInt(types.I32, 0), constant.NewInt(types.I32, int64(i)))
+	ptr.InBounds = true
+	return ptr
+}
+
+// call calls a function and assigns its outputs to variables.
+func (c *compiler) call(s *StmtCall, callee *compiledClass, self value.Value, ctx *context) error {
+	var args []value.Value
+	if self != nil {
+		args = append(args, self)
 	}
+	for _, arg := range s.Args {
+		v, err := c.expr(arg, ctx)
+		if err != nil {
+			return err
+		}
+		// Unit parameters are omitted
+		if !types.IsVoid(v.Type()) {
+			args = append(args, v)
+		}
+	}
+	ret := ctx.b.NewCall(callee.step, args...)
 
-	if len(assign.Dst) == 1 {
-		return ctx.setVar(assign.Dst[0], v)
-	} else if len(assign.Dst) > 1 {
-		for i, dst := range assign.Dst {
-			ptr := ctx.b.NewGetElementPtr(v, constant.NewInt(types.I32, 0), constant.NewInt(types.I32, int64(i)))
+	out := callee.class.Out
+	if len(s.Dst) != len(out) {
+		return fmt.Errorf("minilustre: node '%v' has %v outputs, got %v variables", callee.class.Name, len(out), len(s.Dst))
+	}
+	multiple := len(c.retTypes(out)) > 1
+	i := 0
+	for j, dst := range s.Dst {
+		switch {
+		case out[j].Type == TypeUnit:
+			ctx.vars[dst] = constant.NewUndef(types.Void)
+		case multiple:
+			ptr := ctx.b.NewGetElementPtr(ret, constant.NewInt(types.I32, 0), constant.NewInt(types.I32, int64(i)))
 			ptr.InBounds = true
-			vv := ctx.b.NewLoad(ptr)
-			if err := ctx.setVar(dst, vv); err != nil {
-				return err
-			}
+			ctx.vars[dst] = ctx.b.NewLoad(ptr)
+			i++
+		default:
+			ctx.vars[dst] = ret
 		}
-
-		return nil
-	} else {
-		panic("cannot assign to nothing")
 	}
+	return nil
 }
 
-func (c *compiler) node(n *Node) error {
-	vars := make(map[string]value.Value, len(n.InParams)+len(n.OutParams)+len(n.LocalParams))
-	params := make([]*ir.Param, 0, len(n.InParams))
-	retTypes := make([]types.Type, 0, len(n.OutParams))
-	retNames := make([]string, 0, len(n.OutParams))
-	for name, typ := range n.InParams {
-		if typ != TypeUnit {
-			p := ir.NewParam(name, c.typ(typ))
-			params = append(params, p)
-			vars[name] = p
-		} else {
-			vars[name] = constant.NewUndef(c.typ(typ))
+func (c *compiler) stmt(s Stmt, ctx *context) error {
+	switch s := s.(type) {
+	case *StmtAssign:
+		v, err := c.expr(s.Expr, ctx)
+		if err != nil {
+			return err
 		}
-	}
-	for name, typ := range n.OutParams {
-		// TODO
-		vars[name] = constant.NewUndef(c.typ(typ))
-		if typ != TypeUnit {
-			retTypes = append(retTypes, vars[name].Type())
-			retNames = append(retNames, name)
+		ctx.vars[s.Dst] = v
+	case *StmtMemRead:
+		i, ok := ctx.cc.mems[s.Mem]
+		if !ok {
+			// Unit memories aren't stored
+			ctx.vars[s.Dst] = constant.NewUndef(types.Void)
+			return nil
 		}
+		ctx.vars[s.Dst] = ctx.b.NewLoad(ctx.field(i))
+	case *StmtMemWrite:
+		v, err := c.expr(s.Expr, ctx)
+		if err != nil {
+			return err
+		}
+		if i, ok := ctx.cc.mems[s.Mem]; ok {
+			ctx.b.NewStore(v, ctx.field(i))
+		}
+	case *StmtCall:
+		callee, ok := c.classes[s.Class]
+		if !ok {
+			return fmt.Errorf("minilustre: undefined node '%v'", s.Class)
+		}
+		var self value.Value
+		if s.Instance != "" {
+			inst := ctx.cc.insts[s.Instance]
+			callee = inst.class
+			self = ctx.field(inst.index)
+		}
+		return c.call(s, callee, self, ctx)
+	case *StmtReset:
+		inst := ctx.cc.insts[s.Instance]
+		ctx.b.NewCall(inst.class.reset, ctx.field(inst.index))
+	default:
+		panic(fmt.Sprintf("unknown statement %T", s))
+	}
+	return nil
+}
+
+// method defines the function implementing a method of a class. Its first
+// parameter is a pointer to the state of the instance.
+func (c *compiler) method(cc *compiledClass, name string, in []Param, retType types.Type) (*ir.Func, *context) {
+	self := ir.NewParam("self", types.NewPointer(cc.typ))
+	params := append([]*ir.Param{self}, c.params(in)...)
+	f := c.m.NewFunc(cc.class.Name+"."+name, retType, params...)
+
+	vars := make(map[string]value.Value)
+	for _, param := range in {
+		vars[param.Name] = constant.NewUndef(types.Void)
 	}
-	for name, typ := range n.LocalParams {
-		vars[name] = constant.NewUndef(c.typ(typ))
+	for _, p := range params[1:] {
+		vars[p.LocalName] = p
 	}
 
-	var retType types.Type = types.Void
-	if len(retTypes) == 1 {
-		retType = retTypes[0]
-	} else if len(retTypes) > 1 {
-		retType = types.NewPointer(types.NewStruct(retTypes...))
+	return f, &context{b: f.NewBlock(""), f: f, cc: cc, self: self, vars: vars}
+}
+
+// output returns the value of an output at the end of a step method. Outputs
+// which are never assigned are undefined.
+func (ctx *context) output(param Param, t types.Type) value.Value {
+	if v, ok := ctx.vars[param.Name]; ok {
+		return v
 	}
+	return constant.NewUndef(t)
+}
 
-	f := c.m.NewFunc(n.Name, retType, params...)
-	entry := f.NewBlock("")
+func (c *compiler) class(class *Class) error {
+	cc := &compiledClass{
+		class: class,
+		mems:  make(map[string]int),
+		insts: make(map[string]compiledInstance),
+	}
+
+	if class.Extern {
+		cc.step = c.m.NewFunc(class.Name, c.retType(class.Out), c.params(class.In)...)
+		c.classes[class.Name] = cc
+		return nil
+	}
+
+	var fields []types.Type
+	for _, param := range class.Mems {
+		if param.Type != TypeUnit {
+			cc.mems[param.Name] = len(fields)
+			fields = append(fields, c.typ(param.Type))
+		}
+	}
+	for _, inst := range class.Instances {
+		callee, ok := c.classes[inst.Class]
+		if !ok {
+			return fmt.Errorf("minilustre: undefined node '%v'", inst.Class)
+		}
+		cc.insts[inst.Name] = compiledInstance{len(fields), callee}
+		fields = append(fields, callee.typ)
+	}
+	cc.typ = c.m.NewTypeDef(class.Name, types.NewStruct(fields...))
+
+	reset, ctx := c.method(cc, "reset", nil, types.Void)
+	for _, s := range class.Reset {
+		if err := c.stmt(s, ctx); err != nil {
+			return fmt.Errorf("failed to compile node '%v': %v", class.Name, err)
+		}
+	}
+	ctx.b.NewRet(nil)
+	cc.reset = reset
 
-	ctx := context{b: entry, f: f, vars: vars}
-	for _, assign := range n.Body {
-		if err := c.assign(&assign, &ctx); err != nil {
-			return fmt.Errorf("failed to compile node '%v': %v", n.Name, err)
+	retType := c.retType(class.Out)
+	step, ctx := c.method(cc, "step", class.In, retType)
+	for _, s := range class.Step {
+		if err := c.stmt(s, ctx); err != nil {
+			return fmt.Errorf("failed to compile node '%v': %v", class.Name, err)
 		}
 	}
 
 	var ret value.Value
-	if len(retTypes) == 1 {
-		ret = vars[retNames[0]]
-	} else if len(retTypes) > 1 {
-		glob := c.m.NewGlobalDef(f.GlobalName + "_ret", constant.NewUndef(types.NewStruct(retTypes...)))
+	if retTypes := c.retTypes(class.Out); len(retTypes) > 1 {
+		glob := c.m.NewGlobalDef(class.Name+".ret", constant.NewUndef(types.NewStruct(retTypes...)))
 		glob.Linkage = enum.LinkagePrivate
 
-		for i, name := range retNames {
+		i := 0
+		for _, param := range class.Out {
+			if param.Type == TypeUnit {
+				continue
+			}
 			ptr := ctx.b.NewGetElementPtr(glob, constant.NewInt(types.I32, 0), constant.NewInt(types.I32, int64(i)))
 			ptr.InBounds = true
-			ctx.b.NewStore(vars[name], ptr)
+			ctx.b.NewStore(ctx.output(param, c.typ(param.Type)), ptr)
+			i++
 		}
 
 		ret = glob
+	} else if !types.IsVoid(retType) {
+		for _, param := range class.Out {
+			if param.Type != TypeUnit {
+				ret = ctx.output(param, retType)
+			}
+		}
 	}
+	ctx.b.NewRet(ret)
+	cc.step = step
 
-	entry.NewRet(ret)
-
-	c.funcs[n.Name] = f
+	c.wrapper(cc)
+	c.classes[class.Name] = cc
 	return nil
 }
 
+// wrapper defines a function named after the class, which steps a global
+// instance. The instance is reset on the first call.
+func (c *compiler) wrapper(cc *compiledClass) {
+	params := c.params(cc.class.In)
+	f := c.m.NewFunc(cc.class.Name, cc.step.Sig.RetType, params...)
+
+	state := c.m.NewGlobalDef(cc.class.Name+".state", constant.NewZeroInitializer(cc.typ))
+	state.Linkage = enum.LinkagePrivate
+
+	entry := f.NewBlock("")
+	step := entry
+	if len(cc.class.Reset) > 0 {
+		initialized := c.m.NewGlobalDef(cc.class.Name+".initialized", constant.NewInt(types.I1, 0))
+		initialized.Linkage = enum.LinkagePrivate
+
+		reset := f.NewBlock("reset")
+		step = f.NewBlock("step")
+		entry.NewCondBr(entry.NewLoad(initialized), step, reset)
+		reset.NewCall(cc.reset, state)
+		reset.NewStore(constant.NewInt(types.I1, 1), initialized)
+		reset.NewBr(step)
+	}
+
+	args := []value.Value{state}
+	for _, p := range params {
+		args = append(args, p)
+	}
+	ret := step.NewCall(cc.step, args...)
+	if types.IsVoid(cc.step.Sig.RetType) {
+		step.NewRet(nil)
+	} else {
+		step.NewRet(ret)
+	}
+}
+
+// Compile compiles a file to LLVM IR. The file is translated to Obc first.
+//
+// Each node f is compiled to a state type %f and to functions @f.reset and
+// @f.step taking a pointer to the state as their first argument. A function
+// @f with the node's inputs and outputs steps a global instance of the node.
+// Extern nodes are declared as functions with their inputs and outputs. Other
+// symbols contain a dot, so they can't collide with node names.
+//
+// Integer divisions by zero trap.
+//
+// The target triple and data layout of m, if set, are used to pick the width
+// of pointer-sized integers.
 func Compile(f *File, m *ir.Module) error {
+	p, err := Translate(f)
+	if err != nil {
+		return err
+	}
+
 	c := compiler{
-		m: m,
-		funcs: map[string]*ir.Func{
-			"print": m.NewFunc("print", types.Void, ir.NewParam("str", types.I8Ptr)),
+		m:     m,
+		index: types.NewInt(uint64(pointerSize(m))),
+		classes: map[string]*compiledClass{
+			"print": {
+				class: &Class{
+					Name:   "print",
+					Extern: true,
+					In:     []Param{{Name: "str", Type: TypeString}},
+					Out:    []Param{{Name: "u", Type: TypeUnit}},
+				},
+				step: m.NewFunc("print", types.Void, ir.NewParam("str", types.I8Ptr)),
+			},
 		},
 	}
 
-	for _, n := range f.Nodes {
-		if err := c.node(&n); err != nil {
+	for i := range p.Classes {
+		if err := c.class(&p.Classes[i]); err != nil {
 			return err
 		}
 	}
@@ -0,0 +1,162 @@
+package minilustre
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/llir/llvm/ir"
+)
+
+func TestPointerSize(t *testing.T) {
+	tests := []struct {
+		triple, dataLayout string
+		size               int
+	}{
+		{"", "", 64},
+		{"x86_64-unknown-linux-gnu", "", 64},
+		{"aarch64-linux-gnu", "", 64},
+		{"thumbv7em-none-eabi", "", 32},
+		{"armv6m-none-eabi", "", 32},
+		{"i686-pc-linux-gnu", "", 32},
+		{"riscv32-unknown-elf", "", 32},
+		{"avr", "", 16},
+		{"x86_64-unknown-linux-gnu", "e-m:e-p:32:32-i64:64-n32:64-S128", 32},
+		{"thumbv7em-none-eabi", "e-p270:32:32-p0:64:64", 64},
+	}
+	for _, tc := range tests {
+		m := ir.NewModule()
+		m.TargetTriple = tc.triple
+		m.DataLayout = tc.dataLayout
+		if size := pointerSize(m); size != tc.size {
+			t.Errorf("pointerSize(%q, %q) = %v, want %v", tc.triple, tc.dataLayout, size, tc.size)
+		}
+	}
+}
+
+func TestCompileTarget(t *testing.T) {
+	f := parseFile(t, "testdata/simple.mls")
+
+	m := ir.NewModule()
+	m.TargetTriple = "thumbv7em-none-eabi"
+	m.DataLayout = "e-m:e-p:32:32-Fi8-i64:64-v128:64:128-a:0:32-n32-S64"
+	if err := Compile(f, m); err != nil {
+		t.Fatalf("Compile() = %v", err)
+	}
+
+	ll := m.String()
+	if !strings.Contains(ll, "i32 0, i32 0") || strings.Contains(ll, "i64 ") {
+		t.Errorf("Compile() used 64-bit indices on a 32-bit target:\n%v", ll)
+	}
+
+	llc, err := exec.LookPath("llc")
+	if err != nil {
+		t.Skip("llc not available")
+	}
+	cmd := exec.Command(llc, "-filetype=obj", "-o", "/dev/null")
+	cmd.Stdin = strings.NewReader(ll)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Errorf("llc failed: %v\n%s", err, out)
+	}
+}
+
+func TestCompileUnassignedOutput(t *testing.T) {
+	src := "node f (x: int) returns (o, p: int);\nlet\n  o = x;\ntel\n"
+	f, err := Parse(strings.NewReader(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := ir.NewModule()
+	err = Compile(f, m)
+	if want := "output 'p' of node 'f' is never assigned"; err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("Compile() = %v, want an error containing %q", err, want)
+	}
+	if ll := m.String(); strings.Contains(ll, "%!") {
+		t.Errorf("Compile() emitted invalid IR:\n%v", ll)
+	}
+}
+
+func TestCompileNameCollisions(t *testing.T) {
+	src := `node a (x: int) returns (y, z: int);
+let
+  y = 0 fby x;
+  z = x;
+tel
+
+node a_step (x: int) returns (y: int);
+let
+  y = x;
+tel
+
+node a_reset (x: int) returns (y: int);
+let
+  y = x;
+tel
+
+node a_state (x: int) returns (y: int);
+let
+  y = x;
+tel
+
+node a_ret (x: int) returns (y: int);
+let
+  y = x;
+tel
+
+node a_initialized (x: int) returns (y: int);
+let
+  y = x;
+tel
+`
+	f, err := Parse(strings.NewReader(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := ir.NewModule()
+	if err := Compile(f, m); err != nil {
+		t.Fatalf("Compile() = %v", err)
+	}
+
+	llc, err := exec.LookPath("llc")
+	if err != nil {
+		t.Skip("llc not available")
+	}
+	cmd := exec.Command(llc, "-filetype=obj", "-o", os.DevNull)
+	cmd.Stdin = strings.NewReader(m.String())
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Errorf("llc failed: %v\n%s", err, out)
+	}
+}
+
+// TestCompileTestdata checks that llc accepts the IR generated for each file
+// of the testdata directory.
+func TestCompileTestdata(t *testing.T) {
+	llc, err := exec.LookPath("llc")
+	if err != nil {
+		t.Skip("llc not available")
+	}
+
+	filenames, err := filepath.Glob("testdata/*.mls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, filename := range filenames {
+		filename := filename
+		t.Run(filepath.Base(filename), func(t *testing.T) {
+			f := parseFile(t, filename)
+			m := ir.NewModule()
+			if err := Compile(f, m); err != nil {
+				t.Fatalf("Compile() = %v", err)
+			}
+
+			cmd := exec.Command(llc, "-filetype=obj", "-o", os.DevNull)
+			cmd.Stdin = strings.NewReader(m.String())
+			if out, err := cmd.CombinedOutput(); err != nil {
+				t.Errorf("llc failed: %v\n%s", err, out)
+			}
+		})
+	}
+}
@@ -0,0 +1,214 @@
+package minilustre
+
+import (
+	"sort"
+)
+
+// hasFby returns true if an expression contains a fby operator.
+func hasFby(e Expr) bool {
+	found := false
+	Inspect(e, func(e Expr) bool {
+		if e, ok := e.(*ExprBinOp); ok && e.Op == BinOpFby {
+			found = true
+		}
+		return !found
+	})
+	return found
+}
+
+type cse struct {
+	node *Node
+	// Nodes which can be called from the node being processed
+	defs map[string]*Node
+	// Nodes which can return different results for the same arguments
+	stateful map[string]bool
+	impure   map[string]bool
+	types    map[string]Type
+	names    map[string]bool
+}
+
+// candidate returns true if an expression can be computed once and shared: it
+// must always evaluate to the same value given the same variables.
+func (c *cse) candidate(e Expr) bool {
+	switch e.(type) {
+	case ExprConst, ExprVar, ExprTuple:
+		return false
+	}
+	if t, ok := typeOf(e, c.types, c.defs); !ok || t == TypeUnit {
+		return false
+	}
+
+	ok := true
+	Inspect(e, func(e Expr) bool {
+		switch e := e.(type) {
+		case *ExprBinOp:
+			if e.Op == BinOpFby {
+				ok = false
+			}
+		case *ExprCall:
+			if _, defined := c.defs[e.Name]; !defined || c.stateful[e.Name] || c.impure[e.Name] {
+				ok = false
+			}
+		}
+		return ok
+	})
+	return ok
+}
+
+type cseOccurrence struct {
+	expr  Expr
+	count int
+	// Index of the first equation containing the expression
+	first int
+}
+
+func (c *cse) occurrences() map[string]*cseOccurrence {
+	occs := make(map[string]*cseOccurrence)
+	for j, a := range c.node.Body {
+		Inspect(a.Body, func(e Expr) bool {
+			if e == nil || !c.candidate(e) {
+				return true
+			}
+			k := formatExpr(e)
+			if occ, ok := occs[k]; ok {
+				occ.count++
+			} else {
+				occs[k] = &cseOccurrence{expr: e, count: 1, first: j}
+			}
+			return true
+		})
+	}
+	return occs
+}
+
+// eliminate replaces one expression computed more than once with a variable.
+// It returns false if there is no such expression.
+func (c *cse) eliminate() bool {
+	occs := c.occurrences()
+
+	// Pick the largest repeated expression, so that its subexpressions are
+	// shared as well
+	var keys []string
+	for k, occ := range occs {
+		if occ.count > 1 {
+			keys = append(keys, k)
+		}
+	}
+	if len(keys) == 0 {
+		return false
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if len(keys[i]) != len(keys[j]) {
+			return len(keys[i]) > len(keys[j])
+		}
+		return keys[i] < keys[j]
+	})
+	k := keys[0]
+	occ := occs[k]
+
+	// Reuse the variable defined by the first equation containing the
+	// expression, if the equation computes exactly that expression
+	def := -1
+	var name string
+	if a := c.node.Body[occ.first]; len(a.Dst) == 1 && formatExpr(a.Body) == k {
+		def = occ.first
+		name = a.Dst[0]
+	} else {
+		t, _ := typeOf(occ.expr, c.types, c.defs)
+		name = freshName(c.names, "cse")
+		c.types[name] = t
+		c.node.LocalParams = append(c.node.LocalParams, Param{Name: name, Type: t})
+	}
+
+	replace := func(e Expr) Expr {
+		if c.candidate(e) && formatExpr(e) == k {
+			return ExprVar{name, e.Pos()}
+		}
+		return e
+	}
+
+	var body []Assign
+	for j, a := range c.node.Body {
+		if j == def {
+			body = append(body, a)
+			continue
+		}
+		if j == occ.first && def < 0 {
+			// The compiler needs variables to be defined before they're used
+			body = append(body, Assign{Pos: occ.expr.Pos(), Dst: []string{name}, Body: occ.expr})
+		}
+		body = append(body, Assign{Pos: a.Pos, Dst: a.Dst, Body: Rewrite(a.Body, replace)})
+	}
+	c.node.Body = body
+	return true
+}
+
+// CSE eliminates common subexpressions: an expression computed more than once
+// in a node is computed once and stored in a variable.
+//
+// Expressions containing fby operators, or calls to nodes which have state or
+// side effects, aren't shared since they may evaluate to different values.
+// Nodes marked unsafe are considered to have side effects.
+func CSE(f *File) {
+	// Called nodes are processed first, to know whether they have state or
+	// side effects. Files with recursive calls are invalid, see Check: they're
+	// processed in source order, and calls to nodes which haven't been
+	// processed yet are considered to have side effects.
+	order, err := callOrder(f)
+	if err != nil {
+		order = nil
+		for i := range f.Nodes {
+			order = append(order, i)
+		}
+	}
+
+	defs := make(map[string]*Node)
+	stateful := make(map[string]bool)
+	impure := make(map[string]bool)
+	for _, i := range order {
+		n := &f.Nodes[i]
+		if n.Extern {
+			defs[n.Name] = n
+			impure[n.Name] = n.Unsafe
+			continue
+		}
+
+		c := cse{
+			node:     n,
+			defs:     defs,
+			stateful: stateful,
+			impure:   impure,
+			types:    make(map[string]Type),
+			names:    nodeNames(n),
+		}
+		for _, params := range [][]Param{n.InParams, n.OutParams, n.LocalParams} {
+			for _, param := range params {
+				c.types[param.Name] = param.Type
+			}
+		}
+		for c.eliminate() {
+		}
+
+		isStateful := false
+		isImpure := n.Unsafe
+		for _, a := range n.Body {
+			if hasFby(a.Body) {
+				isStateful = true
+			}
+			Inspect(a.Body, func(e Expr) bool {
+				if call, ok := e.(*ExprCall); ok {
+					if _, ok := defs[call.Name]; !ok || impure[call.Name] {
+						isImpure = true
+					}
+					if stateful[call.Name] {
+						isStateful = true
+					}
+				}
+				return true
+			})
+		}
+		defs[n.Name] = n
+		stateful[n.Name] = isStateful
+		impure[n.Name] = isImpure
+	}
+}
@@ -0,0 +1,51 @@
+package minilustre
+
+import (
+	"strings"
+	"testing"
+)
+
+const cseSrc = `node counter (x: int) returns (c: int);
+let
+  c = 0 fby c + x;
+tel
+
+unsafe extern node rand (u: unit) returns (r: int);
+extern node abs (x: int) returns (y: int);
+
+node f (x, y: int) returns (o, p: int);
+var t: int;
+let
+  t = x * y;
+  o = x * y + abs(x - y) + counter(x) + rand(()) + (0 fby x);
+  p = abs(x - y) + counter(x) + rand(()) + (0 fby x) - (x * y + 1) * (x * y + 1);
+tel
+`
+
+func TestCSE(t *testing.T) {
+	f, err := Parse(strings.NewReader(cseSrc))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	CSE(f)
+
+	n := f.Nodes[len(f.Nodes)-1]
+	var eqs []string
+	for _, a := range n.Body {
+		eqs = append(eqs, a.String())
+	}
+	want := []string{
+		"t = x * y",
+		"cse_1 = abs(x - y)",
+		"o = t + cse_1 + counter(x) + rand(()) + (0 fby x)",
+		"cse_2 = t + 1",
+		"p = cse_1 + counter(x) + rand(()) + (0 fby x) - cse_2 * cse_2",
+	}
+	if strings.Join(eqs, "\n") != strings.Join(want, "\n") {
+		t.Errorf("CSE() = \n%v\nwant:\n%v", strings.Join(eqs, "\n"), strings.Join(want, "\n"))
+	}
+	if l := n.LocalParams; len(l) != 3 || l[2].Name != "cse_2" || l[2].Type != TypeInt {
+		t.Errorf("locals: %v, want t, cse_1 and cse_2", l)
+	}
+}
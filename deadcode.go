@@ -0,0 +1,134 @@
+package minilustre
+
+import (
+	"sort"
+)
+
+// hasImpureCall returns true if an expression calls a node which has side
+// effects: unsafe extern nodes, and nodes which call them. Calls to nodes which
+// aren't defined in the file, such as print, are assumed to have side effects.
+func hasImpureCall(e Expr, defined, impure map[string]bool) bool {
+	found := false
+	Inspect(e, func(e Expr) bool {
+		if call, ok := e.(*ExprCall); ok && (!defined[call.Name] || impure[call.Name]) {
+			found = true
+		}
+		return !found
+	})
+	return found
+}
+
+// exprVars calls f for each variable referenced in an expression.
+func exprVars(e Expr, f func(name string)) {
+	Inspect(e, func(e Expr) bool {
+		if v, ok := e.(ExprVar); ok {
+			f(v.Name)
+		}
+		return true
+	})
+}
+
+// EliminateDeadCode removes equations which don't contribute to the outputs of
+// their node, and the locals they define. Equations calling nodes with side
+// effects are kept. Nodes marked unsafe are considered to have side effects.
+//
+// Warnings are returned for unused inputs and locals.
+func EliminateDeadCode(f *File) ErrorList {
+	var warnings ErrorList
+
+	// Called nodes are processed first, to know whether they have side
+	// effects. If there are recursive calls, which Check rejects, nodes are
+	// processed in source order and calls to nodes defined later are kept.
+	order, err := callOrder(f)
+	if err != nil {
+		order = nil
+		for i := range f.Nodes {
+			order = append(order, i)
+		}
+	}
+
+	defined := make(map[string]bool)
+	impure := make(map[string]bool)
+	for _, i := range order {
+		n := &f.Nodes[i]
+		if n.Extern {
+			defined[n.Name] = true
+			impure[n.Name] = n.Unsafe
+			continue
+		}
+
+		live := make(map[string]bool)
+		liveEqs := make([]bool, len(n.Body))
+		for _, param := range n.OutParams {
+			live[param.Name] = true
+		}
+
+		isImpure := n.Unsafe
+		for j, a := range n.Body {
+			if hasImpureCall(a.Body, defined, impure) {
+				liveEqs[j] = true
+				isImpure = true
+			}
+		}
+
+		// Propagate liveness backwards until a fixed point is reached
+		for changed := true; changed; {
+			changed = false
+			for j, a := range n.Body {
+				if !liveEqs[j] {
+					for _, dst := range a.Dst {
+						if live[dst] {
+							liveEqs[j] = true
+						}
+					}
+					if !liveEqs[j] {
+						continue
+					}
+				}
+				exprVars(a.Body, func(name string) {
+					if !live[name] {
+						live[name] = true
+						changed = true
+					}
+				})
+			}
+		}
+
+		var body []Assign
+		assigned := make(map[string]bool)
+		for j, a := range n.Body {
+			if liveEqs[j] {
+				body = append(body, a)
+				for _, dst := range a.Dst {
+					assigned[dst] = true
+				}
+			}
+		}
+		n.Body = body
+
+		for _, param := range n.InParams {
+			if !live[param.Name] && param.Type != TypeUnit && param.Pos.IsValid() {
+				warnings = append(warnings, errorf(param.Pos, "unused input '%v'", param.Name))
+			}
+		}
+
+		var locals []Param
+		for _, param := range n.LocalParams {
+			if !live[param.Name] && param.Pos.IsValid() {
+				warnings = append(warnings, errorf(param.Pos, "unused variable '%v'", param.Name))
+			}
+			if live[param.Name] || assigned[param.Name] {
+				locals = append(locals, param)
+			}
+		}
+		n.LocalParams = locals
+
+		defined[n.Name] = true
+		impure[n.Name] = isImpure
+	}
+
+	sort.SliceStable(warnings, func(i, j int) bool {
+		return warnings[i].Pos.Offset < warnings[j].Pos.Offset
+	})
+	return warnings
+}
@@ -0,0 +1,94 @@
+package minilustre
+
+import (
+	"strings"
+	"testing"
+)
+
+const deadCodeSrc = `node f (x, y: int; u: unit) returns (o: int);
+var a, b, c: int; d: bool; p: unit;
+let
+  a = x + 1;
+  b = a fby c;
+  c = b * 2;
+  d = true;
+  p = print("hi");
+  o = a;
+tel
+
+node g (x: int) returns (o: int);
+var t: int;
+let
+  t = f(x, x, ());
+  o = x;
+tel
+`
+
+func TestEliminateDeadCode(t *testing.T) {
+	f, err := Parse(strings.NewReader(deadCodeSrc))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	warnings := EliminateDeadCode(f)
+
+	var got []string
+	for _, w := range warnings {
+		got = append(got, w.Pos.String()+": "+w.Msg)
+	}
+	want := []string{
+		"1:12: unused input 'y'",
+		"2:8: unused variable 'b'",
+		"2:11: unused variable 'c'",
+		"2:19: unused variable 'd'",
+		"2:28: unused variable 'p'",
+		"13:5: unused variable 't'",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("EliminateDeadCode() = \n%v\nwant:\n%v", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	// Equations calling print, directly or not, must be kept
+	var eqs []string
+	for _, n := range f.Nodes {
+		for _, a := range n.Body {
+			eqs = append(eqs, a.String())
+		}
+	}
+	wantEqs := []string{"a = x + 1", "p = print(\"hi\")", "o = a", "t = f(x, x, ())", "o = x"}
+	if strings.Join(eqs, "; ") != strings.Join(wantEqs, "; ") {
+		t.Errorf("remaining equations: %v, want %v", strings.Join(eqs, "; "), strings.Join(wantEqs, "; "))
+	}
+	if l := f.Nodes[0].LocalParams; len(l) != 2 || l[0].Name != "a" || l[1].Name != "p" {
+		t.Errorf("remaining locals: %v, want a and p", l)
+	}
+}
+
+func TestEliminateDeadCodeForwardCall(t *testing.T) {
+	src := `node g (x: int) returns (o: int);
+var t: int;
+let
+  t = f(x);
+  o = x;
+tel
+
+node f (x: int) returns (o: int);
+let
+  o = x + 1;
+tel
+`
+	f, err := Parse(strings.NewReader(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	EliminateDeadCode(f)
+
+	// f is pure, even though it's defined after g
+	if body := f.Nodes[0].Body; len(body) != 1 || body[0].String() != "o = x" {
+		t.Errorf("remaining equations of g: %v, want o = x", body)
+	}
+	if l := f.Nodes[0].LocalParams; len(l) != 0 {
+		t.Errorf("remaining locals of g: %v, want none", l)
+	}
+}
@@ -0,0 +1,798 @@
+package minilustre
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/llir/llvm/ir"
+	"github.com/llir/llvm/ir/constant"
+	"github.com/llir/llvm/ir/enum"
+	"github.com/llir/llvm/ir/types"
+	"github.com/llir/llvm/ir/value"
+)
+
+// TestDifferential runs each trace file against both the interpreter and the
+// compiled code, and checks that they produce the same outputs.
+//
+// Trace files are named testdata/<file>.<node>.in: they drive the node <node>
+// defined in testdata/<file>.mls. Each non-empty line that doesn't start with
+// '#' describes one cycle and contains one whitespace-separated value per
+// non-unit input parameter.
+func TestDifferential(t *testing.T) {
+	traces, err := filepath.Glob("testdata/*.in")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var r runners
+	r.llvm, err = llvmRunner()
+	if err != nil {
+		t.Skip(err)
+	}
+	r.c = cRunner()
+	r.gorun = goRunner()
+	r.wasm = wasmRunner()
+
+	for _, trace := range traces {
+		trace := trace
+		name := strings.TrimSuffix(filepath.Base(trace), ".in")
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			l := strings.SplitN(name, ".", 2)
+			if len(l) != 2 {
+				t.Fatalf("invalid trace file name %q", trace)
+			}
+			testDifferential(t, filepath.Join("testdata", l[0]+".mls"), l[1], trace, &r)
+		})
+	}
+}
+
+// diffVariants are transformations applied to the source file before running
+// it. Each variant must preserve the semantics of the file.
+var diffVariants = []struct {
+	name      string
+	transform func(f *File) error
+}{
+	{"inline", func(f *File) error {
+		Inline(f, true)
+		return nil
+	}},
+	{"fold", Fold},
+	{"dce", func(f *File) error {
+		EliminateDeadCode(f)
+		return nil
+	}},
+	{"normalize", Normalize},
+	{"cse", func(f *File) error {
+		CSE(f)
+		return nil
+	}},
+	{"inline+fold+dce+cse", func(f *File) error {
+		Inline(f, true)
+		if err := Fold(f); err != nil {
+			return err
+		}
+		EliminateDeadCode(f)
+		CSE(f)
+		return nil
+	}},
+	{"inline+normalize+cse", func(f *File) error {
+		Inline(f, true)
+		if err := Normalize(f); err != nil {
+			return err
+		}
+		CSE(f)
+		return nil
+	}},
+}
+
+func parseFile(t *testing.T, filename string) *File {
+	src, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+
+	f, err := Parse(src)
+	if err != nil {
+		t.Fatalf("Parse() = %v", err)
+	}
+	return f
+}
+
+// runners execute the code generated by the backends. The C, Go and
+// WebAssembly runners are nil if no C compiler, Go toolchain or Node.js is
+// available.
+type runners struct {
+	llvm  func(*testing.T, *ir.Module) (string, error)
+	c     func(t *testing.T, files map[string]string) (string, error)
+	gorun func(t *testing.T, files map[string]string) (string, error)
+	wasm  func(t *testing.T, files map[string]string) (string, error)
+}
+
+func testDifferential(t *testing.T, filename, node, trace string, r *runners) {
+	f := parseFile(t, filename)
+
+	it, err := NewInterpreter(f, node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := it.Node()
+
+	inputs, err := readTrace(trace, n)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want, err := interpret(it, inputs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkBackends(t, f, n, inputs, want, r)
+	// Building a Go program and starting Node.js are slow, only check the
+	// original file
+	if r.gorun != nil {
+		checkGo(t, f, n, inputs, want, r.gorun)
+	}
+	if r.wasm != nil {
+		checkWasm(t, f, n, inputs, want, r.wasm)
+	}
+
+	for _, variant := range diffVariants {
+		variant := variant
+		t.Run(variant.name, func(t *testing.T) {
+			f := parseFile(t, filename)
+			if err := variant.transform(f); err != nil {
+				t.Fatal(err)
+			}
+
+			it, err := NewInterpreter(f, node)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := interpret(it, inputs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := range want {
+				for j, param := range n.OutParams {
+					if !reflect.DeepEqual(got[i][j], want[i][j]) {
+						t.Fatalf("cycle %v: output '%v' diverges: interpreter gave %v on the original file, %v on the transformed file", i, param.Name, valueString(want[i][j]), valueString(got[i][j]))
+					}
+				}
+			}
+
+			checkBackends(t, f, it.Node(), inputs, want, r)
+		})
+	}
+}
+
+func interpret(it *Interpreter, inputs [][]interface{}) ([][]interface{}, error) {
+	var outputs [][]interface{}
+	for i, in := range inputs {
+		out, err := it.Step(in)
+		if err != nil {
+			return nil, fmt.Errorf("cycle %v: interpreter failed: %v", i, err)
+		}
+		outputs = append(outputs, out)
+	}
+	return outputs, nil
+}
+
+func checkBackends(t *testing.T, f *File, n *Node, inputs, want [][]interface{}, r *runners) {
+	checkCompiled(t, f, n, inputs, want, r.llvm)
+	if r.c != nil {
+		checkC(t, f, n, inputs, want, r.c)
+	}
+}
+
+// checkCompiled compiles f, runs the node n with the provided inputs and
+// checks that its outputs match the ones of the interpreter.
+func checkCompiled(t *testing.T, f *File, n *Node, inputs, want [][]interface{}, run func(*testing.T, *ir.Module) (string, error)) {
+	m := ir.NewModule()
+	if err := Compile(f, m); err != nil {
+		t.Fatalf("Compile() = %v", err)
+	}
+	if err := addTraceMain(m, n, inputs); err != nil {
+		t.Fatal(err)
+	}
+
+	stdout, err := run(t, m)
+	if err != nil {
+		t.Fatalf("failed to run compiled code: %v", err)
+	}
+
+	checkOutputs(t, n, want, stdout, "compiled code")
+}
+
+// checkC compiles f to C, runs the node n with the provided inputs and checks
+// that its outputs match the ones of the interpreter.
+func checkC(t *testing.T, f *File, n *Node, inputs, want [][]interface{}, run func(*testing.T, map[string]string) (string, error)) {
+	var h, c strings.Builder
+	if err := CompileC(f, "node.h", &h, &c); err != nil {
+		t.Fatalf("CompileC() = %v", err)
+	}
+
+	stdout, err := run(t, map[string]string{
+		"node.h": h.String(),
+		"node.c": c.String(),
+		"main.c": cTraceMain(n, inputs),
+	})
+	if err != nil {
+		t.Fatalf("failed to run C code: %v", err)
+	}
+
+	checkOutputs(t, n, want, stdout, "C code")
+}
+
+// checkGo compiles f to a Go package, runs the node n with the provided inputs
+// and checks that its outputs match the ones of the interpreter.
+func checkGo(t *testing.T, f *File, n *Node, inputs, want [][]interface{}, run func(*testing.T, map[string]string) (string, error)) {
+	var pkg strings.Builder
+	if err := CompileGo(f, "node", &pkg); err != nil {
+		t.Fatalf("CompileGo() = %v", err)
+	}
+
+	stdout, err := run(t, map[string]string{
+		"go.mod":       "module trace\n\ngo 1.18\n",
+		"node/node.go": pkg.String(),
+		"main.go":      goTraceMain(n, inputs, strings.Contains(pkg.String(), "\nvar Print ")),
+	})
+	if err != nil {
+		t.Fatalf("failed to run Go code: %v", err)
+	}
+
+	checkOutputs(t, n, want, stdout, "Go code")
+}
+
+// checkWasm compiles f to WebAssembly, runs the node n with the provided
+// inputs and checks that its outputs match the ones of the interpreter.
+func checkWasm(t *testing.T, f *File, n *Node, inputs, want [][]interface{}, run func(*testing.T, map[string]string) (string, error)) {
+	var b strings.Builder
+	if err := CompileWasm(f, &b); err != nil {
+		t.Fatalf("CompileWasm() = %v", err)
+	}
+
+	stdout, err := run(t, map[string]string{
+		"node.wasm": b.String(),
+		"main.cjs":  wasmTraceMain(n, inputs),
+	})
+	if err != nil {
+		t.Fatalf("failed to run WebAssembly code: %v", err)
+	}
+
+	checkOutputs(t, n, want, stdout, "WebAssembly code")
+}
+
+// checkOutputs checks that the outputs printed by generated code match the
+// ones of the interpreter.
+func checkOutputs(t *testing.T, n *Node, want [][]interface{}, stdout, name string) {
+	lines := strings.Split(stdout, "\n")
+	for i, out := range want {
+		for j, param := range n.OutParams {
+			if param.Type == TypeUnit {
+				continue
+			}
+
+			if len(lines) == 0 {
+				t.Fatalf("cycle %v: %v didn't produce output '%v'", i, name, param.Name)
+			}
+			got := lines[0]
+			lines = lines[1:]
+
+			if !equalTraceValue(out[j], got) {
+				t.Fatalf("cycle %v: output '%v' diverges: interpreter gave %v, %v gave %v", i, param.Name, valueString(out[j]), name, got)
+			}
+		}
+	}
+}
+
+func readTrace(filename string, n *Node) ([][]interface{}, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var inputs [][]interface{}
+	scanner := bufio.NewScanner(f)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		in := make([]interface{}, len(n.InParams))
+		for i, param := range n.InParams {
+			if param.Type == TypeUnit {
+				continue
+			}
+			if len(fields) == 0 {
+				return nil, fmt.Errorf("%v:%v: missing value for input '%v'", filename, lineno, param.Name)
+			}
+
+			v, err := parseTraceValue(fields[0], param.Type)
+			if err != nil {
+				return nil, fmt.Errorf("%v:%v: input '%v': %v", filename, lineno, param.Name, err)
+			}
+			in[i] = v
+			fields = fields[1:]
+		}
+		if len(fields) > 0 {
+			return nil, fmt.Errorf("%v:%v: too many values", filename, lineno)
+		}
+
+		inputs = append(inputs, in)
+	}
+
+	return inputs, scanner.Err()
+}
+
+func parseTraceValue(s string, t Type) (interface{}, error) {
+	switch t {
+	case TypeBool:
+		return strconv.ParseBool(s)
+	case TypeInt:
+		i, err := strconv.ParseInt(s, 10, 32)
+		return int(i), err
+	case TypeFloat:
+		f, err := strconv.ParseFloat(s, 32)
+		return float32(f), err
+	default:
+		return nil, fmt.Errorf("unsupported type %v", t)
+	}
+}
+
+// equalTraceValue checks whether a value returned by the interpreter is equal
+// to a value printed by the compiled code.
+func equalTraceValue(v interface{}, s string) bool {
+	switch v := v.(type) {
+	case bool:
+		return (v && s == "1") || (!v && s == "0")
+	case int:
+		return strconv.Itoa(v) == s
+	case float32:
+		f, err := strconv.ParseFloat(s, 32)
+		if err != nil {
+			return false
+		}
+		return v == float32(f) || math.Abs(float64(v)-f) <= 1e-5*math.Abs(f)
+	default:
+		return false
+	}
+}
+
+// addTraceMain adds a main function to m which steps the node n once per
+// cycle with the provided inputs, and prints each non-unit output on its own
+// line.
+func addTraceMain(m *ir.Module, n *Node, inputs [][]interface{}) error {
+	var f *ir.Func
+	for _, ff := range m.Funcs {
+		if ff.GlobalName == n.Name {
+			f = ff
+		}
+	}
+	if f == nil {
+		return fmt.Errorf("compiled module doesn't contain node '%v'", n.Name)
+	}
+
+	printf := m.NewFunc("printf", types.I32, ir.NewParam("format", types.I8Ptr))
+	printf.Sig.Variadic = true
+
+	formats := make(map[string]*ir.Global)
+	format := func(b *ir.Block, s string) value.Value {
+		glob, ok := formats[s]
+		if !ok {
+			glob = m.NewGlobalDef(fmt.Sprintf("_trace_format_%v", len(formats)), constant.NewCharArrayFromString(s+"\x00"))
+			glob.Immutable = true
+			glob.Linkage = enum.LinkagePrivate
+			formats[s] = glob
+		}
+		zero := constant.NewInt(types.I64, 0)
+		return b.NewGetElementPtr(glob, zero, zero)
+	}
+
+	var outTypes []Type
+	for _, param := range n.OutParams {
+		if param.Type != TypeUnit {
+			outTypes = append(outTypes, param.Type)
+		}
+	}
+
+	main := m.NewFunc("main", types.I32)
+	b := main.NewBlock("")
+	for _, in := range inputs {
+		var args []value.Value
+		for i, param := range n.InParams {
+			switch v := in[i].(type) {
+			case nil:
+				// Unit parameters are omitted
+			case bool:
+				var i int64
+				if v {
+					i = 1
+				}
+				args = append(args, constant.NewInt(types.I1, i))
+			case int:
+				args = append(args, constant.NewInt(types.I32, int64(v)))
+			case float32:
+				args = append(args, constant.NewFloat(types.Float, float64(v)))
+			default:
+				return fmt.Errorf("unsupported value for input '%v'", param.Name)
+			}
+		}
+
+		ret := b.NewCall(f, args...)
+
+		outs := []value.Value{ret}
+		if len(outTypes) > 1 {
+			outs = make([]value.Value, len(outTypes))
+			for i := range outTypes {
+				ptr := b.NewGetElementPtr(ret, constant.NewInt(types.I32, 0), constant.NewInt(types.I32, int64(i)))
+				ptr.InBounds = true
+				outs[i] = b.NewLoad(ptr)
+			}
+		}
+
+		for i, t := range outTypes {
+			v := outs[i]
+			switch t {
+			case TypeBool:
+				b.NewCall(printf, format(b, "%d\n"), b.NewZExt(v, types.I32))
+			case TypeInt:
+				b.NewCall(printf, format(b, "%d\n"), v)
+			case TypeFloat:
+				b.NewCall(printf, format(b, "%.9g\n"), b.NewFPExt(v, types.Double))
+			default:
+				return fmt.Errorf("unsupported type %v for output", t)
+			}
+		}
+	}
+	b.NewRet(constant.NewInt(types.I32, 0))
+
+	return nil
+}
+
+// llvmRunner returns a function which executes an LLVM module and returns its
+// standard output. It uses lli if available, or falls back to clang.
+func llvmRunner() (func(*testing.T, *ir.Module) (string, error), error) {
+	if lli, err := exec.LookPath("lli"); err == nil {
+		return func(t *testing.T, m *ir.Module) (string, error) {
+			cmd := exec.Command(lli, "-")
+			cmd.Stdin = strings.NewReader(m.String())
+			return runCommand(cmd)
+		}, nil
+	}
+
+	if clang, err := exec.LookPath("clang"); err == nil {
+		return func(t *testing.T, m *ir.Module) (string, error) {
+			dir := t.TempDir()
+
+			ll := filepath.Join(dir, "main.ll")
+			exe := filepath.Join(dir, "main")
+			if err := os.WriteFile(ll, []byte(m.String()), 0644); err != nil {
+				return "", err
+			}
+			if _, err := runCommand(exec.Command(clang, "-Wno-override-module", "-o", exe, ll)); err != nil {
+				return "", err
+			}
+			return runCommand(exec.Command(exe))
+		}, nil
+	}
+
+	return nil, fmt.Errorf("neither lli nor clang is available")
+}
+
+// cTraceMain returns a C main function which steps the node n once per cycle
+// with the provided inputs, and prints each non-unit output on its own line.
+func cTraceMain(n *Node, inputs [][]interface{}) string {
+	var b strings.Builder
+	name := cName(n.Name)
+	b.WriteString("#include <stdio.h>\n#include \"node.h\"\n\n")
+	b.WriteString("void print(const char *str)\n{\n\tfputs(str, stderr);\n}\n\n")
+	b.WriteString("int main(void)\n{\n")
+	fmt.Fprintf(&b, "\tstatic %v_state s;\n", name)
+	var outs []string
+	for _, param := range n.OutParams {
+		if param.Type != TypeUnit {
+			fmt.Fprintf(&b, "\t%v;\n", cDecl(param.Type, "out_"+param.Name))
+			outs = append(outs, "&out_"+param.Name)
+		}
+	}
+	fmt.Fprintf(&b, "\n\t%v_reset(&s);\n", name)
+	for _, in := range inputs {
+		args := []string{"&s"}
+		for _, v := range in {
+			if v != nil {
+				args = append(args, cConst(v))
+			}
+		}
+		fmt.Fprintf(&b, "\t%v_step(%v);\n", name, strings.Join(append(args, outs...), ", "))
+		for _, param := range n.OutParams {
+			switch param.Type {
+			case TypeBool, TypeInt:
+				fmt.Fprintf(&b, "\tprintf(\"%%ld\\n\", (long)out_%v);\n", param.Name)
+			case TypeFloat:
+				fmt.Fprintf(&b, "\tprintf(\"%%.9g\\n\", (double)out_%v);\n", param.Name)
+			}
+		}
+	}
+	b.WriteString("\treturn 0;\n}\n")
+	return b.String()
+}
+
+// goTraceMain returns a Go main package which steps the node n once per cycle
+// with the provided inputs, and prints each non-unit output on its own line.
+func goTraceMain(n *Node, inputs [][]interface{}, print bool) string {
+	var b strings.Builder
+	b.WriteString("package main\n\nimport (\n\t\"fmt\"\n\t\"os\"\n\n\t\"trace/node\"\n)\n\n")
+	b.WriteString("func b2i(b bool) int {\n\tif b {\n\t\treturn 1\n\t}\n\treturn 0\n}\n\n")
+	b.WriteString("func main() {\n")
+	if print {
+		b.WriteString("\tnode.Print = func(str string) {\n\t\tfmt.Fprint(os.Stderr, str)\n\t}\n\n")
+	}
+	fmt.Fprintf(&b, "\tvar s node.%v\n", goExported(n.Name))
+	var outs []string
+	for _, param := range n.OutParams {
+		if param.Type != TypeUnit {
+			fmt.Fprintf(&b, "\tvar out_%v %v\n", param.Name, goType(param.Type))
+			outs = append(outs, "out_"+param.Name)
+		}
+	}
+	b.WriteString("\n\ts.Reset()\n")
+	var g gogen
+	for _, in := range inputs {
+		var args []string
+		for _, v := range in {
+			if v != nil {
+				args = append(args, g.constant(v, false))
+			}
+		}
+		call := "s.Step(" + strings.Join(args, ", ") + ")"
+		if len(outs) > 0 {
+			call = strings.Join(outs, ", ") + " = " + call
+		}
+		fmt.Fprintf(&b, "\t%v\n", call)
+		for _, param := range n.OutParams {
+			switch param.Type {
+			case TypeBool:
+				fmt.Fprintf(&b, "\tfmt.Println(b2i(out_%v))\n", param.Name)
+			case TypeInt:
+				fmt.Fprintf(&b, "\tfmt.Println(out_%v)\n", param.Name)
+			case TypeFloat:
+				fmt.Fprintf(&b, "\tfmt.Printf(\"%%.9g\\n\", out_%v)\n", param.Name)
+			}
+		}
+	}
+	b.WriteString("\tos.Stdout.Sync()\n}\n")
+	return b.String()
+}
+
+// goRunner returns a function which builds a Go module and returns the
+// standard output of the resulting program, or nil if no Go toolchain is
+// available.
+func goRunner() func(*testing.T, map[string]string) (string, error) {
+	gobin, err := exec.LookPath("go")
+	if err != nil {
+		return nil
+	}
+
+	return func(t *testing.T, files map[string]string) (string, error) {
+		dir := t.TempDir()
+
+		for name, src := range files {
+			filename := filepath.Join(dir, filepath.FromSlash(name))
+			if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+				return "", err
+			}
+			if err := os.WriteFile(filename, []byte(src), 0644); err != nil {
+				return "", err
+			}
+		}
+
+		exe := filepath.Join(dir, "main")
+		cmd := exec.Command(gobin, "build", "-o", exe, ".")
+		cmd.Dir = dir
+		cmd.Env = append(os.Environ(), "GOFLAGS=-mod=mod", "GOWORK=off")
+		if _, err := runCommand(cmd); err != nil {
+			return "", err
+		}
+		return runCommand(exec.Command(exe))
+	}
+}
+
+// wasmTraceMain returns a JavaScript program which instantiates node.wasm,
+// steps the node n once per cycle with the provided inputs, and prints each
+// non-unit output on its own line.
+func wasmTraceMain(n *Node, inputs [][]interface{}) string {
+	var b strings.Builder
+	b.WriteString(`const fs = require("fs");
+const path = require("path");
+
+let memory;
+const env = {
+	print(ptr) {
+		const bytes = new Uint8Array(memory.buffer);
+		let end = ptr;
+		while (bytes[end] !== 0) {
+			end++;
+		}
+		process.stderr.write(bytes.subarray(ptr, end));
+	},
+};
+const mod = new WebAssembly.Module(fs.readFileSync(path.join(__dirname, "node.wasm")));
+const wasm = new WebAssembly.Instance(mod, { env }).exports;
+memory = wasm.memory;
+
+const lines = [];
+let out;
+`)
+	var outs []Param
+	for _, param := range n.OutParams {
+		if param.Type != TypeUnit {
+			outs = append(outs, param)
+		}
+	}
+	fmt.Fprintf(&b, "wasm.%v_init();\n", n.Name)
+	for _, in := range inputs {
+		var args []string
+		for _, v := range in {
+			switch v := v.(type) {
+			case nil:
+			case bool:
+				if v {
+					args = append(args, "1")
+				} else {
+					args = append(args, "0")
+				}
+			case float32:
+				args = append(args, strconv.FormatFloat(float64(v), 'g', -1, 32))
+			default:
+				args = append(args, fmt.Sprint(v))
+			}
+		}
+		fmt.Fprintf(&b, "out = wasm.%v_step(%v);\n", n.Name, strings.Join(args, ", "))
+		if len(outs) == 1 {
+			b.WriteString("lines.push(String(out));\n")
+		} else if len(outs) > 1 {
+			b.WriteString("lines.push(...out.map(String));\n")
+		}
+	}
+	b.WriteString("process.stdout.write(lines.map((l) => l + \"\\n\").join(\"\"));\n")
+	return b.String()
+}
+
+// wasmRunner returns a function which runs a JavaScript program with Node.js
+// and returns its standard output, or nil if Node.js isn't available.
+func wasmRunner() func(*testing.T, map[string]string) (string, error) {
+	node, err := exec.LookPath("node")
+	if err != nil {
+		return nil
+	}
+
+	return func(t *testing.T, files map[string]string) (string, error) {
+		dir := t.TempDir()
+
+		for name, src := range files {
+			if err := os.WriteFile(filepath.Join(dir, name), []byte(src), 0644); err != nil {
+				return "", err
+			}
+		}
+		return runCommand(exec.Command(node, filepath.Join(dir, "main.cjs")))
+	}
+}
+
+// cRunner returns a function which compiles C files and returns the standard
+// output of the resulting program, or nil if no C compiler is available.
+func cRunner() func(*testing.T, map[string]string) (string, error) {
+	cc, err := exec.LookPath("cc")
+	if err != nil {
+		return nil
+	}
+
+	return func(t *testing.T, files map[string]string) (string, error) {
+		dir := t.TempDir()
+
+		exe := filepath.Join(dir, "main")
+		args := []string{"-std=c99", "-pedantic", "-Wall", "-Wextra", "-Werror", "-Wno-unused-parameter", "-o", exe}
+		for name, src := range files {
+			if err := os.WriteFile(filepath.Join(dir, name), []byte(src), 0644); err != nil {
+				return "", err
+			}
+			if strings.HasSuffix(name, ".c") {
+				args = append(args, filepath.Join(dir, name))
+			}
+		}
+		if _, err := runCommand(exec.Command(cc, args...)); err != nil {
+			return "", err
+		}
+		return runCommand(exec.Command(exe))
+	}
+}
+
+func runCommand(cmd *exec.Cmd) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("%v: %v\n%v", cmd.Path, err, stderr.String())
+	}
+	return stdout.String(), nil
+}
+
+// TestDivisionByZero checks that all backends stop on integer divisions by
+// zero, like the interpreter.
+func TestDivisionByZero(t *testing.T) {
+	src := "node n (x, y: int) returns (o: int);\nlet\n  o = x / y;\ntel\n"
+	f, err := Parse(strings.NewReader(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := &f.Nodes[0]
+	inputs := [][]interface{}{{7, 2}, {1, 0}}
+
+	it, err := NewInterpreter(f, n.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := interpret(it, inputs); err == nil || !strings.Contains(err.Error(), "division by zero") {
+		t.Errorf("interpreter: got %v, want a division by zero error", err)
+	}
+
+	if run, err := llvmRunner(); err == nil {
+		m := ir.NewModule()
+		if err := Compile(f, m); err != nil {
+			t.Fatalf("Compile() = %v", err)
+		}
+		if err := addTraceMain(m, n, inputs); err != nil {
+			t.Fatal(err)
+		}
+		if stdout, err := run(t, m); err == nil {
+			t.Errorf("compiled code didn't fail, printed %q", stdout)
+		}
+	}
+
+	if run := cRunner(); run != nil {
+		var h, c strings.Builder
+		if err := CompileC(f, "node.h", &h, &c); err != nil {
+			t.Fatalf("CompileC() = %v", err)
+		}
+		files := map[string]string{"node.h": h.String(), "node.c": c.String(), "main.c": cTraceMain(n, inputs)}
+		if stdout, err := run(t, files); err == nil {
+			t.Errorf("C code didn't fail, printed %q", stdout)
+		}
+	}
+
+	if run := goRunner(); run != nil {
+		var pkg strings.Builder
+		if err := CompileGo(f, "node", &pkg); err != nil {
+			t.Fatalf("CompileGo() = %v", err)
+		}
+		files := map[string]string{"go.mod": "module trace\n\ngo 1.18\n", "node/node.go": pkg.String(), "main.go": goTraceMain(n, inputs, false)}
+		if stdout, err := run(t, files); err == nil {
+			t.Errorf("Go code didn't fail, printed %q", stdout)
+		}
+	}
+
+	if run := wasmRunner(); run != nil {
+		var b strings.Builder
+		if err := CompileWasm(f, &b); err != nil {
+			t.Fatalf("CompileWasm() = %v", err)
+		}
+		files := map[string]string{"node.wasm": b.String(), "main.cjs": wasmTraceMain(n, inputs)}
+		if stdout, err := run(t, files); err == nil {
+			t.Errorf("WebAssembly code didn't fail, printed %q", stdout)
+		}
+	}
+}
@@ -0,0 +1,267 @@
+package minilustre
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+)
+
+// WriteCallGraph writes the call graph of a file in the Graphviz DOT format.
+// Each node is a vertex, with an edge to each node it calls. Extern nodes and
+// the built-in print node are drawn dashed.
+func WriteCallGraph(w io.Writer, f *File) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "digraph calls {\n")
+	fmt.Fprintf(bw, "\tnode [shape=box];\n")
+
+	defined := make(map[string]bool)
+	for i := range f.Nodes {
+		n := &f.Nodes[i]
+		if defined[n.Name] {
+			continue
+		}
+		defined[n.Name] = true
+		if n.Extern {
+			fmt.Fprintf(bw, "\t%q [style=dashed];\n", n.Name)
+		} else {
+			fmt.Fprintf(bw, "\t%q;\n", n.Name)
+		}
+	}
+
+	edges := make(map[[2]string]bool)
+	for i := range f.Nodes {
+		n := &f.Nodes[i]
+		for _, a := range n.Body {
+			Inspect(a.Body, func(e Expr) bool {
+				call, ok := e.(*ExprCall)
+				if !ok {
+					return true
+				}
+				edge := [2]string{n.Name, call.Name}
+				if edges[edge] {
+					return true
+				}
+				edges[edge] = true
+				if !defined[call.Name] {
+					defined[call.Name] = true
+					fmt.Fprintf(bw, "\t%q [style=dashed];\n", call.Name)
+				}
+				fmt.Fprintf(bw, "\t%q -> %q;\n", n.Name, call.Name)
+				return true
+			})
+		}
+	}
+
+	fmt.Fprintf(bw, "}\n")
+	return bw.Flush()
+}
+
+// WriteDataflowGraph writes the dataflow graph of nodes in the Graphviz DOT
+// format, with one cluster per node. If no node name is given, all nodes which
+// aren't extern are drawn.
+//
+// Inputs, outputs and locals are vertices with distinct shapes. Operators,
+// constants and node calls are vertices too, with an edge from each operand.
+// The delayed operand of a fby operator is drawn with a dashed edge.
+func WriteDataflowGraph(w io.Writer, f *File, names ...string) error {
+	var nodes []*Node
+	if len(names) == 0 {
+		for i := range f.Nodes {
+			if !f.Nodes[i].Extern {
+				nodes = append(nodes, &f.Nodes[i])
+			}
+		}
+	}
+	for _, name := range names {
+		var n *Node
+		for i := range f.Nodes {
+			if f.Nodes[i].Name == name {
+				n = &f.Nodes[i]
+				break
+			}
+		}
+		if n == nil {
+			return fmt.Errorf("minilustre: undefined node '%v'", name)
+		}
+		nodes = append(nodes, n)
+	}
+
+	defs := make(map[string]*Node)
+	for i := range f.Nodes {
+		if _, ok := defs[f.Nodes[i].Name]; !ok {
+			defs[f.Nodes[i].Name] = &f.Nodes[i]
+		}
+	}
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "digraph dataflow {\n")
+	fmt.Fprintf(bw, "\trankdir=LR;\n")
+	g := dataflowGraph{w: bw, defs: defs}
+	for _, n := range nodes {
+		g.node(n)
+	}
+	fmt.Fprintf(bw, "}\n")
+	return bw.Flush()
+}
+
+// dataflowPort is a value produced by a vertex of a dataflow graph. Vertices
+// producing several values, such as node calls, have one port per value.
+type dataflowPort struct {
+	id    string
+	label string
+}
+
+type dataflowGraph struct {
+	w    *bufio.Writer
+	defs map[string]*Node
+	// Number of vertices, used to generate identifiers
+	n int
+	// Vertices of the variables of the node being drawn
+	vars map[string]string
+}
+
+func (g *dataflowGraph) vertex(attrs string) string {
+	g.n++
+	id := fmt.Sprintf("v%v", g.n)
+	fmt.Fprintf(g.w, "\t\t%v [%v];\n", id, attrs)
+	return id
+}
+
+func (g *dataflowGraph) edge(from dataflowPort, to, attrs string) {
+	if from.label != "" {
+		if attrs != "" {
+			attrs += ", "
+		}
+		attrs += fmt.Sprintf("taillabel=%q", from.label)
+	}
+	if attrs != "" {
+		attrs = " [" + attrs + "]"
+	}
+	fmt.Fprintf(g.w, "\t\t%v -> %v%v;\n", from.id, to, attrs)
+}
+
+func (g *dataflowGraph) variable(name string) string {
+	id, ok := g.vars[name]
+	if !ok {
+		// Undeclared variable
+		id = g.vertex(fmt.Sprintf("label=%q, shape=ellipse, style=dashed", name))
+		g.vars[name] = id
+	}
+	return id
+}
+
+func (g *dataflowGraph) node(n *Node) {
+	fmt.Fprintf(g.w, "\tsubgraph %q {\n", "cluster_"+n.Name)
+	fmt.Fprintf(g.w, "\t\tlabel=%q;\n", n.Name)
+
+	g.vars = make(map[string]string)
+	for _, l := range []struct {
+		params []Param
+		shape  string
+	}{
+		{n.InParams, "invhouse"},
+		{n.OutParams, "house"},
+		{n.LocalParams, "ellipse"},
+	} {
+		for _, param := range l.params {
+			label := param.Name + ": " + param.Type.String()
+			g.vars[param.Name] = g.vertex(fmt.Sprintf("label=%q, shape=%v", label, l.shape))
+		}
+	}
+
+	for _, a := range n.Body {
+		ports := g.expr(a.Body)
+		for i, dst := range a.Dst {
+			if i < len(ports) {
+				g.edge(ports[i], g.variable(dst), "")
+			}
+		}
+	}
+
+	fmt.Fprintf(g.w, "\t}\n")
+}
+
+// elementWise draws an operator applied to each element of tuples. operands
+// contains the ports of each operand, attrs the attributes of the edge from
+// each operand.
+func (g *dataflowGraph) elementWise(vertexAttrs string, operands [][]dataflowPort, attrs []string) []dataflowPort {
+	size := 1
+	for _, ports := range operands {
+		if len(ports) > size {
+			size = len(ports)
+		}
+	}
+
+	out := make([]dataflowPort, size)
+	for i := range out {
+		id := g.vertex(vertexAttrs)
+		for j, ports := range operands {
+			// Operands which aren't tuples are shared by all elements
+			if len(ports) == 1 {
+				g.edge(ports[0], id, attrs[j])
+			} else if i < len(ports) {
+				g.edge(ports[i], id, attrs[j])
+			}
+		}
+		out[i] = dataflowPort{id: id}
+	}
+	return out
+}
+
+// expr draws an expression and returns the ports producing its values.
+func (g *dataflowGraph) expr(e Expr) []dataflowPort {
+	switch e := e.(type) {
+	case ExprVar:
+		return []dataflowPort{{id: g.variable(e.Name)}}
+	case ExprConst:
+		return []dataflowPort{{id: g.vertex(fmt.Sprintf("label=%q, shape=plaintext", e.String()))}}
+	case ExprTuple:
+		var ports []dataflowPort
+		for _, e := range e {
+			ports = append(ports, g.expr(e)...)
+		}
+		return ports
+	case *ExprCall:
+		id := g.vertex(fmt.Sprintf("label=%q, shape=box, style=bold", e.Name))
+		callee := g.defs[e.Name]
+		var args []dataflowPort
+		for _, arg := range e.Args {
+			args = append(args, g.expr(arg)...)
+		}
+		for i, arg := range args {
+			attrs := ""
+			if callee != nil && i < len(callee.InParams) {
+				attrs = fmt.Sprintf("headlabel=%q", callee.InParams[i].Name)
+			}
+			g.edge(arg, id, attrs)
+		}
+
+		if callee == nil || len(callee.OutParams) == 1 {
+			return []dataflowPort{{id: id}}
+		}
+		out := make([]dataflowPort, len(callee.OutParams))
+		for i, param := range callee.OutParams {
+			out[i] = dataflowPort{id, param.Name}
+		}
+		return out
+	case *ExprBinOp:
+		left, right := g.expr(e.Left), g.expr(e.Right)
+		if e.Op == BinOpFby {
+			return g.elementWise(`label="fby", shape=box, peripheries=2`, [][]dataflowPort{left, right}, []string{"", `style=dashed, label="delay", constraint=false`})
+		}
+		attrs := []string{"", ""}
+		switch e.Op {
+		case BinOpMinus, BinOpDiv, BinOpFMinus, BinOpFDiv, BinOpGt, BinOpLt, BinOpGe, BinOpLe:
+			// Operand order matters
+			attrs = []string{`label="1"`, `label="2"`}
+		}
+		return g.elementWise(fmt.Sprintf("label=%q, shape=circle", e.Op.String()), [][]dataflowPort{left, right}, attrs)
+	case *ExprUnOp:
+		return g.elementWise(fmt.Sprintf("label=%q, shape=circle", e.Op.String()), [][]dataflowPort{g.expr(e.Expr)}, []string{""})
+	case *ExprIf:
+		operands := [][]dataflowPort{g.expr(e.Cond), g.expr(e.Body), g.expr(e.Else)}
+		return g.elementWise(`label="if", shape=diamond`, operands, []string{`label="cond"`, `label="then"`, `label="else"`})
+	default:
+		panic(fmt.Sprintf("minilustre: unknown expression type %T", e))
+	}
+}
@@ -0,0 +1,75 @@
+package minilustre
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var (
+	dotVertexRegexp = regexp.MustCompile(`^\t+(v\d+) \[(.*)\];$`)
+	dotEdgeRegexp   = regexp.MustCompile(`^\t+(v\d+) -> (v\d+)(?: \[(.*)\])?;$`)
+)
+
+func TestWriteDataflowGraph(t *testing.T) {
+	f := parseFile(t, "testdata/seq.mls")
+
+	var b strings.Builder
+	if err := WriteDataflowGraph(&b, f, "counter", "sums"); err != nil {
+		t.Fatalf("WriteDataflowGraph() = %v", err)
+	}
+	out := b.String()
+
+	vertices := make(map[string]string)
+	var edges [][]string
+	for _, line := range strings.Split(out, "\n") {
+		if m := dotVertexRegexp.FindStringSubmatch(line); m != nil {
+			vertices[m[1]] = m[2]
+		} else if m := dotEdgeRegexp.FindStringSubmatch(line); m != nil {
+			edges = append(edges, m[1:])
+		}
+	}
+	for _, e := range edges {
+		if _, ok := vertices[e[0]]; !ok {
+			t.Errorf("edge from undeclared vertex %v", e[0])
+		}
+		if _, ok := vertices[e[1]]; !ok {
+			t.Errorf("edge to undeclared vertex %v", e[1])
+		}
+	}
+
+	for _, s := range []string{
+		`subgraph "cluster_counter" {`,
+		`subgraph "cluster_sums" {`,
+		`[label="x: int", shape=invhouse]`,
+		`[label="c: int", shape=house]`,
+		`[label="c1: int", shape=ellipse]`,
+		`[label="counter", shape=box, style=bold]`,
+		`[label="edge_count", shape=box, style=bold]`,
+		`[headlabel="b"]`,
+	} {
+		if !strings.Contains(out, s) {
+			t.Errorf("WriteDataflowGraph() doesn't contain %q:\n%v", s, out)
+		}
+	}
+
+	// c = 0 fby c + x: the sum is delayed, and its result is fed back
+	var fby, delayed int
+	for id, attrs := range vertices {
+		if strings.HasPrefix(attrs, `label="fby"`) {
+			fby++
+			for _, e := range edges {
+				if e[1] == id && strings.Contains(e[2], "style=dashed") {
+					delayed++
+				}
+			}
+		}
+	}
+	if fby != 3 || delayed != 3 {
+		t.Errorf("WriteDataflowGraph() has %v fby vertices and %v delayed edges, want 3", fby, delayed)
+	}
+
+	if err := WriteDataflowGraph(&b, f, "missing"); err == nil {
+		t.Errorf("WriteDataflowGraph() succeeded with an undefined node")
+	}
+}
@@ -0,0 +1,56 @@
+package minilustre
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Error is an error at a position in a source file.
+type Error struct {
+	Pos Pos
+	Msg string
+}
+
+func errorf(pos Pos, format string, v ...interface{}) *Error {
+	return &Error{pos, fmt.Sprintf(format, v...)}
+}
+
+func (err *Error) Error() string {
+	return fmt.Sprintf("minilustre: %v: %v", err.Pos, err.Msg)
+}
+
+// ErrorList is a list of errors, sorted by position.
+type ErrorList []*Error
+
+func (l ErrorList) Error() string {
+	switch len(l) {
+	case 0:
+		return "minilustre: no errors"
+	case 1:
+		return l[0].Error()
+	case 2:
+		return fmt.Sprintf("%v (and 1 more error)", l[0])
+	default:
+		return fmt.Sprintf("%v (and %v more errors)", l[0], len(l)-1)
+	}
+}
+
+// sortErrors sorts a list of errors by file name and offset. Errors at the
+// same position keep their order.
+func sortErrors(l ErrorList) {
+	sort.SliceStable(l, func(i, j int) bool {
+		a, b := l[i].Pos, l[j].Pos
+		if a.Filename != b.Filename {
+			return a.Filename < b.Filename
+		}
+		return a.Offset < b.Offset
+	})
+}
+
+// Err returns an error equivalent to this list, or nil if the list is empty.
+func (l ErrorList) Err() error {
+	if len(l) == 0 {
+		return nil
+	}
+	return l
+}
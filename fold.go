@@ -0,0 +1,161 @@
+package minilustre
+
+import (
+	"math"
+)
+
+// hasEffects returns true if an expression contains a node call or an integer
+// division. Such expressions can't be removed, because the called node may
+// have side effects or state, and divisions by zero are runtime errors.
+func hasEffects(e Expr) bool {
+	found := false
+	Inspect(e, func(e Expr) bool {
+		switch e := e.(type) {
+		case *ExprCall:
+			found = true
+		case *ExprBinOp:
+			found = e.Op == BinOpDiv
+		}
+		return !found
+	})
+	return found
+}
+
+func isConst(e Expr, v interface{}) bool {
+	c, ok := e.(ExprConst)
+	return ok && c.Value == v
+}
+
+type folder struct {
+	errors ErrorList
+}
+
+func (fo *folder) binOp(e *ExprBinOp) Expr {
+	left, leftOk := e.Left.(ExprConst)
+	right, rightOk := e.Right.(ExprConst)
+
+	if e.Op == BinOpDiv && isConst(e.Right, 0) {
+		fo.errors = append(fo.errors, errorf(e.OpPos, "integer division by zero"))
+		return e
+	}
+
+	if leftOk && rightOk {
+		if e.Op == BinOpFby {
+			if left.Value == right.Value {
+				return left
+			}
+			return e
+		}
+
+		v, err := evalBinOp(e.Op, left.Value, right.Value)
+		if f, ok := v.(float32); ok && (math.IsInf(float64(f), 0) || math.IsNaN(float64(f))) {
+			// Can't be written as a constant
+			return e
+		}
+		if err == nil {
+			return ExprConst{v, e.Pos()}
+		}
+		return e
+	}
+
+	switch e.Op {
+	case BinOpPlus:
+		if isConst(e.Left, 0) {
+			return e.Right
+		} else if isConst(e.Right, 0) {
+			return e.Left
+		}
+	case BinOpMinus:
+		if isConst(e.Right, 0) {
+			return e.Left
+		}
+	case BinOpMul:
+		if isConst(e.Left, 1) {
+			return e.Right
+		} else if isConst(e.Right, 1) {
+			return e.Left
+		} else if isConst(e.Left, 0) && !hasEffects(e.Right) {
+			return e.Left
+		} else if isConst(e.Right, 0) && !hasEffects(e.Left) {
+			return ExprConst{0, e.Pos()}
+		}
+	case BinOpDiv:
+		if isConst(e.Right, 1) {
+			return e.Left
+		}
+	case BinOpAnd:
+		if isConst(e.Left, true) {
+			return e.Right
+		} else if isConst(e.Right, true) {
+			return e.Left
+		} else if isConst(e.Left, false) && !hasEffects(e.Right) {
+			return e.Left
+		} else if isConst(e.Right, false) && !hasEffects(e.Left) {
+			return ExprConst{false, e.Pos()}
+		}
+	case BinOpOr:
+		if isConst(e.Left, false) {
+			return e.Right
+		} else if isConst(e.Right, false) {
+			return e.Left
+		} else if isConst(e.Left, true) && !hasEffects(e.Right) {
+			return e.Left
+		} else if isConst(e.Right, true) && !hasEffects(e.Left) {
+			return ExprConst{true, e.Pos()}
+		}
+	}
+
+	return e
+}
+
+func (fo *folder) unOp(e *ExprUnOp) Expr {
+	if c, ok := e.Expr.(ExprConst); ok {
+		if v, err := evalUnOp(e.Op, c.Value); err == nil {
+			return ExprConst{v, e.OpPos}
+		}
+		return e
+	}
+
+	// not not x, - -x and -. -.x
+	if inner, ok := e.Expr.(*ExprUnOp); ok && inner.Op == e.Op {
+		return inner.Expr
+	}
+
+	return e
+}
+
+func (fo *folder) fold(e Expr) Expr {
+	switch e := e.(type) {
+	case *ExprBinOp:
+		return fo.binOp(e)
+	case *ExprUnOp:
+		return fo.unOp(e)
+	case *ExprIf:
+		cond, ok := e.Cond.(ExprConst)
+		if !ok {
+			return e
+		}
+		if cond.Value == true && !hasEffects(e.Else) {
+			return e.Body
+		} else if cond.Value == false && !hasEffects(e.Body) {
+			return e.Else
+		}
+	}
+	return e
+}
+
+// Fold evaluates constant expressions and simplifies trivial operations, such
+// as additions of zero. Expressions containing node calls are never removed.
+//
+// Errors detected at compile time, such as divisions by zero, are returned in
+// an ErrorList.
+func Fold(f *File) error {
+	var fo folder
+	for i := range f.Nodes {
+		n := &f.Nodes[i]
+		for j := range n.Body {
+			n.Body[j].Body = Rewrite(n.Body[j].Body, fo.fold)
+		}
+	}
+	return fo.errors.Err()
+}
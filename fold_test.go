@@ -0,0 +1,65 @@
+package minilustre
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFold(t *testing.T) {
+	tests := []struct {
+		expr, want string
+	}{
+		{"1 + 2 * 3", "7"},
+		{"2147483647 + 1", "-2147483648"},
+		{"1.5 *. 2.0 -. 4.0", "-1.0"},
+		{"1 < 2 and not false", "true"},
+		{"x + 0", "x"},
+		{"1 * x / 1 - 0", "x"},
+		{"x * 0", "0"},
+		{"f(x) * 0", "f(x) * 0"},
+		{"0 * (1 / x)", "0 * (1 / x)"},
+		{"false and 1 / x > 0", "false and 1 / x > 0"},
+		{"if true then y else 1 / x", "if true then y else 1 / x"},
+		{"false and z /. 2.0 > 0.0", "false"},
+		{"not not (x > 0)", "x > 0"},
+		{"- -x", "x"},
+		{"if 1 > 0 then x else y", "x"},
+		{"if false then f(x) else y", "if false then f(x) else y"},
+		{"b and true or false", "b"},
+		{"b or true", "true"},
+		{"1 fby 1", "1"},
+		{"1 fby 2", "1 fby 2"},
+		{"1.0 /. 0.0", "1.0 /. 0.0"},
+	}
+
+	for _, tc := range tests {
+		f, err := Parse(strings.NewReader("node n () returns (o: int); let o = " + tc.expr + "; tel"))
+		if err != nil {
+			t.Fatalf("Parse(%q) = %v", tc.expr, err)
+		}
+		if err := Fold(f); err != nil {
+			t.Errorf("Fold(%q) = %v", tc.expr, err)
+			continue
+		}
+		if got := f.Nodes[0].Body[0].Body.String(); got != tc.want {
+			t.Errorf("Fold(%q) = %q, want %q", tc.expr, got, tc.want)
+		}
+	}
+}
+
+func TestFoldDivisionByZero(t *testing.T) {
+	src := "node n (x: int) returns (o: int);\nlet\n  o = x / (1 - 1);\ntel\n"
+	f, err := Parse(strings.NewReader(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = Fold(f)
+	l, ok := err.(ErrorList)
+	if !ok || len(l) != 1 {
+		t.Fatalf("Fold() = %v, want one error", err)
+	}
+	if l[0].Pos.Line != 3 || l[0].Pos.Column != 9 {
+		t.Errorf("error at %v, want 3:9", l[0].Pos)
+	}
+}
@@ -0,0 +1,116 @@
+package minilustre
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func addTestdataCorpus(f *testing.F) {
+	filenames, err := filepath.Glob("testdata/*.mls")
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, filename := range filenames {
+		b, err := os.ReadFile(filename)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(string(b))
+	}
+}
+
+func FuzzLex(f *testing.F) {
+	addTestdataCorpus(f)
+	f.Fuzz(func(t *testing.T, src string) {
+		s := NewScanner(strings.NewReader(src))
+		offset := 0
+		for {
+			tok, err := s.Next()
+			if err != nil {
+				break
+			}
+
+			if tok.Pos.Offset < offset {
+				t.Fatalf("token %v at offset %v is before offset %v", &tok, tok.Pos.Offset, offset)
+			}
+			offset = tok.Pos.Offset + len(tok.Value)
+			if offset > len(src) || src[tok.Pos.Offset:offset] != tok.Value {
+				t.Fatalf("token %v doesn't match source text at %v", &tok, tok.Pos)
+			}
+
+			if tok.Kind == TokenEOF {
+				if offset != len(src) {
+					t.Fatalf("EOF at offset %v, want %v", offset, len(src))
+				}
+				break
+			}
+		}
+	})
+}
+
+func FuzzParse(f *testing.F) {
+	addTestdataCorpus(f)
+	f.Fuzz(func(t *testing.T, src string) {
+		file, err := Parse(strings.NewReader(src))
+		if file == nil {
+			t.Fatalf("Parse() = nil, %v: want a partial file", err)
+		}
+		if err == nil {
+			return
+		}
+
+		l, ok := err.(ErrorList)
+		if !ok || len(l) == 0 {
+			t.Fatalf("Parse() = %#v, want a non-empty ErrorList", err)
+		}
+		for _, e := range l {
+			if !e.Pos.IsValid() || e.Pos.Offset > len(src) {
+				t.Errorf("invalid error position: %v", e)
+			}
+		}
+	})
+}
+
+func FuzzParseString(f *testing.F) {
+	addTestdataCorpus(f)
+	f.Fuzz(func(t *testing.T, src string) {
+		file, err := Parse(strings.NewReader(src))
+		if err != nil {
+			return
+		}
+
+		s := file.String()
+		file2, err := Parse(strings.NewReader(s))
+		if err != nil {
+			t.Fatalf("Parse(%q) = %v", s, err)
+		}
+		if !equalNodes(file.Nodes, file2.Nodes) {
+			t.Fatalf("Parse(%q) differs from the original file", s)
+		}
+		if s2 := file2.String(); s2 != s {
+			t.Fatalf("String() is not stable:\n%v\nvs.\n%v", s, s2)
+		}
+	})
+}
+
+func FuzzFormat(f *testing.F) {
+	addTestdataCorpus(f)
+	f.Add("-- a\nnode f (x: int) returns (o: int); -- b\nvar a: int; (* c *)\nlet\n  a = (if x > 0 then x else 0) + 1;\n\n  o = - -a; -- d\n  (* e *)\ntel -- f\n")
+	f.Fuzz(func(t *testing.T, src string) {
+		out, err := Format([]byte(src))
+		if err != nil {
+			return
+		}
+
+		out2, err := Format(out)
+		if err != nil {
+			t.Fatalf("Format(%q) = %v", out, err)
+		}
+		if !bytes.Equal(out, out2) {
+			t.Fatalf("Format() is not idempotent:\n%s\nvs.\n%s", out, out2)
+		}
+	})
+}
@@ -1,3 +1,11 @@
 module github.com/emersion/minilustre
 
+go 1.18
+
 require github.com/llir/llvm v0.3.0-pre6
+
+require (
+	github.com/mewmew/float v0.0.0-20181121163145-c0f786d7da73 // indirect
+	github.com/pkg/errors v0.8.0 // indirect
+	golang.org/x/tools v0.0.0-20181221235234-d00ac6d27372 // indirect
+)
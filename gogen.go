@@ -0,0 +1,551 @@
+package minilustre
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// goReserved contains Go keywords, predeclared identifiers and names used by
+// the generated code.
+var goReserved = map[string]bool{
+	"break": true, "case": true, "chan": true, "const": true,
+	"continue": true, "default": true, "defer": true, "else": true,
+	"fallthrough": true, "for": true, "func": true, "go": true, "goto": true,
+	"if": true, "import": true, "interface": true, "map": true,
+	"package": true, "range": true, "return": true, "select": true,
+	"struct": true, "switch": true, "type": true, "var": true,
+	"bool": true, "int32": true, "float32": true, "string": true,
+	"true": true, "false": true, "nil": true, "math": true, "fmt": true,
+	"s": true, "ite": true,
+}
+
+// goExported returns the exported Go identifier for a node name, e.g.
+// EdgeCount for edge_count.
+func goExported(name string) string {
+	var b strings.Builder
+	for _, part := range strings.Split(name, "_") {
+		if part != "" {
+			b.WriteString(strings.ToUpper(part[:1]) + part[1:])
+		}
+	}
+	if b.Len() == 0 {
+		return "X" + name
+	}
+	return b.String()
+}
+
+// goNodeNames returns the exported Go identifiers of nodes. Distinct node
+// names may give the same identifier, such as edge_count and edgeCount: a
+// numeric suffix is then added to the nodes defined last, e.g. EdgeCount2.
+func goNodeNames(nodes []Node) map[string]string {
+	names := map[string]string{"print": "Print"}
+	taken := map[string]bool{"Print": true}
+	for _, n := range nodes {
+		name := goExported(n.Name)
+		if taken[name] {
+			i := 2
+			for taken[name+strconv.Itoa(i)] {
+				i++
+			}
+			name += strconv.Itoa(i)
+		}
+		taken[name] = true
+		names[n.Name] = name
+	}
+	return names
+}
+
+func goType(t Type) string {
+	switch t {
+	case TypeBool:
+		return "bool"
+	case TypeInt:
+		return "int32"
+	case TypeFloat:
+		return "float32"
+	case TypeString:
+		return "string"
+	}
+	panic(fmt.Sprintf("minilustre: no Go type for %v", t))
+}
+
+// goPrecedence returns the precedence of a Go binary operator.
+func goPrecedence(op BinOp) int {
+	switch op {
+	case BinOpMul, BinOpDiv, BinOpFMul, BinOpFDiv:
+		return 5
+	case BinOpPlus, BinOpMinus, BinOpFPlus, BinOpFMinus:
+		return 4
+	case BinOpAnd:
+		return 2
+	case BinOpOr:
+		return 1
+	default:
+		return 3
+	}
+}
+
+func goBinOp(op BinOp) string {
+	switch op {
+	case BinOpPlus, BinOpFPlus:
+		return "+"
+	case BinOpMinus, BinOpFMinus:
+		return "-"
+	case BinOpMul, BinOpFMul:
+		return "*"
+	case BinOpDiv, BinOpFDiv:
+		return "/"
+	case BinOpAnd:
+		return "&&"
+	case BinOpOr:
+		return "||"
+	case BinOpEq:
+		return "=="
+	case BinOpNe:
+		return "!="
+	}
+	return op.String()
+}
+
+type gogen struct {
+	classes map[string]*Class
+	// Go identifiers of the nodes
+	exported map[string]string
+	// Names of the top-level declarations
+	globals  map[string]bool
+	usesIte  bool
+	usesMath bool
+	errors   ErrorList
+
+	// Class being generated
+	class *Class
+	types map[string]Type
+	mems  map[string]Type
+	used  map[string]bool
+}
+
+// name returns the Go identifier for a variable, memory or instance.
+func (g *gogen) name(name string) string {
+	if goReserved[name] || g.globals[name] {
+		return name + "_"
+	}
+	return name
+}
+
+func (g *gogen) constant(v interface{}, typed bool) string {
+	var s string
+	switch v := v.(type) {
+	case bool:
+		return strconv.FormatBool(v)
+	case int:
+		s = strconv.Itoa(v)
+		if typed {
+			return "int32(" + s + ")"
+		}
+	case float32:
+		// Constant expressions can't produce infinities, NaNs nor negative
+		// zeros
+		switch f := float64(v); {
+		case math.IsInf(f, 0) || math.IsNaN(f):
+			g.usesMath = true
+			if math.IsNaN(f) {
+				return "float32(math.NaN())"
+			} else if f > 0 {
+				return "float32(math.Inf(1))"
+			}
+			return "float32(math.Inf(-1))"
+		case f == 0 && math.Signbit(f):
+			g.usesMath = true
+			return "float32(math.Copysign(0, -1))"
+		}
+		s = strconv.FormatFloat(float64(v), 'g', -1, 32)
+		if typed {
+			return "float32(" + s + ")"
+		}
+	case string:
+		return strconv.Quote(v)
+	default:
+		panic(fmt.Sprintf("minilustre: no Go constant for %#v", v))
+	}
+	if strings.HasPrefix(s, "-") {
+		return "(" + s + ")"
+	}
+	return s
+}
+
+// goEval evaluates an expression made of constants. Go evaluates constant
+// expressions at compile time with arbitrary precision and rejects overflows,
+// so they're evaluated with the semantics of the interpreter instead.
+func goEval(e Expr) (interface{}, bool) {
+	switch e := e.(type) {
+	case ExprConst:
+		return e.Value, true
+	case *ExprBinOp:
+		left, ok := goEval(e.Left)
+		if !ok {
+			return nil, false
+		}
+		right, ok := goEval(e.Right)
+		if !ok {
+			return nil, false
+		}
+		v, err := evalBinOp(e.Op, left, right)
+		return v, err == nil
+	case *ExprUnOp:
+		v, ok := goEval(e.Expr)
+		if !ok {
+			return nil, false
+		}
+		v, err := evalUnOp(e.Op, v)
+		return v, err == nil
+	}
+	return nil, false
+}
+
+// expr returns the Go expression for a simple expression. If typed is true,
+// constants are converted to their type, for instance when used as arguments
+// of ite.
+func (g *gogen) expr(e Expr, typed bool) string {
+	switch e := e.(type) {
+	case ExprConst:
+		return g.constant(e.Value, typed)
+	case ExprVar:
+		return g.name(e.Name)
+	case *ExprBinOp:
+		if v, ok := goEval(e); ok {
+			return g.constant(v, typed)
+		}
+
+		// Go rejects divisions by a constant zero
+		if v, ok := goEval(e.Right); ok && (v == 0 || v == float32(0)) {
+			if e.Op == BinOpDiv {
+				g.errors = append(g.errors, errorf(e.OpPos, "integer division by zero"))
+			} else if e.Op == BinOpFDiv {
+				// x / 0 is the same as x * inf
+				g.usesMath = true
+				inf := "float32(math.Inf(1))"
+				if math.Signbit(float64(v.(float32))) {
+					inf = "float32(math.Inf(-1))"
+				}
+				return g.operand(e.Left, BinOpFMul, false) + " * " + inf
+			}
+		}
+
+		l, r := g.operand(e.Left, e.Op, false), g.operand(e.Right, e.Op, true)
+		return l + " " + goBinOp(e.Op) + " " + r
+	case *ExprUnOp:
+		if v, ok := goEval(e); ok {
+			return g.constant(v, typed)
+		}
+
+		v := g.expr(e.Expr, false)
+		switch e.Expr.(type) {
+		case *ExprBinOp, *ExprUnOp:
+			v = "(" + v + ")"
+		}
+		switch e.Op {
+		case UnOpNot:
+			return "!" + v
+		default:
+			return "-" + v
+		}
+	case *ExprIf:
+		g.usesIte = true
+		return "ite(" + g.expr(e.Cond, false) + ", " + g.expr(e.Body, true) + ", " + g.expr(e.Else, true) + ")"
+	}
+	panic(fmt.Sprintf("minilustre: unexpected expression %T in Obc", e))
+}
+
+// operand returns the Go expression for the operand of a binary operator.
+func (g *gogen) operand(e Expr, op BinOp, right bool) string {
+	s := g.expr(e, false)
+	bin, ok := e.(*ExprBinOp)
+	if !ok {
+		return s
+	}
+
+	// An explicit conversion prevents the compiler from fusing a float
+	// multiplication with another operation
+	if bin.Op == BinOpFMul {
+		return "float32(" + s + ")"
+	}
+
+	if p := goPrecedence(bin.Op); p < goPrecedence(op) || (p == goPrecedence(op) && right) {
+		return "(" + s + ")"
+	}
+	return s
+}
+
+// dst returns the Go expression for the destination of an assignment. Unused
+// variables aren't declared, and are discarded.
+func (g *gogen) dst(name string) string {
+	if !g.used[name] {
+		return "_"
+	}
+	return g.name(name)
+}
+
+// assign writes an assignment, turning if expressions into if statements.
+func (g *gogen) assign(w io.Writer, indent, dst string, e Expr) {
+	ite, ok := e.(*ExprIf)
+	if !ok || dst == "_" {
+		fmt.Fprintf(w, "%v%v = %v\n", indent, dst, g.expr(e, false))
+		return
+	}
+
+	fmt.Fprintf(w, "%vif %v {\n", indent, g.expr(ite.Cond, false))
+	for {
+		g.assign(w, indent+"\t", dst, ite.Body)
+		next, ok := ite.Else.(*ExprIf)
+		if !ok {
+			break
+		}
+		ite = next
+		fmt.Fprintf(w, "%v} else if %v {\n", indent, g.expr(ite.Cond, false))
+	}
+	fmt.Fprintf(w, "%v} else {\n", indent)
+	g.assign(w, indent+"\t", dst, ite.Else)
+	fmt.Fprintf(w, "%v}\n", indent)
+}
+
+func (g *gogen) stmt(w io.Writer, s Stmt) {
+	switch s := s.(type) {
+	case *StmtAssign:
+		if g.types[s.Dst] != TypeUnit {
+			g.assign(w, "\t", g.dst(s.Dst), s.Expr)
+		}
+	case *StmtMemRead:
+		if g.types[s.Dst] != TypeUnit && g.used[s.Dst] {
+			fmt.Fprintf(w, "\t%v = s.%v\n", g.name(s.Dst), g.name(s.Mem))
+		}
+	case *StmtMemWrite:
+		if g.mems[s.Mem] != TypeUnit {
+			fmt.Fprintf(w, "\ts.%v = %v\n", g.name(s.Mem), g.expr(s.Expr, false))
+		}
+	case *StmtCall:
+		callee := g.classes[s.Class]
+		var args []string
+		for _, arg := range s.Args {
+			if v, ok := arg.(ExprVar); ok && g.types[v.Name] == TypeUnit {
+				continue
+			}
+			if c, ok := arg.(ExprConst); ok && c.Value == nil {
+				continue
+			}
+			args = append(args, g.expr(arg, false))
+		}
+		call := g.exported[s.Class] + "(" + strings.Join(args, ", ") + ")"
+		if s.Instance != "" {
+			call = "s." + g.name(s.Instance) + ".Step(" + strings.Join(args, ", ") + ")"
+		}
+
+		var dst []string
+		for i, name := range s.Dst {
+			if callee.Out[i].Type != TypeUnit {
+				dst = append(dst, g.dst(name))
+			}
+		}
+		if len(dst) == 0 {
+			fmt.Fprintf(w, "\t%v\n", call)
+		} else {
+			fmt.Fprintf(w, "\t%v = %v\n", strings.Join(dst, ", "), call)
+		}
+	case *StmtReset:
+		fmt.Fprintf(w, "\ts.%v.Reset()\n", g.name(s.Instance))
+	default:
+		panic(fmt.Sprintf("unknown statement %T", s))
+	}
+}
+
+// params returns a Go parameter list. Unit parameters are omitted.
+func (g *gogen) params(params []Param) string {
+	var l []string
+	for _, group := range paramGroups(params) {
+		if group[0].Type == TypeUnit {
+			continue
+		}
+		names := make([]string, len(group))
+		for i, param := range group {
+			names[i] = g.name(param.Name)
+		}
+		l = append(l, strings.Join(names, ", ")+" "+goType(group[0].Type))
+	}
+	return strings.Join(l, ", ")
+}
+
+func (g *gogen) extern(w io.Writer, c *Class) {
+	name := g.exported[c.Name]
+	fmt.Fprintf(w, "\n// %v implements the extern node %v. It must be set before stepping\n", name, c.Name)
+	fmt.Fprintf(w, "// nodes which call it.\n")
+	fmt.Fprintf(w, "var %v func(%v) (%v)\n", name, g.params(c.In), g.params(c.Out))
+}
+
+func (g *gogen) define(w io.Writer, c *Class) {
+	g.class = c
+	g.types = make(map[string]Type)
+	g.mems = make(map[string]Type)
+	g.used = make(map[string]bool)
+	for _, params := range [][]Param{c.In, c.Out, c.Locals} {
+		for _, param := range params {
+			g.types[param.Name] = param.Type
+		}
+	}
+	for _, param := range c.Mems {
+		g.mems[param.Name] = param.Type
+	}
+	for _, param := range c.Out {
+		g.used[param.Name] = true
+	}
+	for _, s := range c.Step {
+		var exprs []Expr
+		switch s := s.(type) {
+		case *StmtAssign:
+			exprs = []Expr{s.Expr}
+		case *StmtMemWrite:
+			exprs = []Expr{s.Expr}
+		case *StmtCall:
+			exprs = s.Args
+		}
+		for _, e := range exprs {
+			exprVars(e, func(name string) {
+				g.used[name] = true
+			})
+		}
+	}
+
+	name := g.exported[c.Name]
+	fmt.Fprintf(w, "\n// %v is the state of the node %v.\n", name, c.Name)
+	fmt.Fprintf(w, "// Reset must be called before the first cycle.\n")
+	fmt.Fprintf(w, "type %v struct {\n", name)
+	for _, param := range c.Mems {
+		if param.Type != TypeUnit {
+			fmt.Fprintf(w, "\t%v %v\n", g.name(param.Name), goType(param.Type))
+		}
+	}
+	for _, inst := range c.Instances {
+		fmt.Fprintf(w, "\t%v %v\n", g.name(inst.Name), g.exported[inst.Class])
+	}
+	fmt.Fprintf(w, "}\n")
+
+	fmt.Fprintf(w, "\n// Reset initializes the state of the node.\n")
+	fmt.Fprintf(w, "func (s *%v) Reset() {\n", name)
+	for _, st := range c.Reset {
+		g.stmt(w, st)
+	}
+	fmt.Fprintf(w, "}\n")
+
+	fmt.Fprintf(w, "\n// Step computes one cycle of the node.\n")
+	out := g.params(c.Out)
+	if out != "" {
+		out = " (" + out + ")"
+	}
+	fmt.Fprintf(w, "func (s *%v) Step(%v)%v {\n", name, g.params(c.In), out)
+	var locals []Param
+	for _, param := range c.Locals {
+		if g.used[param.Name] && param.Type != TypeUnit {
+			locals = append(locals, param)
+		}
+	}
+	for _, group := range paramGroups(locals) {
+		names := make([]string, len(group))
+		for i, param := range group {
+			names[i] = g.name(param.Name)
+		}
+		fmt.Fprintf(w, "\tvar %v %v\n", strings.Join(names, ", "), goType(group[0].Type))
+	}
+	for _, st := range c.Step {
+		g.stmt(w, st)
+	}
+	if out != "" {
+		fmt.Fprintf(w, "\treturn\n")
+	}
+	fmt.Fprintf(w, "}\n")
+}
+
+// CompileGo compiles a file to the source of a Go package named pkg.
+//
+// Each node, e.g. edge_count, is compiled to a struct type EdgeCount holding
+// its state, with a Reset method and a Step method taking the inputs of the
+// node and returning its outputs. Each extern node is compiled to a function
+// variable, which must be set by the user of the package. If several nodes
+// get the same identifier, a numeric suffix is added to the ones defined
+// last, e.g. EdgeCount2.
+func CompileGo(f *File, pkg string, w io.Writer) error {
+	p, err := Translate(f)
+	if err != nil {
+		return err
+	}
+
+	g := gogen{
+		classes: map[string]*Class{
+			"print": {
+				Name:   "print",
+				Extern: true,
+				In:     []Param{{Name: "str", Type: TypeString}},
+				Out:    []Param{{Name: "u", Type: TypeUnit}},
+			},
+		},
+		exported: goNodeNames(f.Nodes),
+		globals:  make(map[string]bool),
+	}
+	for i := range p.Classes {
+		g.classes[p.Classes[i].Name] = &p.Classes[i]
+	}
+	for _, name := range g.exported {
+		g.globals[name] = true
+	}
+
+	var body bytes.Buffer
+	usesPrint := false
+	for i := range p.Classes {
+		c := &p.Classes[i]
+		if c.Extern {
+			g.extern(&body, c)
+			continue
+		}
+		g.define(&body, c)
+		for _, s := range c.Step {
+			if call, ok := s.(*StmtCall); ok && call.Class == "print" && call.Instance == "" {
+				usesPrint = true
+			}
+		}
+	}
+
+	if err := g.errors.Err(); err != nil {
+		return err
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "// Code generated by minilustre. DO NOT EDIT.\n\n")
+	fmt.Fprintf(&b, "package %v\n", pkg)
+	if usesPrint || g.usesMath {
+		fmt.Fprintf(&b, "\nimport (\n")
+		if usesPrint {
+			fmt.Fprintf(&b, "\t\"fmt\"\n")
+		}
+		if g.usesMath {
+			fmt.Fprintf(&b, "\t\"math\"\n")
+		}
+		fmt.Fprintf(&b, ")\n")
+	}
+	if usesPrint {
+		fmt.Fprintf(&b, "\n// Print implements the print node.\n")
+		fmt.Fprintf(&b, "var Print = func(str string) {\n\tfmt.Print(str)\n}\n")
+	}
+	if g.usesIte {
+		fmt.Fprintf(&b, "\nfunc ite[T any](cond bool, a, b T) T {\n\tif cond {\n\t\treturn a\n\t}\n\treturn b\n}\n")
+	}
+	b.Write(body.Bytes())
+
+	src, err := format.Source(b.Bytes())
+	if err != nil {
+		return fmt.Errorf("minilustre: failed to format Go code: %v", err)
+	}
+	_, err = w.Write(src)
+	return err
+}
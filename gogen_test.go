@@ -0,0 +1,69 @@
+package minilustre
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCompileGoNames(t *testing.T) {
+	src := `node edge_count (x: int) returns (y: int);
+let
+  y = x + 1;
+tel
+
+node edgeCount (x: int) returns (y: int);
+let
+  y = x + 2;
+tel
+
+node p__f (x: int) returns (y: int);
+let
+  y = edge_count(x) + edgeCount(x);
+tel
+
+node p_f (x: int) returns (y: int);
+let
+  y = p__f(x) * 10;
+tel
+`
+	f, err := Parse(strings.NewReader(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var pkg strings.Builder
+	if err := CompileGo(f, "node", &pkg); err != nil {
+		t.Fatalf("CompileGo() = %v", err)
+	}
+	for _, name := range []string{"EdgeCount", "EdgeCount2", "PF", "PF2"} {
+		if !strings.Contains(pkg.String(), "\ntype "+name+" struct") {
+			t.Errorf("package doesn't define %v:\n%v", name, pkg.String())
+		}
+	}
+
+	run := goRunner()
+	if run == nil {
+		t.Skip("go not available")
+	}
+	main := `package main
+
+import (
+	"fmt"
+
+	"trace/node"
+)
+
+func main() {
+	var s node.PF2
+	s.Reset()
+	fmt.Println(s.Step(1))
+}
+`
+	stdout, err := run(t, map[string]string{"go.mod": "module trace\n\ngo 1.18\n", "node/node.go": pkg.String(), "main.go": main})
+	if err != nil {
+		t.Fatalf("failed to run Go code: %v", err)
+	}
+	if stdout != "50\n" {
+		t.Errorf("got output %q, want %q", stdout, "50\n")
+	}
+}
@@ -0,0 +1,158 @@
+package minilustre
+
+import (
+	"strconv"
+)
+
+type inliner struct {
+	node *Node
+	all  bool
+	// Nodes which can be called from the node being processed
+	defs map[string]*Node
+	// Variable names used in the node being processed
+	names map[string]bool
+	body  []Assign
+}
+
+// freshName returns a name derived from base which isn't in names, and adds
+// it to names.
+func freshName(names map[string]bool, base string) string {
+	for i := 1; ; i++ {
+		s := base + "_" + strconv.Itoa(i)
+		if !names[s] {
+			names[s] = true
+			return s
+		}
+	}
+}
+
+// nodeNames returns the names of the parameters and locals of a node.
+func nodeNames(n *Node) map[string]bool {
+	names := make(map[string]bool)
+	for _, params := range [][]Param{n.InParams, n.OutParams, n.LocalParams} {
+		for _, param := range params {
+			names[param.Name] = true
+		}
+	}
+	return names
+}
+
+func (in *inliner) local(name string, t Type) string {
+	name = freshName(in.names, name)
+	in.node.LocalParams = append(in.node.LocalParams, Param{Name: name, Type: t})
+	return name
+}
+
+// call returns the expression replacing a call. The equations of the callee
+// are added to the body of the caller.
+func (in *inliner) call(call *ExprCall) Expr {
+	callee, ok := in.defs[call.Name]
+	if !ok || callee.Extern || !(in.all || callee.Inline) || len(call.Args) != len(callee.InParams) {
+		return call
+	}
+
+	vars := make(map[string]Expr)
+	for i, param := range callee.InParams {
+		// Variables and constants can be substituted directly, other
+		// arguments need to be evaluated once
+		switch arg := call.Args[i].(type) {
+		case ExprVar, ExprConst:
+			vars[param.Name] = arg
+		default:
+			name := in.local(callee.Name+"_"+param.Name, param.Type)
+			in.body = append(in.body, Assign{Pos: arg.Pos(), Dst: []string{name}, Body: arg})
+			vars[param.Name] = ExprVar{name, arg.Pos()}
+		}
+	}
+
+	var out ExprTuple
+	for _, param := range callee.OutParams {
+		name := in.local(callee.Name+"_"+param.Name, param.Type)
+		vars[param.Name] = ExprVar{name, call.NamePos}
+		out = append(out, ExprVar{name, call.NamePos})
+	}
+	for _, param := range callee.LocalParams {
+		name := in.local(callee.Name+"_"+param.Name, param.Type)
+		vars[param.Name] = ExprVar{name, param.Pos}
+	}
+
+	rename := func(e Expr) Expr {
+		switch e := e.(type) {
+		case ExprVar:
+			switch v := vars[e.Name].(type) {
+			case ExprVar:
+				return ExprVar{v.Name, e.NamePos}
+			case ExprConst:
+				return ExprConst{v.Value, e.NamePos}
+			}
+		}
+		return e
+	}
+
+	for _, a := range callee.Body {
+		dst := make([]string, len(a.Dst))
+		for i, name := range a.Dst {
+			dst[i] = vars[name].(ExprVar).Name
+		}
+		in.body = append(in.body, Assign{Pos: a.Pos, Dst: dst, Body: Rewrite(a.Body, rename)})
+	}
+
+	if len(out) == 1 {
+		return out[0]
+	}
+	return out
+}
+
+func (in *inliner) inline() {
+	for _, a := range in.node.Body {
+		body := Rewrite(a.Body, func(e Expr) Expr {
+			if call, ok := e.(*ExprCall); ok {
+				return in.call(call)
+			}
+			return e
+		})
+
+		// Split (a, b) = (x, y) into a = x and b = y
+		if t, ok := body.(ExprTuple); ok && len(t) == len(a.Dst) && len(t) > 1 {
+			if _, ok := a.Body.(*ExprCall); ok {
+				for i, dst := range a.Dst {
+					in.body = append(in.body, Assign{Pos: a.Pos, Dst: []string{dst}, Body: t[i]})
+				}
+				continue
+			}
+		}
+
+		in.body = append(in.body, Assign{Pos: a.Pos, Dst: a.Dst, Body: body})
+	}
+
+	in.node.Body = in.body
+}
+
+// Inline replaces calls to nodes marked inline with the equations of the
+// called node. If all is true, calls to all nodes defined in f are inlined.
+//
+// The parameters and locals of the called node become locals of the caller,
+// with fresh names. Each call gets its own copy of the state of the called
+// node.
+//
+// Nodes are processed so that called nodes are inlined first. If the file
+// contains recursive calls, which are reported by Check, nothing is inlined.
+func Inline(f *File, all bool) {
+	order, err := callOrder(f)
+	if err != nil {
+		return
+	}
+
+	defs := make(map[string]*Node)
+	for _, i := range order {
+		n := &f.Nodes[i]
+		in := inliner{
+			node:  n,
+			all:   all,
+			defs:  defs,
+			names: nodeNames(n),
+		}
+		in.inline()
+		defs[n.Name] = n
+	}
+}
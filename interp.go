@@ -0,0 +1,548 @@
+package minilustre
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// Interpreter executes a node cycle by cycle, directly from the AST. It is
+// meant to be used as a reference implementation of the language semantics.
+//
+// Values are represented as Go values: unit is nil, bool is bool, int is int,
+// float is float32, string is string and tuples are []interface{}.
+type Interpreter struct {
+	// Stdout is the writer used by the print node. If nil, os.Stdout is
+	// used.
+	Stdout io.Writer
+	// Externs contains the implementations of extern nodes. Functions
+	// receive one value per input, and return a single value or a tuple like
+	// node calls.
+	Externs map[string]func(args []interface{}) (interface{}, error)
+
+	file *File
+	root *instance
+}
+
+// NewInterpreter creates an interpreter for the node called name.
+func NewInterpreter(f *File, name string) (*Interpreter, error) {
+	if err := Check(f); err != nil {
+		return nil, err
+	}
+
+	it := &Interpreter{file: f}
+	index, ok := it.lookup(name)
+	if !ok {
+		return nil, fmt.Errorf("minilustre: undefined node '%v'", name)
+	}
+
+	if f.Nodes[index].Extern {
+		return nil, fmt.Errorf("minilustre: cannot interpret extern node '%v'", name)
+	}
+
+	it.root = it.newInstance(index)
+	return it, nil
+}
+
+// Node returns the node being interpreted.
+func (it *Interpreter) Node() *Node {
+	return it.root.node
+}
+
+// Reset brings the node back to its initial state.
+func (it *Interpreter) Reset() {
+	it.root = it.newInstance(it.root.index)
+}
+
+// Step executes one cycle of the node. in contains one value per input
+// parameter, and the returned slice one value per output parameter.
+func (it *Interpreter) Step(in []interface{}) ([]interface{}, error) {
+	out, err := it.root.step(in)
+	if err != nil {
+		return nil, fmt.Errorf("minilustre: %v", err)
+	}
+	return out, nil
+}
+
+// Values returns the values of the variables of the node computed during the
+// last cycle, including inputs and outputs. It returns nil before the first
+// cycle.
+func (it *Interpreter) Values() map[string]interface{} {
+	if it.root.vals == nil {
+		return nil
+	}
+	vals := make(map[string]interface{}, len(it.root.vals))
+	for k, v := range it.root.vals {
+		vals[k] = v
+	}
+	return vals
+}
+
+// Memory is the state held by a fby operator between two cycles.
+type Memory struct {
+	// Calls is the path of node calls leading to the instance holding the
+	// memory. It's empty for memories of the interpreted node.
+	Calls []*ExprCall
+	// Vars contains the variables assigned by the equation containing the
+	// operator.
+	Vars []string
+	Expr *ExprBinOp
+	// Value is the value the operator will return on the next cycle.
+	Value interface{}
+}
+
+// Memories returns the memories of the fby operators of the node and of the
+// nodes it calls, in source order. Operators which haven't been evaluated
+// yet, for instance before the first cycle, are omitted.
+func (it *Interpreter) Memories() []Memory {
+	return it.root.memories(nil, nil)
+}
+
+func (inst *instance) memories(l []Memory, calls []*ExprCall) []Memory {
+	for _, a := range inst.node.Body {
+		a := a
+		Inspect(a.Body, func(e Expr) bool {
+			switch e := e.(type) {
+			case *ExprBinOp:
+				if v, ok := inst.mem[e]; ok {
+					l = append(l, Memory{
+						Calls: calls,
+						Vars:  a.Dst,
+						Expr:  e,
+						Value: v,
+					})
+				}
+			case *ExprCall:
+				if callee, ok := inst.calls[e]; ok {
+					path := append(calls[:len(calls):len(calls)], e)
+					l = callee.memories(l, path)
+				}
+			}
+			return true
+		})
+	}
+	return l
+}
+
+func (it *Interpreter) stdout() io.Writer {
+	if it.Stdout != nil {
+		return it.Stdout
+	}
+	return os.Stdout
+}
+
+// lookup returns the index of the node called name.
+func (it *Interpreter) lookup(name string) (int, bool) {
+	for i := range it.file.Nodes {
+		if it.file.Nodes[i].Name == name {
+			return i, true
+		}
+	}
+	return -1, false
+}
+
+type equation struct {
+	assign *Assign
+	index  int
+}
+
+// instance holds the state of a node instance across cycles.
+type instance struct {
+	it    *Interpreter
+	index int
+	node  *Node
+	eqs   map[string]equation
+	first bool
+	mem   map[*ExprBinOp]interface{}
+	calls map[*ExprCall]*instance
+	// Values computed during the last cycle
+	vals map[string]interface{}
+}
+
+func (it *Interpreter) newInstance(index int) *instance {
+	n := &it.file.Nodes[index]
+
+	eqs := make(map[string]equation)
+	for i := range n.Body {
+		a := &n.Body[i]
+		for j, dst := range a.Dst {
+			eqs[dst] = equation{a, j}
+		}
+	}
+
+	return &instance{
+		it:    it,
+		index: index,
+		node:  n,
+		eqs:   eqs,
+		first: true,
+		mem:   make(map[*ExprBinOp]interface{}),
+		calls: make(map[*ExprCall]*instance),
+	}
+}
+
+// frame holds the values computed during a single cycle.
+type frame struct {
+	inst    *instance
+	vals    map[string]interface{}
+	pending map[string]bool
+	fbys    []*ExprBinOp
+}
+
+func (inst *instance) step(in []interface{}) ([]interface{}, error) {
+	n := inst.node
+	if len(in) != len(n.InParams) {
+		return nil, fmt.Errorf("node '%v' expects %v inputs, got %v", n.Name, len(n.InParams), len(in))
+	}
+
+	fr := frame{
+		inst:    inst,
+		vals:    make(map[string]interface{}),
+		pending: make(map[string]bool),
+	}
+	for i, param := range n.InParams {
+		if err := checkValue(in[i], param.Type); err != nil {
+			return nil, fmt.Errorf("input '%v' of node '%v': %v", param.Name, n.Name, err)
+		}
+		fr.vals[param.Name] = in[i]
+	}
+
+	// All equations are computed on each cycle, even if their result isn't
+	// used, because they might hold state or have side effects
+	for i := range n.Body {
+		for _, dst := range n.Body[i].Dst {
+			if _, err := fr.variable(dst); err != nil {
+				return nil, fmt.Errorf("in node '%v': %v", n.Name, err)
+			}
+		}
+	}
+
+	out := make([]interface{}, len(n.OutParams))
+	for i, param := range n.OutParams {
+		v, err := fr.variable(param.Name)
+		if err != nil {
+			return nil, fmt.Errorf("in node '%v': %v", n.Name, err)
+		}
+		out[i] = v
+	}
+
+	// The right-hand side of fby operators is evaluated at the end of the
+	// cycle, once all variables are known. Evaluating it may encounter new
+	// fby operators.
+	mem := make(map[*ExprBinOp]interface{}, len(fr.fbys))
+	for i := 0; i < len(fr.fbys); i++ {
+		e := fr.fbys[i]
+		v, err := fr.expr(e.Right)
+		if err != nil {
+			return nil, fmt.Errorf("in node '%v': %v", n.Name, err)
+		}
+		mem[e] = v
+	}
+	for e, v := range mem {
+		inst.mem[e] = v
+	}
+	inst.first = false
+	inst.vals = fr.vals
+
+	return out, nil
+}
+
+func (fr *frame) variable(name string) (interface{}, error) {
+	if v, ok := fr.vals[name]; ok {
+		return v, nil
+	}
+	if fr.pending[name] {
+		return nil, fmt.Errorf("variable '%v' depends on itself", name)
+	}
+
+	eq, ok := fr.inst.eqs[name]
+	if !ok {
+		return nil, fmt.Errorf("variable '%v' is never assigned", name)
+	}
+
+	for _, dst := range eq.assign.Dst {
+		fr.pending[dst] = true
+	}
+	v, err := fr.expr(eq.assign.Body)
+	if err != nil {
+		return nil, err
+	}
+	for _, dst := range eq.assign.Dst {
+		delete(fr.pending, dst)
+	}
+
+	if len(eq.assign.Dst) == 1 {
+		fr.vals[name] = v
+		return v, nil
+	}
+
+	tuple, ok := v.([]interface{})
+	if !ok || len(tuple) != len(eq.assign.Dst) {
+		return nil, fmt.Errorf("cannot assign %v to %v variables", valueString(v), len(eq.assign.Dst))
+	}
+	for i, dst := range eq.assign.Dst {
+		fr.vals[dst] = tuple[i]
+	}
+	return tuple[eq.index], nil
+}
+
+func (fr *frame) expr(e Expr) (interface{}, error) {
+	switch e := e.(type) {
+	case *ExprCall:
+		args := make([]interface{}, len(e.Args))
+		for i, arg := range e.Args {
+			var err error
+			if args[i], err = fr.expr(arg); err != nil {
+				return nil, err
+			}
+		}
+		return fr.call(e, args)
+	case ExprConst:
+		return e.Value, nil
+	case ExprVar:
+		return fr.variable(e.Name)
+	case ExprTuple:
+		values := make([]interface{}, len(e))
+		for i, ee := range e {
+			var err error
+			if values[i], err = fr.expr(ee); err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	case *ExprBinOp:
+		left, err := fr.expr(e.Left)
+		if err != nil {
+			return nil, err
+		}
+
+		if e.Op == BinOpFby {
+			fr.fbys = append(fr.fbys, e)
+			if fr.inst.first {
+				return left, nil
+			}
+			return fr.inst.mem[e], nil
+		}
+
+		right, err := fr.expr(e.Right)
+		if err != nil {
+			return nil, err
+		}
+
+		return evalBinOp(e.Op, left, right)
+	case *ExprUnOp:
+		v, err := fr.expr(e.Expr)
+		if err != nil {
+			return nil, err
+		}
+
+		return evalUnOp(e.Op, v)
+	case *ExprIf:
+		cond, err := fr.expr(e.Cond)
+		if err != nil {
+			return nil, err
+		}
+
+		body, err := fr.expr(e.Body)
+		if err != nil {
+			return nil, err
+		}
+
+		els, err := fr.expr(e.Else)
+		if err != nil {
+			return nil, err
+		}
+
+		c, ok := cond.(bool)
+		if !ok {
+			return nil, fmt.Errorf("condition %v is not a boolean", valueString(cond))
+		}
+		if c {
+			return body, nil
+		}
+		return els, nil
+	default:
+		panic(fmt.Sprintf("unknown expression %T", e))
+	}
+}
+
+func (fr *frame) call(e *ExprCall, args []interface{}) (interface{}, error) {
+	inst, ok := fr.inst.calls[e]
+	if !ok {
+		index, ok := fr.inst.it.lookup(e.Name)
+		if !ok {
+			return fr.builtin(e.Name, args)
+		}
+
+		if n := &fr.inst.it.file.Nodes[index]; n.Extern {
+			f, ok := fr.inst.it.Externs[n.Name]
+			if !ok {
+				return nil, fmt.Errorf("extern node '%v' isn't implemented", n.Name)
+			}
+			return f(args)
+		}
+
+		inst = fr.inst.it.newInstance(index)
+		fr.inst.calls[e] = inst
+	}
+
+	out, err := inst.step(args)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(out) == 1 {
+		return out[0], nil
+	}
+	return out, nil
+}
+
+func (fr *frame) builtin(name string, args []interface{}) (interface{}, error) {
+	switch name {
+	case "print":
+		if len(args) != 1 {
+			return nil, fmt.Errorf("print expects 1 argument, got %v", len(args))
+		}
+		s, ok := args[0].(string)
+		if !ok {
+			return nil, fmt.Errorf("cannot print %v", valueString(args[0]))
+		}
+		_, err := io.WriteString(fr.inst.it.stdout(), s)
+		return nil, err
+	default:
+		return nil, fmt.Errorf("undefined node '%v'", name)
+	}
+}
+
+func evalBinOp(op BinOp, left, right interface{}) (interface{}, error) {
+	switch l := left.(type) {
+	case int:
+		if r, ok := right.(int); ok {
+			return evalIntBinOp(op, l, r)
+		}
+	case float32:
+		if r, ok := right.(float32); ok {
+			return evalFloatBinOp(op, l, r)
+		}
+	case bool:
+		if r, ok := right.(bool); ok {
+			return evalBoolBinOp(op, l, r)
+		}
+	}
+	return nil, fmt.Errorf("invalid operands %v and %v for operator %v", valueString(left), valueString(right), op)
+}
+
+func evalIntBinOp(op BinOp, l, r int) (interface{}, error) {
+	// Integers are 32-bit wide, wrap around like the compiled code does
+	switch op {
+	case BinOpMinus:
+		return int(int32(l - r)), nil
+	case BinOpPlus:
+		return int(int32(l + r)), nil
+	case BinOpMul:
+		return int(int32(l * r)), nil
+	case BinOpDiv:
+		if r == 0 {
+			return nil, fmt.Errorf("integer division by zero")
+		}
+		return int(int32(l / r)), nil
+	case BinOpGt:
+		return l > r, nil
+	case BinOpLt:
+		return l < r, nil
+	case BinOpGe:
+		return l >= r, nil
+	case BinOpLe:
+		return l <= r, nil
+	case BinOpEq:
+		return l == r, nil
+	case BinOpNe:
+		return l != r, nil
+	}
+	return nil, fmt.Errorf("invalid integer operands for operator %v", op)
+}
+
+func evalFloatBinOp(op BinOp, l, r float32) (interface{}, error) {
+	switch op {
+	case BinOpFMinus:
+		return l - r, nil
+	case BinOpFPlus:
+		return l + r, nil
+	case BinOpFMul:
+		return l * r, nil
+	case BinOpFDiv:
+		return l / r, nil
+	case BinOpGt:
+		return l > r, nil
+	case BinOpLt:
+		return l < r, nil
+	case BinOpGe:
+		return l >= r, nil
+	case BinOpLe:
+		return l <= r, nil
+	case BinOpEq:
+		return l == r, nil
+	case BinOpNe:
+		return l != r, nil
+	}
+	return nil, fmt.Errorf("invalid float operands for operator %v", op)
+}
+
+func evalBoolBinOp(op BinOp, l, r bool) (interface{}, error) {
+	switch op {
+	case BinOpAnd:
+		return l && r, nil
+	case BinOpOr:
+		return l || r, nil
+	case BinOpEq:
+		return l == r, nil
+	case BinOpNe:
+		return l != r, nil
+	}
+	return nil, fmt.Errorf("invalid boolean operands for operator %v", op)
+}
+
+func evalUnOp(op UnOp, v interface{}) (interface{}, error) {
+	switch op {
+	case UnOpNot:
+		if b, ok := v.(bool); ok {
+			return !b, nil
+		}
+	case UnOpMinus:
+		if i, ok := v.(int); ok {
+			return int(int32(-i)), nil
+		}
+	case UnOpFMinus:
+		if f, ok := v.(float32); ok {
+			return -f, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid operand %v for operator %v", valueString(v), op)
+}
+
+func checkValue(v interface{}, t Type) error {
+	var ok bool
+	switch t {
+	case TypeUnit:
+		ok = v == nil
+	case TypeBool:
+		_, ok = v.(bool)
+	case TypeInt:
+		_, ok = v.(int)
+	case TypeFloat:
+		_, ok = v.(float32)
+	case TypeString:
+		_, ok = v.(string)
+	}
+	if !ok {
+		return fmt.Errorf("expected %v, got %v", t, valueString(v))
+	}
+	return nil
+}
+
+func valueString(v interface{}) string {
+	if v == nil {
+		return "()"
+	}
+	return fmt.Sprintf("%#v", v)
+}
@@ -0,0 +1,466 @@
+package minilustre
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// jsonVersion is the version of the JSON representation of the AST. It is
+// bumped on incompatible changes.
+const jsonVersion = 1
+
+type jsonPos struct {
+	File   string `json:"file,omitempty"`
+	Offset int    `json:"offset"`
+	Line   int    `json:"line"`
+	Column int    `json:"column"`
+}
+
+type jsonFile struct {
+	Version  int           `json:"version"`
+	Includes []jsonInclude `json:"includes,omitempty"`
+	Packages []jsonPackage `json:"packages,omitempty"`
+	Nodes    []jsonNode    `json:"nodes"`
+	Comments []jsonComment `json:"comments,omitempty"`
+}
+
+type jsonInclude struct {
+	Pos  *jsonPos `json:"pos,omitempty"`
+	Path string   `json:"path"`
+}
+
+type jsonPackage struct {
+	Pos   *jsonPos   `json:"pos,omitempty"`
+	Name  string     `json:"name"`
+	Uses  []string   `json:"uses,omitempty"`
+	Nodes []jsonNode `json:"nodes"`
+	Body  *jsonPos   `json:"body,omitempty"`
+	End   *jsonPos   `json:"end,omitempty"`
+}
+
+type jsonComment struct {
+	Pos       *jsonPos `json:"pos,omitempty"`
+	Text      string   `json:"text"`
+	EndOfLine bool     `json:"endOfLine,omitempty"`
+}
+
+type jsonNode struct {
+	Pos       *jsonPos       `json:"pos,omitempty"`
+	Name      string         `json:"name"`
+	Inline    bool           `json:"inline,omitempty"`
+	Unsafe    bool           `json:"unsafe,omitempty"`
+	Extern    bool           `json:"extern,omitempty"`
+	Inputs    []jsonParam    `json:"inputs"`
+	Outputs   []jsonParam    `json:"outputs"`
+	Locals    []jsonParam    `json:"locals"`
+	Equations []jsonEquation `json:"equations"`
+	Let       *jsonPos       `json:"let,omitempty"`
+	Tel       *jsonPos       `json:"tel,omitempty"`
+}
+
+type jsonParam struct {
+	Pos  *jsonPos `json:"pos,omitempty"`
+	Name string   `json:"name"`
+	Type string   `json:"type"`
+}
+
+type jsonEquation struct {
+	Pos *jsonPos  `json:"pos,omitempty"`
+	Lhs []string  `json:"lhs"`
+	Rhs *jsonExpr `json:"rhs"`
+}
+
+type jsonExpr struct {
+	Kind string   `json:"kind"`
+	Pos  *jsonPos `json:"pos,omitempty"`
+
+	// call, var
+	Name string      `json:"name,omitempty"`
+	Args []*jsonExpr `json:"args,omitempty"`
+	// const
+	Type  string          `json:"type,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+	// tuple
+	Elems []*jsonExpr `json:"elems,omitempty"`
+	// binop, unop
+	Op    string    `json:"op,omitempty"`
+	Left  *jsonExpr `json:"left,omitempty"`
+	Right *jsonExpr `json:"right,omitempty"`
+	Expr  *jsonExpr `json:"expr,omitempty"`
+	// if
+	Cond *jsonExpr `json:"cond,omitempty"`
+	Then *jsonExpr `json:"then,omitempty"`
+	Else *jsonExpr `json:"else,omitempty"`
+}
+
+func encodePos(pos Pos) *jsonPos {
+	if !pos.IsValid() {
+		return nil
+	}
+	return &jsonPos{pos.Filename, pos.Offset, pos.Line, pos.Column}
+}
+
+func decodePos(pos *jsonPos) Pos {
+	if pos == nil {
+		return Pos{}
+	}
+	return Pos{Filename: pos.File, Offset: pos.Offset, Line: pos.Line, Column: pos.Column}
+}
+
+func encodeParams(params []Param) []jsonParam {
+	l := make([]jsonParam, len(params))
+	for i, param := range params {
+		l[i] = jsonParam{encodePos(param.Pos), param.Name, param.Type.String()}
+	}
+	return l
+}
+
+func encodeExprList(l []Expr) ([]*jsonExpr, error) {
+	var out []*jsonExpr
+	for _, e := range l {
+		je, err := encodeExpr(e)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, je)
+	}
+	return out, nil
+}
+
+func encodeExpr(e Expr) (*jsonExpr, error) {
+	var err error
+	switch e := e.(type) {
+	case *ExprCall:
+		je := &jsonExpr{Kind: "call", Pos: encodePos(e.NamePos), Name: e.Name}
+		je.Args, err = encodeExprList(e.Args)
+		return je, err
+	case ExprConst:
+		je := &jsonExpr{Kind: "const", Pos: encodePos(e.ValuePos), Type: e.Type().String()}
+		switch v := e.Value.(type) {
+		case nil:
+			// No value
+		case int:
+			je.Value = json.RawMessage(strconv.Itoa(v))
+		case float32:
+			je.Value = json.RawMessage(strconv.FormatFloat(float64(v), 'g', -1, 32))
+		default:
+			je.Value, err = json.Marshal(v)
+		}
+		return je, err
+	case ExprTuple:
+		je := &jsonExpr{Kind: "tuple"}
+		je.Elems, err = encodeExprList(e)
+		return je, err
+	case *ExprBinOp:
+		je := &jsonExpr{Kind: "binop", Pos: encodePos(e.OpPos), Op: e.Op.String()}
+		if je.Left, err = encodeExpr(e.Left); err != nil {
+			return nil, err
+		}
+		je.Right, err = encodeExpr(e.Right)
+		return je, err
+	case *ExprUnOp:
+		je := &jsonExpr{Kind: "unop", Pos: encodePos(e.OpPos), Op: e.Op.String()}
+		je.Expr, err = encodeExpr(e.Expr)
+		return je, err
+	case ExprVar:
+		return &jsonExpr{Kind: "var", Pos: encodePos(e.NamePos), Name: e.Name}, nil
+	case *ExprIf:
+		je := &jsonExpr{Kind: "if", Pos: encodePos(e.If)}
+		if je.Cond, err = encodeExpr(e.Cond); err != nil {
+			return nil, err
+		}
+		if je.Then, err = encodeExpr(e.Body); err != nil {
+			return nil, err
+		}
+		je.Else, err = encodeExpr(e.Else)
+		return je, err
+	default:
+		return nil, fmt.Errorf("minilustre: unknown expression type %T", e)
+	}
+}
+
+func encodeNodes(nodes []Node) ([]jsonNode, error) {
+	l := make([]jsonNode, len(nodes))
+	for i, n := range nodes {
+		jn := jsonNode{
+			Pos:       encodePos(n.Pos),
+			Name:      n.Name,
+			Inline:    n.Inline,
+			Unsafe:    n.Unsafe,
+			Extern:    n.Extern,
+			Inputs:    encodeParams(n.InParams),
+			Outputs:   encodeParams(n.OutParams),
+			Locals:    encodeParams(n.LocalParams),
+			Equations: make([]jsonEquation, len(n.Body)),
+			Let:       encodePos(n.Let),
+			Tel:       encodePos(n.Tel),
+		}
+		for j, a := range n.Body {
+			rhs, err := encodeExpr(a.Body)
+			if err != nil {
+				return nil, err
+			}
+			jn.Equations[j] = jsonEquation{encodePos(a.Pos), a.Dst, rhs}
+		}
+		l[i] = jn
+	}
+	return l, nil
+}
+
+// MarshalJSON encodes the file in the JSON format documented in docs/json.md.
+func (f *File) MarshalJSON() ([]byte, error) {
+	jf := jsonFile{Version: jsonVersion}
+	var err error
+	if jf.Nodes, err = encodeNodes(f.Nodes); err != nil {
+		return nil, err
+	}
+	for _, inc := range f.Includes {
+		jf.Includes = append(jf.Includes, jsonInclude{encodePos(inc.Pos), inc.Path})
+	}
+	for _, pkg := range f.Packages {
+		jp := jsonPackage{
+			Pos:  encodePos(pkg.Pos),
+			Name: pkg.Name,
+			Uses: pkg.Uses,
+			Body: encodePos(pkg.Body),
+			End:  encodePos(pkg.End),
+		}
+		if jp.Nodes, err = encodeNodes(pkg.Nodes); err != nil {
+			return nil, err
+		}
+		jf.Packages = append(jf.Packages, jp)
+	}
+	for _, c := range f.Comments {
+		jf.Comments = append(jf.Comments, jsonComment{encodePos(c.Pos), c.Text, c.EndOfLine})
+	}
+
+	// Operators such as "<" would be escaped otherwise
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(&jf); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(b.Bytes(), []byte("\n")), nil
+}
+
+func decodeType(s string) (Type, error) {
+	for t := TypeUnit; t <= TypeString; t++ {
+		if t.String() == s {
+			return t, nil
+		}
+	}
+	return 0, fmt.Errorf("minilustre: unknown type %q", s)
+}
+
+func decodeParams(l []jsonParam) ([]Param, error) {
+	var params []Param
+	for _, jp := range l {
+		t, err := decodeType(jp.Type)
+		if err != nil {
+			return nil, err
+		}
+		params = append(params, Param{Name: jp.Name, Type: t, Pos: decodePos(jp.Pos)})
+	}
+	return params, nil
+}
+
+func decodeExprList(l []*jsonExpr) ([]Expr, error) {
+	var out []Expr
+	for _, je := range l {
+		e, err := decodeExpr(je)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, e)
+	}
+	return out, nil
+}
+
+func decodeConst(je *jsonExpr) (interface{}, error) {
+	t, err := decodeType(je.Type)
+	if err != nil {
+		return nil, err
+	}
+	if t == TypeUnit {
+		return nil, nil
+	}
+	if je.Value == nil {
+		return nil, fmt.Errorf("minilustre: missing value for %v constant", t)
+	}
+
+	switch t {
+	case TypeBool:
+		var v bool
+		err = json.Unmarshal(je.Value, &v)
+		return v, err
+	case TypeInt:
+		v, err := strconv.ParseInt(string(je.Value), 10, 32)
+		return int(v), err
+	case TypeFloat:
+		v, err := strconv.ParseFloat(string(je.Value), 32)
+		return float32(v), err
+	default:
+		var v string
+		err = json.Unmarshal(je.Value, &v)
+		return v, err
+	}
+}
+
+func decodeExpr(je *jsonExpr) (Expr, error) {
+	if je == nil {
+		return nil, fmt.Errorf("minilustre: missing expression")
+	}
+
+	pos := decodePos(je.Pos)
+	switch je.Kind {
+	case "call":
+		args, err := decodeExprList(je.Args)
+		if err != nil {
+			return nil, err
+		}
+		return &ExprCall{Name: je.Name, NamePos: pos, Args: args}, nil
+	case "const":
+		v, err := decodeConst(je)
+		if err != nil {
+			return nil, err
+		}
+		return ExprConst{v, pos}, nil
+	case "tuple":
+		l, err := decodeExprList(je.Elems)
+		if err != nil {
+			return nil, err
+		}
+		return ExprTuple(l), nil
+	case "binop":
+		op := BinOpMinus
+		for ; op <= BinOpOr; op++ {
+			if op.String() == je.Op {
+				break
+			}
+		}
+		if op > BinOpOr {
+			return nil, fmt.Errorf("minilustre: unknown binary operator %q", je.Op)
+		}
+		left, err := decodeExpr(je.Left)
+		if err != nil {
+			return nil, err
+		}
+		right, err := decodeExpr(je.Right)
+		if err != nil {
+			return nil, err
+		}
+		return &ExprBinOp{op, pos, left, right}, nil
+	case "unop":
+		op := UnOpNot
+		for ; op <= UnOpFMinus; op++ {
+			if op.String() == je.Op {
+				break
+			}
+		}
+		if op > UnOpFMinus {
+			return nil, fmt.Errorf("minilustre: unknown unary operator %q", je.Op)
+		}
+		e, err := decodeExpr(je.Expr)
+		if err != nil {
+			return nil, err
+		}
+		return &ExprUnOp{op, pos, e}, nil
+	case "var":
+		return ExprVar{je.Name, pos}, nil
+	case "if":
+		cond, err := decodeExpr(je.Cond)
+		if err != nil {
+			return nil, err
+		}
+		body, err := decodeExpr(je.Then)
+		if err != nil {
+			return nil, err
+		}
+		els, err := decodeExpr(je.Else)
+		if err != nil {
+			return nil, err
+		}
+		return &ExprIf{pos, cond, body, els}, nil
+	default:
+		return nil, fmt.Errorf("minilustre: unknown expression kind %q", je.Kind)
+	}
+}
+
+func decodeNodes(l []jsonNode) ([]Node, error) {
+	var nodes []Node
+	for _, jn := range l {
+		n := Node{
+			Pos:    decodePos(jn.Pos),
+			Name:   jn.Name,
+			Inline: jn.Inline,
+			Unsafe: jn.Unsafe,
+			Extern: jn.Extern,
+			Let:    decodePos(jn.Let),
+			Tel:    decodePos(jn.Tel),
+		}
+
+		var err error
+		if n.InParams, err = decodeParams(jn.Inputs); err != nil {
+			return nil, err
+		}
+		if n.OutParams, err = decodeParams(jn.Outputs); err != nil {
+			return nil, err
+		}
+		if n.LocalParams, err = decodeParams(jn.Locals); err != nil {
+			return nil, err
+		}
+
+		for _, eq := range jn.Equations {
+			body, err := decodeExpr(eq.Rhs)
+			if err != nil {
+				return nil, err
+			}
+			n.Body = append(n.Body, Assign{Pos: decodePos(eq.Pos), Dst: eq.Lhs, Body: body})
+		}
+
+		nodes = append(nodes, n)
+	}
+	return nodes, nil
+}
+
+// UnmarshalJSON decodes a file encoded by MarshalJSON.
+func (f *File) UnmarshalJSON(b []byte) error {
+	var jf jsonFile
+	if err := json.Unmarshal(b, &jf); err != nil {
+		return err
+	}
+	if jf.Version != jsonVersion {
+		return fmt.Errorf("minilustre: unsupported JSON AST version %v", jf.Version)
+	}
+
+	*f = File{}
+	var err error
+	if f.Nodes, err = decodeNodes(jf.Nodes); err != nil {
+		return err
+	}
+	for _, ji := range jf.Includes {
+		f.Includes = append(f.Includes, Include{decodePos(ji.Pos), ji.Path})
+	}
+	for _, jp := range jf.Packages {
+		pkg := Package{
+			Pos:  decodePos(jp.Pos),
+			Name: jp.Name,
+			Uses: jp.Uses,
+			Body: decodePos(jp.Body),
+			End:  decodePos(jp.End),
+		}
+		if pkg.Nodes, err = decodeNodes(jp.Nodes); err != nil {
+			return err
+		}
+		f.Packages = append(f.Packages, pkg)
+	}
+
+	for _, jc := range jf.Comments {
+		f.Comments = append(f.Comments, Comment{decodePos(jc.Pos), jc.Text, jc.EndOfLine})
+	}
+
+	return nil
+}
@@ -0,0 +1,45 @@
+package minilustre
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestJSONRoundTrip(t *testing.T) {
+	filenames, err := filepath.Glob("testdata/*.mls")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, filename := range filenames {
+		filename := filename
+		t.Run(filepath.Base(filename), func(t *testing.T) {
+			r, err := os.Open(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+
+			f, err := ParseFile(filename, r)
+			if err != nil {
+				t.Fatalf("Parse() = %v", err)
+			}
+
+			b, err := json.Marshal(f)
+			if err != nil {
+				t.Fatalf("json.Marshal() = %v", err)
+			}
+
+			var f2 File
+			if err := json.Unmarshal(b, &f2); err != nil {
+				t.Fatalf("json.Unmarshal() = %v", err)
+			}
+			if !reflect.DeepEqual(f, &f2) {
+				t.Errorf("decoded file differs from the original file:\n%s", b)
+			}
+		})
+	}
+}
@@ -6,259 +6,499 @@ import (
 	"io"
 	"strings"
 	"unicode"
+	"unicode/utf8"
 )
 
-type itemType int
+// Pos is a position in a source file.
+type Pos struct {
+	// Name of the source file, empty if unknown.
+	Filename string
+	// Offset in bytes, starting at 0.
+	Offset int
+	// Line number, starting at 1.
+	Line int
+	// Column number in bytes, starting at 1.
+	Column int
+}
+
+// IsValid returns true if the position is known.
+func (p Pos) IsValid() bool {
+	return p.Line > 0
+}
+
+func (p Pos) String() string {
+	if !p.IsValid() {
+		return "-"
+	}
+	if p.Filename != "" {
+		return fmt.Sprintf("%v:%v:%v", p.Filename, p.Line, p.Column)
+	}
+	return fmt.Sprintf("%v:%v", p.Line, p.Column)
+}
+
+// TokenKind is the kind of a lexical token.
+type TokenKind int
 
 const (
-	itemEOF itemType = iota
-	itemKeyword
-	itemIdent
-	itemNumber
-	itemString
-	itemOp
-	itemLparen
-	itemRparen
-	itemColon
-	itemSemi
-	itemComma
-	itemEq
+	TokenEOF TokenKind = iota
+	TokenKeyword
+	TokenIdent
+	TokenInt
+	TokenFloat
+	TokenString
+	TokenOp
+	TokenLparen
+	TokenRparen
+	TokenColon
+	TokenSemi
+	TokenComma
+	TokenEq
+	TokenComment
 )
 
-func (t itemType) String() string {
-	switch t {
-	case itemEOF:
+func (k TokenKind) String() string {
+	switch k {
+	case TokenEOF:
 		return "EOF"
-	case itemKeyword:
+	case TokenKeyword:
 		return "Keyword"
-	case itemIdent:
+	case TokenIdent:
 		return "Ident"
-	case itemNumber:
-		return "Number"
-	case itemString:
+	case TokenInt:
+		return "Int"
+	case TokenFloat:
+		return "Float"
+	case TokenString:
 		return "String"
-	case itemOp:
+	case TokenOp:
 		return "Op"
-	case itemLparen:
+	case TokenLparen:
 		return "Lparen"
-	case itemRparen:
+	case TokenRparen:
 		return "Rparen"
-	case itemColon:
+	case TokenColon:
 		return "Colon"
-	case itemSemi:
+	case TokenSemi:
 		return "Semi"
-	case itemComma:
+	case TokenComma:
 		return "Comma"
-	case itemEq:
+	case TokenEq:
 		return "Eq"
+	case TokenComment:
+		return "Comment"
 	}
-	panic(fmt.Sprintf("unknown lexer item %d", int(t)))
+	panic(fmt.Sprintf("unknown token kind %d", int(k)))
 }
 
 const (
 	keywordAnd     = "and"
+	keywordBody    = "body"
 	keywordBool    = "bool"
 	keywordConst   = "const"
 	keywordElse    = "else"
 	keywordEnd     = "end"
+	keywordExtern  = "extern"
 	keywordFalse   = "false"
 	keywordFby     = "fby"
 	keywordFloat   = "float"
 	keywordIf      = "if"
+	keywordInclude = "include"
+	keywordInline  = "inline"
 	keywordInt     = "int"
 	keywordLet     = "let"
 	keywordNode    = "node"
 	keywordNot     = "not"
 	keywordOr      = "or"
+	keywordPackage = "package"
 	keywordReturns = "returns"
 	keywordString  = "string"
 	keywordTel     = "tel"
 	keywordThen    = "then"
 	keywordTrue    = "true"
 	keywordUnit    = "unit"
+	keywordUnsafe  = "unsafe"
+	keywordUses    = "uses"
 	keywordVar     = "var"
 )
 
-type item struct {
-	typ   itemType
-	value string
+func isKeyword(s string) bool {
+	switch s {
+	case keywordIf, keywordInline, keywordLet, keywordAnd, keywordBool, keywordFloat, keywordConst, keywordElse, keywordEnd, keywordExtern, keywordFalse, keywordInt, keywordNode, keywordNot, keywordOr, keywordReturns, keywordString, keywordTel, keywordThen, keywordTrue, keywordUnit, keywordUnsafe, keywordVar, keywordFby, keywordInclude, keywordPackage, keywordUses, keywordBody:
+		return true
+	}
+	return false
 }
 
-func (it *item) String() string {
-	return fmt.Sprintf("%v '%v'", it.typ, it.value)
+// Token is a lexical token.
+type Token struct {
+	Kind TokenKind
+	// Value is the source text of the token. It is empty for TokenEOF.
+	Value string
+	// Pos is the position of the first character of the token.
+	Pos Pos
 }
 
-type lexer struct {
-	in  *bufio.Reader
-	out chan<- item
-	// Current position in the input stream.
-	pos int64
-	// Size of last rune read, used to unread rune.
-	lastRuneSize int
+func (tok *Token) String() string {
+	return fmt.Sprintf("%v '%v'", tok.Kind, tok.Value)
 }
 
-func (l *lexer) readRune() (r rune, size int, err error) {
-	r, size, err = l.in.ReadRune()
-	l.pos += int64(size)
-	l.lastRuneSize = size
-	return r, size, err
+// Scanner splits a source file into tokens.
+type Scanner struct {
+	in *bufio.Reader
+	// Position of the next rune.
+	pos Pos
 }
 
-func (l *lexer) unreadRune() error {
-	err := l.in.UnreadRune()
-	if l.lastRuneSize > 0 {
-		l.pos -= int64(l.lastRuneSize)
+// NewScanner creates a new scanner reading from r.
+func NewScanner(r io.Reader) *Scanner {
+	return &Scanner{
+		in:  bufio.NewReader(r),
+		pos: Pos{Line: 1, Column: 1},
 	}
-	l.lastRuneSize = -1
-	return err
 }
 
-func (l *lexer) readString(delim byte) (string, error) {
-	s, err := l.in.ReadString(delim)
-	l.lastRuneSize = -1
-	return s, err
+func (s *Scanner) readRune() (rune, error) {
+	r, size, err := s.in.ReadRune()
+	if err != nil {
+		return 0, err
+	}
+
+	pos := s.pos
+	s.pos.Offset += size
+	if r == '\n' {
+		s.pos.Line++
+		s.pos.Column = 1
+	} else {
+		s.pos.Column += size
+	}
+
+	if r == utf8.RuneError && size == 1 {
+		return 0, errorf(pos, "invalid UTF-8 encoding")
+	}
+	return r, nil
 }
 
-func (l *lexer) string(accept func(rune) bool) (string, error) {
-	var b strings.Builder
+// peekRune returns the next rune without consuming it. It returns -1 on EOF.
+func (s *Scanner) peekRune() (rune, error) {
+	r, _, err := s.in.ReadRune()
+	if err == io.EOF {
+		return -1, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return r, s.in.UnreadRune()
+}
+
+// acceptRune consumes the next rune and appends it to b if accept returns
+// true for it.
+func (s *Scanner) acceptRune(b *strings.Builder, accept func(rune) bool) (bool, error) {
+	r, err := s.peekRune()
+	if err != nil || r < 0 || !accept(r) {
+		return false, err
+	}
+	if _, err := s.readRune(); err != nil {
+		return false, err
+	}
+	b.WriteRune(r)
+	return true, nil
+}
+
+func (s *Scanner) acceptRunes(b *strings.Builder, accept func(rune) bool) error {
 	for {
-		r, _, err := l.readRune()
-		if err == io.EOF {
-			break
-		} else if err != nil {
-			return "", err
+		if ok, err := s.acceptRune(b, accept); err != nil {
+			return err
+		} else if !ok {
+			return nil
 		}
+	}
+}
 
-		if !accept(r) {
-			l.unreadRune()
-			break
-		}
+func isSpace(r rune) bool {
+	return r == ' ' || r == '\t' || r == '\n' || r == '\r'
+}
 
-		b.WriteRune(r)
-	}
+func isDigit(r rune) bool {
+	return r >= '0' && r <= '9'
+}
 
-	return b.String(), nil
+func isIdent(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
 }
 
-func (l *lexer) number() error {
-	// TODO: float
-	s, err := l.string(unicode.IsDigit)
-	if err != nil {
-		return err
+func isRune(want rune) func(rune) bool {
+	return func(r rune) bool {
+		return r == want
 	}
-
-	l.out <- item{itemNumber, s}
-	return nil
 }
 
-func (l *lexer) quoted() error {
-	r, _, err := l.readRune()
-	if err != nil {
-		return err
-	} else if r != '"' {
-		return fmt.Errorf("minilustre: expected lquote at offset %v", l.pos)
+func (s *Scanner) number(b *strings.Builder, pos Pos) (TokenKind, error) {
+	if err := s.acceptRunes(b, isDigit); err != nil {
+		return 0, err
 	}
 
-	// TODO: escape support
-	s, err := l.readString('"')
-	if err != nil {
-		return err
+	kind := TokenInt
+	if ok, err := s.acceptRune(b, isRune('.')); err != nil {
+		return 0, err
+	} else if ok {
+		kind = TokenFloat
+		if err := s.acceptRunes(b, isDigit); err != nil {
+			return 0, err
+		}
 	}
 
-	l.out <- item{itemString, s[:len(s)-1]}
-	return nil
-}
+	if ok, err := s.acceptRune(b, func(r rune) bool { return r == 'e' || r == 'E' }); err != nil {
+		return 0, err
+	} else if ok {
+		kind = TokenFloat
+		if _, err := s.acceptRune(b, func(r rune) bool { return r == '+' || r == '-' }); err != nil {
+			return 0, err
+		}
+		if ok, err := s.acceptRune(b, isDigit); err != nil {
+			return 0, err
+		} else if !ok {
+			return 0, errorf(pos, "malformed number '%v'", b.String())
+		}
+		if err := s.acceptRunes(b, isDigit); err != nil {
+			return 0, err
+		}
+	}
 
-func isIdent(r rune) bool {
-	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+	if ok, err := s.acceptRune(b, isIdent); err != nil {
+		return 0, err
+	} else if ok {
+		return 0, errorf(pos, "malformed number '%v'", b.String())
+	}
+
+	return kind, nil
 }
 
-func (l *lexer) keywordOrIdent() error {
-	s, err := l.string(isIdent)
-	if err != nil {
-		return err
+func (s *Scanner) quoted(b *strings.Builder, pos Pos) error {
+	for {
+		r, err := s.readRune()
+		if err == io.EOF {
+			return errorf(pos, "unterminated string")
+		} else if err != nil {
+			return err
+		}
+		b.WriteRune(r)
+
+		switch r {
+		case '"':
+			return nil
+		case '\\':
+			escPos := s.pos
+			r, err := s.readRune()
+			if err == io.EOF {
+				return errorf(pos, "unterminated string")
+			} else if err != nil {
+				return err
+			}
+			b.WriteRune(r)
+
+			if _, ok := unescapeRune(r); !ok {
+				return errorf(escPos, "unknown escape sequence '\\%c'", r)
+			}
+		}
 	}
+}
 
-	var t itemType
-	switch s {
-	case keywordIf, keywordLet, keywordAnd, keywordBool, keywordFloat, keywordConst, keywordElse, keywordEnd, keywordFalse, keywordInt, keywordNode, keywordNot, keywordOr, keywordReturns, keywordString, keywordTel, keywordThen, keywordTrue, keywordUnit, keywordVar, keywordFby:
-		t = itemKeyword
-	default:
-		t = itemIdent
+// lineComment reads a comment which ends at the end of the line. The newline
+// isn't part of the comment.
+func (s *Scanner) lineComment(b *strings.Builder) error {
+	return s.acceptRunes(b, func(r rune) bool {
+		return r != '\n'
+	})
+}
+
+// blockComment reads a comment delimited by "(*" and "*)".
+func (s *Scanner) blockComment(b *strings.Builder, pos Pos) error {
+	var star bool
+	for {
+		r, err := s.readRune()
+		if err == io.EOF {
+			return errorf(pos, "unterminated comment")
+		} else if err != nil {
+			return err
+		}
+		b.WriteRune(r)
+
+		if star && r == ')' {
+			return nil
+		}
+		star = r == '*'
 	}
+}
 
-	l.out <- item{t, s}
-	return nil
+// qualified reads the second part of a qualified name such as "p::f", if
+// any. The package name has already been read.
+func (s *Scanner) qualified(b *strings.Builder) error {
+	next, err := s.in.Peek(3)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return err
+	}
+	if len(next) < 3 || string(next[:2]) != "::" || !isIdent(rune(next[2])) && next[2] < utf8.RuneSelf {
+		return nil
+	}
+	b.WriteString("::")
+	s.readRune()
+	s.readRune()
+	return s.acceptRunes(b, isIdent)
 }
 
-func (l *lexer) next() (bool, error) {
-	r, _, err := l.readRune()
-	if err == io.EOF {
-		l.out <- item{itemEOF, ""}
-		return false, nil
-	} else if err != nil {
-		return true, err
+// Next returns the next token. Comments are returned as TokenComment tokens.
+// Once the end of the input is reached, TokenEOF is returned.
+func (s *Scanner) Next() (Token, error) {
+	for {
+		r, err := s.peekRune()
+		if err != nil {
+			return Token{}, err
+		} else if r < 0 {
+			return Token{Kind: TokenEOF, Pos: s.pos}, nil
+		} else if !isSpace(r) {
+			break
+		}
+		if _, err := s.readRune(); err != nil {
+			return Token{}, err
+		}
+	}
+
+	pos := s.pos
+	r, err := s.readRune()
+	if err != nil {
+		return Token{}, err
 	}
 
+	var b strings.Builder
+	b.WriteRune(r)
+
+	var kind TokenKind
 	switch r {
 	case '(':
-		l.out <- item{itemLparen, string(r)}
+		kind = TokenLparen
+		var ok bool
+		if ok, err = s.acceptRune(&b, isRune('*')); err == nil && ok {
+			kind = TokenComment
+			err = s.blockComment(&b, pos)
+		}
 	case ')':
-		l.out <- item{itemRparen, string(r)}
+		kind = TokenRparen
 	case ':':
-		l.out <- item{itemColon, string(r)}
+		kind = TokenColon
 	case ';':
-		l.out <- item{itemSemi, string(r)}
+		kind = TokenSemi
 	case ',':
-		l.out <- item{itemComma, string(r)}
+		kind = TokenComma
 	case '=':
-		l.out <- item{itemEq, string(r)}
+		kind = TokenEq
 	case '"':
-		l.unreadRune()
-		return true, l.quoted()
-	case '+', '-', '<', '>':
-		l.out <- item{itemOp, string(r)}
-	case '\n', '\t', ' ', '\r':
-		// No-op
+		kind = TokenString
+		err = s.quoted(&b, pos)
+	case '-':
+		kind = TokenOp
+		var ok bool
+		if ok, err = s.acceptRune(&b, isRune('-')); err == nil && ok {
+			kind = TokenComment
+			err = s.lineComment(&b)
+		} else if err == nil {
+			_, err = s.acceptRune(&b, isRune('.'))
+		}
+	case '+', '*', '/':
+		kind = TokenOp
+		_, err = s.acceptRune(&b, isRune('.'))
+	case '<':
+		kind = TokenOp
+		_, err = s.acceptRune(&b, func(r rune) bool { return r == '=' || r == '>' })
+	case '>':
+		kind = TokenOp
+		_, err = s.acceptRune(&b, isRune('='))
 	default:
-		if unicode.IsDigit(r) {
-			l.unreadRune()
-			return true, l.number()
+		if isDigit(r) {
+			kind, err = s.number(&b, pos)
 		} else if isIdent(r) {
-			l.unreadRune()
-			return true, l.keywordOrIdent()
+			err = s.acceptRunes(&b, isIdent)
+			kind = TokenIdent
+			if isKeyword(b.String()) {
+				kind = TokenKeyword
+			} else if err == nil {
+				err = s.qualified(&b)
+			}
 		} else {
-			return true, fmt.Errorf("minilustre: unexpected character '%c' at offset %v", r, l.pos)
+			return Token{}, errorf(pos, "unexpected character %q", r)
 		}
 	}
+	if err != nil {
+		return Token{}, err
+	}
 
-	return true, nil
+	return Token{Kind: kind, Value: b.String(), Pos: pos}, nil
 }
 
-func (l *lexer) lex() error {
-	defer close(l.out)
+func unescapeRune(r rune) (rune, bool) {
+	switch r {
+	case 'n':
+		return '\n', true
+	case 't':
+		return '\t', true
+	case 'r':
+		return '\r', true
+	case '\\', '"', '\'':
+		return r, true
+	}
+	return 0, false
+}
 
-	for {
-		if more, err := l.next(); err != nil {
-			return err
-		} else if !more {
-			return nil
+// unquote returns the value of a string literal, as returned by the scanner.
+func unquote(s string) string {
+	var b strings.Builder
+	s = s[1 : len(s)-1]
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+			r, _ := unescapeRune(rune(s[i]))
+			b.WriteRune(r)
+		} else {
+			b.WriteByte(s[i])
 		}
 	}
+	return b.String()
 }
 
+// quote returns a string literal whose value is s.
+func quote(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '\n':
+			b.WriteString(`\n`)
+		case '\t':
+			b.WriteString(`\t`)
+		case '\r':
+			b.WriteString(`\r`)
+		case '\\', '"':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// Lex prints the tokens read from r, one per line.
 func Lex(r io.Reader) error {
-	ch := make(chan item, 2)
-	done := make(chan error, 1)
+	s := NewScanner(r)
+	for {
+		tok, err := s.Next()
+		if err != nil {
+			return err
+		}
 
-	l := lexer{in: bufio.NewReader(r), out: ch}
-	go func() {
-		done <- l.lex()
-	}()
+		fmt.Printf("%v: %v\n", tok.Pos, &tok)
 
-	for it := range ch {
-		fmt.Println(it)
+		if tok.Kind == TokenEOF {
+			return nil
+		}
 	}
-
-	return <-done
 }
@@ -0,0 +1,270 @@
+package minilustre
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Loader loads programs made of several source files.
+type Loader struct {
+	// ReadFile reads a source file. If nil, os.ReadFile is used.
+	ReadFile func(filename string) ([]byte, error)
+}
+
+// Load parses source files along with the files they include, and links them
+// into a single file without includes nor packages. Included paths are
+// relative to the including file. Each file is loaded once, even if it's
+// included several times.
+//
+// The nodes of included files come before the nodes of the including file.
+// The nodes of a package p are renamed to p__name, and calls are resolved to
+// their new names: an unqualified name refers to a node of the current
+// package, then of the used packages, then to a top-level node. Nodes which
+// end up with the same name, such as p::f and a top-level node p__f, are
+// reported.
+//
+// Errors in source files are returned as an ErrorList, along with the
+// partially linked file.
+func (l *Loader) Load(filenames ...string) (*File, error) {
+	ld := loader{
+		Loader:  l,
+		files:   make(map[string]*File),
+		loading: make(map[string]bool),
+	}
+	for _, filename := range filenames {
+		if err := ld.load(filename, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	f := ld.link()
+	return f, ld.errors.Err()
+}
+
+// Load is a shorthand for Loader.Load with the default loader.
+func Load(filenames ...string) (*File, error) {
+	var l Loader
+	return l.Load(filenames...)
+}
+
+type loader struct {
+	*Loader
+	// Loaded files by path
+	files map[string]*File
+	// Files being loaded, used to detect include cycles
+	loading map[string]bool
+	stack   []string
+	// Files in include order: included files come first
+	order  []*File
+	errors ErrorList
+
+	packages map[string]*Package
+	// Node names of each package
+	pkgNodes map[string]map[string]bool
+}
+
+func (ld *loader) readFile(filename string) ([]byte, error) {
+	if ld.ReadFile != nil {
+		return ld.ReadFile(filename)
+	}
+	return os.ReadFile(filename)
+}
+
+// load loads a file and the files it includes. inc is the include directive
+// which refers to the file, if any. I/O errors on files which aren't included
+// are returned, other errors are recorded.
+func (ld *loader) load(filename string, inc *Include) error {
+	filename = filepath.Clean(filename)
+	if ld.loading[filename] {
+		var start int
+		for i, name := range ld.stack {
+			if name == filename {
+				start = i
+			}
+		}
+		chain := append(ld.stack[start:], filename)
+		ld.errors = append(ld.errors, errorf(inc.Pos, "include cycle: %v", strings.Join(chain, " -> ")))
+		return nil
+	}
+	if _, ok := ld.files[filename]; ok {
+		return nil
+	}
+
+	b, err := ld.readFile(filename)
+	if err != nil && inc != nil {
+		ld.errors = append(ld.errors, errorf(inc.Pos, "cannot include %q: %v", inc.Path, err))
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	f, err := ParseFile(filename, bytes.NewReader(b))
+	if l, ok := err.(ErrorList); ok {
+		ld.errors = append(ld.errors, l...)
+	} else if err != nil {
+		return err
+	}
+	ld.files[filename] = f
+
+	ld.loading[filename] = true
+	ld.stack = append(ld.stack, filename)
+	for i := range f.Includes {
+		inc := &f.Includes[i]
+		path := inc.Path
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(filepath.Dir(filename), path)
+		}
+		if err := ld.load(path, inc); err != nil {
+			return err
+		}
+	}
+	ld.stack = ld.stack[:len(ld.stack)-1]
+	delete(ld.loading, filename)
+
+	ld.order = append(ld.order, f)
+	return nil
+}
+
+// link merges the loaded files into a single one.
+func (ld *loader) link() *File {
+	ld.packages = make(map[string]*Package)
+	ld.pkgNodes = make(map[string]map[string]bool)
+	for _, f := range ld.order {
+		for i := range f.Packages {
+			pkg := &f.Packages[i]
+			if prev, ok := ld.packages[pkg.Name]; ok {
+				ld.errors = append(ld.errors, errorf(pkg.Pos, "package '%v' already defined at %v", pkg.Name, prev.Pos))
+				continue
+			}
+			ld.packages[pkg.Name] = pkg
+
+			names := make(map[string]bool)
+			for _, n := range pkg.Nodes {
+				names[n.Name] = true
+			}
+			ld.pkgNodes[pkg.Name] = names
+		}
+	}
+
+	var out File
+	// Qualified names and positions of the linked nodes, by linked name
+	type linkedNode struct {
+		qualified string
+		pos       Pos
+	}
+	linked := make(map[string]linkedNode)
+	add := func(n Node, qualified string) {
+		prev, ok := linked[n.Name]
+		if !ok {
+			linked[n.Name] = linkedNode{qualified, n.Pos}
+			out.Nodes = append(out.Nodes, n)
+			return
+		}
+		if qualified == n.Name && prev.qualified == n.Name {
+			// Reported by Check
+			out.Nodes = append(out.Nodes, n)
+		} else if qualified == prev.qualified {
+			ld.errors = append(ld.errors, errorf(n.Pos, "node '%v' already defined at %v", qualified, prev.pos))
+		} else {
+			ld.errors = append(ld.errors, errorf(n.Pos, "node '%v' conflicts with node '%v' defined at %v, both are linked as '%v'", qualified, prev.qualified, prev.pos, n.Name))
+		}
+	}
+
+	for _, f := range ld.order {
+		for i := range f.Packages {
+			pkg := &f.Packages[i]
+			if ld.packages[pkg.Name] != pkg {
+				continue
+			}
+			for _, name := range pkg.Uses {
+				if _, ok := ld.packages[name]; !ok {
+					ld.errors = append(ld.errors, errorf(pkg.Pos, "package '%v' uses unknown package '%v'", pkg.Name, name))
+				}
+			}
+
+			for _, n := range pkg.Nodes {
+				qualified := pkg.Name + "::" + n.Name
+				n.Name = mangleNode(pkg.Name, n.Name)
+				ld.resolve(&n, pkg)
+				add(n, qualified)
+			}
+		}
+
+		for _, n := range f.Nodes {
+			ld.resolve(&n, nil)
+			add(n, n.Name)
+		}
+		out.Comments = append(out.Comments, f.Comments...)
+	}
+	return &out
+}
+
+// resolve rewrites the names of the nodes called by n, which belongs to pkg
+// (nil for top-level nodes).
+func (ld *loader) resolve(n *Node, pkg *Package) {
+	for _, a := range n.Body {
+		Inspect(a.Body, func(e Expr) bool {
+			if call, ok := e.(*ExprCall); ok {
+				if name, err := ld.resolveCall(call, pkg); err != nil {
+					ld.errors = append(ld.errors, err)
+				} else {
+					call.Name = name
+				}
+			}
+			return true
+		})
+	}
+}
+
+func (ld *loader) resolveCall(call *ExprCall, pkg *Package) (string, *Error) {
+	pkgName, name := splitQualified(call.Name)
+	if pkgName != "" {
+		if _, ok := ld.packages[pkgName]; !ok {
+			return "", errorf(call.NamePos, "unknown package '%v'", pkgName)
+		}
+		if pkg != nil && pkgName != pkg.Name && !usesPackage(pkg, pkgName) {
+			return "", errorf(call.NamePos, "package '%v' doesn't use package '%v'", pkg.Name, pkgName)
+		}
+		if !ld.pkgNodes[pkgName][name] {
+			return "", errorf(call.NamePos, "undefined node '%v'", call.Name)
+		}
+		return mangleNode(pkgName, name), nil
+	}
+
+	if pkg == nil {
+		return name, nil
+	}
+	if ld.pkgNodes[pkg.Name][name] {
+		return mangleNode(pkg.Name, name), nil
+	}
+	var found string
+	for _, used := range pkg.Uses {
+		if !ld.pkgNodes[used][name] {
+			continue
+		}
+		if found != "" && found != used {
+			return "", errorf(call.NamePos, "ambiguous node '%v', defined in packages '%v' and '%v'", name, found, used)
+		}
+		found = used
+	}
+	if found != "" {
+		return mangleNode(found, name), nil
+	}
+	return name, nil
+}
+
+func usesPackage(pkg *Package, name string) bool {
+	for _, used := range pkg.Uses {
+		if used == name {
+			return true
+		}
+	}
+	return false
+}
+
+// mangleNode returns the name of a node of a package once linked.
+func mangleNode(pkg, name string) string {
+	return pkg + "__" + name
+}
@@ -0,0 +1,257 @@
+package minilustre
+
+import (
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// memLoader returns a loader reading files from a map.
+func memLoader(files map[string]string) *Loader {
+	return &Loader{ReadFile: func(filename string) ([]byte, error) {
+		src, ok := files[filepath.ToSlash(filename)]
+		if !ok {
+			return nil, fmt.Errorf("open %v: %w", filename, fs.ErrNotExist)
+		}
+		return []byte(src), nil
+	}}
+}
+
+func fileNodeNames(f *File) []string {
+	var l []string
+	for _, n := range f.Nodes {
+		l = append(l, n.Name)
+	}
+	return l
+}
+
+func TestLoad(t *testing.T) {
+	l := memLoader(map[string]string{
+		"main.mls": `include "lib/math.mls";
+include "lib/util.mls";
+
+node main (x: int) returns (y: int);
+let
+  y = util::twice(math::incr(x));
+tel
+`,
+		"lib/math.mls": `package math
+body
+node incr (x: int) returns (y: int);
+let
+  y = x + 1;
+tel
+end
+`,
+		"lib/util.mls": `include "math.mls";
+
+package util uses math;
+body
+node double (x: int) returns (y: int);
+let
+  y = 2 * x;
+tel
+
+node twice (x: int) returns (y: int);
+let
+  y = double(incr(x));
+tel
+end
+`,
+	})
+
+	f, err := l.Load("main.mls")
+	if err != nil {
+		t.Fatalf("Load() = %v", err)
+	}
+
+	want := []string{"math__incr", "util__double", "util__twice", "main"}
+	if got := fileNodeNames(f); strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("Load() nodes = %v, want %v", got, want)
+	}
+
+	var calls []string
+	for _, n := range f.Nodes {
+		for _, a := range n.Body {
+			Inspect(a.Body, func(e Expr) bool {
+				if call, ok := e.(*ExprCall); ok {
+					calls = append(calls, call.Name)
+				}
+				return true
+			})
+		}
+	}
+	want = []string{"util__double", "math__incr", "util__twice", "math__incr"}
+	if strings.Join(calls, " ") != strings.Join(want, " ") {
+		t.Errorf("Load() calls = %v, want %v", calls, want)
+	}
+
+	it, err := NewInterpreter(f, "main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := it.Step([]interface{}{3})
+	if err != nil {
+		t.Fatal(err)
+	} else if out[0] != 10 {
+		t.Errorf("main(3) = %v, want 10", out[0])
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+		err   string
+	}{
+		{
+			name: "cycle",
+			files: map[string]string{
+				"main.mls": `include "a.mls";`,
+				"a.mls":    `include "sub/b.mls";`,
+				"sub/b.mls": `
+include "../a.mls";`,
+			},
+			err: "sub/b.mls:2:1: include cycle: a.mls -> sub/b.mls -> a.mls",
+		},
+		{
+			name: "missing",
+			files: map[string]string{
+				"main.mls": `include "missing.mls";`,
+			},
+			err: `main.mls:1:1: cannot include "missing.mls"`,
+		},
+		{
+			name: "duplicate package",
+			files: map[string]string{
+				"main.mls": "package p body end\npackage p body end",
+			},
+			err: "main.mls:2:1: package 'p' already defined at main.mls:1:1",
+		},
+		{
+			name: "packages and nodes",
+			files: map[string]string{
+				"main.mls": `package p body end
+
+node f (x: int) returns (y: int);
+let
+  y = x;
+tel
+`,
+			},
+			err: "main.mls:3:1: a file can't contain both packages and top-level nodes",
+		},
+		{
+			name: "unused package",
+			files: map[string]string{
+				"main.mls": `package p body
+node f (x: int) returns (y: int);
+let
+  y = x;
+tel
+end
+
+package q body
+node g (x: int) returns (y: int);
+let
+  y = p::f(x);
+tel
+end
+`,
+			},
+			err: "main.mls:11:7: package 'q' doesn't use package 'p'",
+		},
+		{
+			name: "undefined qualified node",
+			files: map[string]string{
+				"main.mls": `include "p.mls";
+
+node f (x: int) returns (y: int);
+let
+  y = p::g(x);
+tel
+`,
+				"p.mls": `package p body end`,
+			},
+			err: "main.mls:5:7: undefined node 'p::g'",
+		},
+		{
+			name: "ambiguous node",
+			files: map[string]string{
+				"main.mls": `package p body
+node f (x: int) returns (y: int);
+let
+  y = x;
+tel
+end
+
+package q body
+node f (x: int) returns (y: int);
+let
+  y = x;
+tel
+end
+
+package r uses p, q;
+body
+node g (x: int) returns (y: int);
+let
+  y = f(x);
+tel
+end
+`,
+			},
+			err: "main.mls:19:7: ambiguous node 'f', defined in packages 'p' and 'q'",
+		},
+		{
+			name: "linked name conflict",
+			files: map[string]string{
+				"main.mls": `include "p.mls";
+
+node p__f (x: int) returns (y: int);
+let
+  y = x;
+tel
+`,
+				"p.mls": `package p body
+node f (x: int) returns (y: int);
+let
+  y = x;
+tel
+end
+`,
+			},
+			err: "main.mls:3:1: node 'p__f' conflicts with node 'p::f' defined at p.mls:2:1, both are linked as 'p__f'",
+		},
+		{
+			name: "duplicate package node",
+			files: map[string]string{
+				"main.mls": `package p body
+node f (x: int) returns (y: int);
+let
+  y = x;
+tel
+
+node f (x: int) returns (y: int);
+let
+  y = x;
+tel
+end
+`,
+			},
+			err: "main.mls:7:1: node 'p::f' already defined at main.mls:2:1",
+		},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := memLoader(tc.files).Load("main.mls")
+			if err == nil || !strings.Contains(filepath.ToSlash(err.Error()), tc.err) {
+				t.Errorf("Load() = %v, want an error containing %q", err, tc.err)
+			}
+		})
+	}
+}
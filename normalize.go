@@ -0,0 +1,287 @@
+package minilustre
+
+import (
+	"fmt"
+)
+
+// typeOf returns the type of a single-valued expression, given the types of
+// the variables in scope and the nodes which can be called.
+func typeOf(e Expr, vars map[string]Type, defs map[string]*Node) (Type, bool) {
+	switch e := e.(type) {
+	case ExprConst:
+		return e.Type(), true
+	case ExprVar:
+		t, ok := vars[e.Name]
+		return t, ok
+	case *ExprCall:
+		callee, ok := defs[e.Name]
+		if !ok || len(callee.OutParams) != 1 {
+			return 0, false
+		}
+		return callee.OutParams[0].Type, true
+	case *ExprBinOp:
+		switch e.Op {
+		case BinOpFby:
+			return typeOf(e.Left, vars, defs)
+		case BinOpPlus, BinOpMinus, BinOpMul, BinOpDiv:
+			return TypeInt, true
+		case BinOpFPlus, BinOpFMinus, BinOpFMul, BinOpFDiv:
+			return TypeFloat, true
+		default:
+			return TypeBool, true
+		}
+	case *ExprUnOp:
+		switch e.Op {
+		case UnOpNot:
+			return TypeBool, true
+		case UnOpMinus:
+			return TypeInt, true
+		case UnOpFMinus:
+			return TypeFloat, true
+		}
+	case *ExprIf:
+		return typeOf(e.Body, vars, defs)
+	}
+	return 0, false
+}
+
+// ExprType returns the type of a single-valued expression of the node n.
+// Calls are resolved among the nodes of f. It returns false if the type can't
+// be determined, for instance for tuples and calls to undefined nodes.
+func ExprType(f *File, n *Node, e Expr) (Type, bool) {
+	vars := make(map[string]Type)
+	for _, params := range [][]Param{n.InParams, n.OutParams, n.LocalParams} {
+		for _, param := range params {
+			vars[param.Name] = param.Type
+		}
+	}
+	defs := make(map[string]*Node)
+	for i := range f.Nodes {
+		if _, ok := defs[f.Nodes[i].Name]; !ok {
+			defs[f.Nodes[i].Name] = &f.Nodes[i]
+		}
+	}
+	return typeOf(e, vars, defs)
+}
+
+type normalizer struct {
+	node *Node
+	// Nodes which can be called from the node being processed
+	defs   map[string]*Node
+	types  map[string]Type
+	names  map[string]bool
+	body   []Assign
+	errors ErrorList
+}
+
+func (nz *normalizer) local(name string, t Type) ExprVar {
+	name = freshName(nz.names, name)
+	nz.types[name] = t
+	nz.node.LocalParams = append(nz.node.LocalParams, Param{Name: name, Type: t})
+	return ExprVar{Name: name}
+}
+
+// outTypes returns the types of the outputs of a node.
+func (nz *normalizer) outTypes(call *ExprCall) ([]string, []Type, bool) {
+	callee, ok := nz.defs[call.Name]
+	if !ok {
+		if call.Name == "print" {
+			return []string{"u"}, []Type{TypeUnit}, true
+		}
+		nz.errors = append(nz.errors, errorf(call.NamePos, "undefined node '%v'", call.Name))
+		return nil, nil, false
+	}
+
+	names := make([]string, len(callee.OutParams))
+	typs := make([]Type, len(callee.OutParams))
+	for i, param := range callee.OutParams {
+		names[i] = param.Name
+		typs[i] = param.Type
+	}
+	return names, typs, true
+}
+
+// single returns the simple expression for an expression which must have
+// exactly one value.
+func (nz *normalizer) single(e Expr) Expr {
+	l := nz.expr(e)
+	if len(l) != 1 {
+		nz.errors = append(nz.errors, errorf(e.Pos(), "expected a single value, got %v", len(l)))
+		return e
+	}
+	return l[0]
+}
+
+// call normalizes the arguments of a call.
+func (nz *normalizer) call(e *ExprCall) *ExprCall {
+	var args []Expr
+	for _, arg := range e.Args {
+		args = append(args, nz.expr(arg)...)
+	}
+	return &ExprCall{Name: e.Name, NamePos: e.NamePos, Args: args}
+}
+
+// fby normalizes the operands of a fby operator, one pair of simple
+// expressions per value.
+func (nz *normalizer) fby(e *ExprBinOp) (left, right []Expr) {
+	left = nz.expr(e.Left)
+	right = nz.expr(e.Right)
+	if len(left) != len(right) {
+		nz.errors = append(nz.errors, errorf(e.OpPos, "fby operands have %v and %v values", len(left), len(right)))
+		return nil, nil
+	}
+	return left, right
+}
+
+// expr returns simple expressions computing the values of e. Equations are
+// added for the fby operators and calls contained in e.
+func (nz *normalizer) expr(e Expr) []Expr {
+	switch e := e.(type) {
+	case ExprConst, ExprVar:
+		return []Expr{e}
+	case ExprTuple:
+		var l []Expr
+		for _, ee := range e {
+			l = append(l, nz.expr(ee)...)
+		}
+		return l
+	case *ExprCall:
+		call := nz.call(e)
+		names, typs, ok := nz.outTypes(call)
+		if !ok {
+			return []Expr{call}
+		}
+		dst := make([]string, len(typs))
+		out := make([]Expr, len(typs))
+		for i, t := range typs {
+			v := nz.local(call.Name+"_"+names[i], t)
+			v.NamePos = call.NamePos
+			dst[i] = v.Name
+			out[i] = v
+		}
+		nz.body = append(nz.body, Assign{Pos: call.NamePos, Dst: dst, Body: call})
+		return out
+	case *ExprBinOp:
+		if e.Op != BinOpFby {
+			return []Expr{&ExprBinOp{e.Op, e.OpPos, nz.single(e.Left), nz.single(e.Right)}}
+		}
+
+		left, right := nz.fby(e)
+		out := make([]Expr, len(left))
+		for i := range left {
+			t, ok := typeOf(left[i], nz.types, nz.defs)
+			if !ok {
+				nz.errors = append(nz.errors, errorf(e.OpPos, "cannot infer the type of %v", left[i]))
+			}
+			v := nz.local("fby", t)
+			v.NamePos = e.OpPos
+			nz.body = append(nz.body, Assign{Pos: e.OpPos, Dst: []string{v.Name}, Body: &ExprBinOp{e.Op, e.OpPos, left[i], right[i]}})
+			out[i] = v
+		}
+		return out
+	case *ExprUnOp:
+		return []Expr{&ExprUnOp{e.Op, e.OpPos, nz.single(e.Expr)}}
+	case *ExprIf:
+		cond := nz.single(e.Cond)
+		body := nz.expr(e.Body)
+		els := nz.expr(e.Else)
+		if len(body) != len(els) {
+			nz.errors = append(nz.errors, errorf(e.If, "if branches have %v and %v values", len(body), len(els)))
+			return nil
+		}
+		out := make([]Expr, len(body))
+		for i := range body {
+			out[i] = &ExprIf{e.If, cond, body[i], els[i]}
+		}
+		return out
+	}
+	panic(fmt.Sprintf("unknown expression %T", e))
+}
+
+func (nz *normalizer) assign(a *Assign) {
+	var values []Expr
+	switch e := a.Body.(type) {
+	case *ExprCall:
+		nz.body = append(nz.body, Assign{Pos: a.Pos, Dst: a.Dst, Body: nz.call(e)})
+		return
+	case *ExprBinOp:
+		if e.Op != BinOpFby {
+			values = nz.expr(e)
+			break
+		}
+		left, right := nz.fby(e)
+		for i := range left {
+			values = append(values, &ExprBinOp{e.Op, e.OpPos, left[i], right[i]})
+		}
+	default:
+		values = nz.expr(e)
+	}
+
+	if len(values) != len(a.Dst) {
+		nz.errors = append(nz.errors, errorf(a.Pos, "cannot assign %v values to %v variables", len(values), len(a.Dst)))
+		return
+	}
+	for i, dst := range a.Dst {
+		nz.body = append(nz.body, Assign{Pos: a.Pos, Dst: []string{dst}, Body: values[i]})
+	}
+}
+
+// Normalize puts the equations of a file in normal form. Each equation of a
+// normalized node has one of the following shapes:
+//
+//	x = e
+//	x = e1 fby e2
+//	(x1, ..., xn) = f(e1, ..., em)
+//
+// where e, e1, ..., em are simple expressions: constants, variables, and
+// operators other than fby and if expressions applied to simple expressions.
+// Simple expressions never contain calls nor tuples.
+//
+// The fby operators and calls nested in expressions are moved to new
+// equations defining fresh locals, inserted before the equation which uses
+// them. Equations with a tuple on their right-hand side are split into one
+// equation per variable. Normalizing a file preserves its semantics, and
+// normalizing a normalized file leaves it unchanged.
+//
+// Nodes can be called before their definition. The file is checked with Check
+// first, and errors are returned in an ErrorList.
+func Normalize(f *File) error {
+	if err := Check(f); err != nil {
+		return err
+	}
+	var errs ErrorList
+
+	// Declare all nodes first, so that calls don't depend on source order
+	defs := make(map[string]*Node)
+	for i := range f.Nodes {
+		if _, ok := defs[f.Nodes[i].Name]; !ok {
+			defs[f.Nodes[i].Name] = &f.Nodes[i]
+		}
+	}
+
+	for i := range f.Nodes {
+		n := &f.Nodes[i]
+		if !n.Extern {
+			nz := normalizer{
+				node:  n,
+				defs:  defs,
+				types: make(map[string]Type),
+				names: nodeNames(n),
+			}
+			for _, params := range [][]Param{n.InParams, n.OutParams, n.LocalParams} {
+				for _, param := range params {
+					nz.types[param.Name] = param.Type
+				}
+			}
+
+			// Don't modify the locals of the original node in place
+			n.LocalParams = append([]Param(nil), n.LocalParams...)
+			for j := range n.Body {
+				nz.assign(&n.Body[j])
+			}
+			n.Body = nz.body
+			errs = append(errs, nz.errors...)
+		}
+	}
+	return errs.Err()
+}
@@ -0,0 +1,154 @@
+package minilustre
+
+import (
+	"strings"
+	"testing"
+)
+
+const normalizeSrc = `node sum (x: int) returns (s: int);
+let
+  s = 0 fby s + x;
+tel
+
+node pair (x: int) returns (a, b: int);
+let
+  (a, b) = (x, sum(x) * 2);
+tel
+
+node f (x: int; c: bool) returns (o, p: int);
+var q, r: int;
+let
+  o = sum(x + 1) + (1 fby sum(x)) * 2;
+  (q, r) = if c then pair(x) else (0, 0) fby (1, x);
+  p = q + r;
+tel
+`
+
+// isSimple returns true if an expression contains no fby, call nor tuple.
+func isSimple(e Expr) bool {
+	ok := true
+	Inspect(e, func(e Expr) bool {
+		switch e := e.(type) {
+		case *ExprCall, ExprTuple:
+			ok = false
+		case *ExprBinOp:
+			if e.Op == BinOpFby {
+				ok = false
+			}
+		}
+		return ok
+	})
+	return ok
+}
+
+func TestNormalize(t *testing.T) {
+	f, err := Parse(strings.NewReader(normalizeSrc))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Normalize(f); err != nil {
+		t.Fatal(err)
+	}
+
+	var eqs []string
+	for _, n := range f.Nodes {
+		for _, a := range n.Body {
+			eqs = append(eqs, a.String())
+
+			switch e := a.Body.(type) {
+			case *ExprCall:
+				for _, arg := range e.Args {
+					if !isSimple(arg) {
+						t.Errorf("%v: argument %v isn't simple", a.String(), arg)
+					}
+				}
+			case *ExprBinOp:
+				if e.Op == BinOpFby && (!isSimple(e.Left) || !isSimple(e.Right)) {
+					t.Errorf("%v: fby operands aren't simple", a.String())
+				}
+			default:
+				if !isSimple(e) || len(a.Dst) != 1 {
+					t.Errorf("%v: equation isn't in normal form", a.String())
+				}
+			}
+		}
+	}
+
+	want := []string{
+		"s = 0 fby s + x",
+		"sum_s_1 = sum(x)",
+		"a = x",
+		"b = sum_s_1 * 2",
+		"sum_s_1 = sum(x + 1)",
+		"sum_s_2 = sum(x)",
+		"fby_1 = 1 fby sum_s_2",
+		"o = sum_s_1 + fby_1 * 2",
+		"(pair_a_1, pair_b_1) = pair(x)",
+		"fby_2 = 0 fby 1",
+		"fby_3 = 0 fby x",
+		"q = if c then pair_a_1 else fby_2",
+		"r = if c then pair_b_1 else fby_3",
+		"p = q + r",
+	}
+	if strings.Join(eqs, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Normalize() = \n%v\nwant:\n%v", strings.Join(eqs, "\n"), strings.Join(want, "\n"))
+	}
+
+	// Normalizing twice is a no-op
+	before := f.String()
+	if err := Normalize(f); err != nil {
+		t.Fatal(err)
+	}
+	if after := f.String(); after != before {
+		t.Errorf("Normalize() isn't idempotent: got\n%v\nwant:\n%v", after, before)
+	}
+}
+
+func TestNormalizeErrors(t *testing.T) {
+	src := `node f (x: int) returns (o: int);
+let
+  o = g(x) + 1;
+tel
+`
+	f, err := Parse(strings.NewReader(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = Normalize(f)
+	if err == nil || !strings.Contains(err.Error(), "3:7: undefined node 'g'") {
+		t.Errorf("Normalize() = %v, want an undefined node error at 3:7", err)
+	}
+}
+
+func TestNormalizeDuplicateNodes(t *testing.T) {
+	src := `node f (x: int) returns (o: int);
+let
+  o = x;
+tel
+
+node f (x, y: int) returns (o: int);
+let
+  o = x + y;
+tel
+
+extern node print (str: string) returns (u: unit);
+`
+	f, err := Parse(strings.NewReader(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = Normalize(f)
+	l, ok := err.(ErrorList)
+	if !ok || len(l) != 2 {
+		t.Fatalf("Normalize() = %v, want 2 errors", err)
+	}
+	if want := "6:1: node 'f' already defined at 1:1"; !strings.Contains(l[0].Error(), want) {
+		t.Errorf("Normalize() = %v, want an error containing %q", l[0], want)
+	}
+	if want := "11:1: node 'print' redefines a built-in node"; !strings.Contains(l[1].Error(), want) {
+		t.Errorf("Normalize() = %v, want an error containing %q", l[1], want)
+	}
+}
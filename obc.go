@@ -0,0 +1,318 @@
+package minilustre
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Stmt is a statement of an Obc method.
+type Stmt interface {
+	fmt.Stringer
+	isStmt()
+}
+
+// StmtAssign assigns the value of a simple expression to a variable.
+type StmtAssign struct {
+	Dst  string
+	Expr Expr
+}
+
+func (*StmtAssign) isStmt() {}
+
+func (s *StmtAssign) String() string {
+	return s.Dst + " := " + formatExpr(s.Expr)
+}
+
+// StmtMemRead reads a memory of the current instance into a variable.
+type StmtMemRead struct {
+	Dst string
+	Mem string
+}
+
+func (*StmtMemRead) isStmt() {}
+
+func (s *StmtMemRead) String() string {
+	return s.Dst + " := state(" + s.Mem + ")"
+}
+
+// StmtMemWrite writes the value of a simple expression to a memory of the
+// current instance.
+type StmtMemWrite struct {
+	Mem  string
+	Expr Expr
+}
+
+func (*StmtMemWrite) isStmt() {}
+
+func (s *StmtMemWrite) String() string {
+	return "state(" + s.Mem + ") := " + formatExpr(s.Expr)
+}
+
+// StmtCall calls the step method of an instance and assigns its outputs to
+// variables. If Instance is empty, the class is extern or built-in and is
+// called directly.
+type StmtCall struct {
+	Dst      []string
+	Class    string
+	Instance string
+	Args     []Expr
+}
+
+func (*StmtCall) isStmt() {}
+
+func (s *StmtCall) String() string {
+	dst := strings.Join(s.Dst, ", ")
+	if len(s.Dst) > 1 {
+		dst = "(" + dst + ")"
+	}
+	callee := s.Class
+	if s.Instance != "" {
+		callee = s.Instance + ".step"
+	}
+	return dst + " := " + callee + "(" + formatExprList(s.Args) + ")"
+}
+
+// StmtReset calls the reset method of an instance.
+type StmtReset struct {
+	Instance string
+}
+
+func (*StmtReset) isStmt() {}
+
+func (s *StmtReset) String() string {
+	return s.Instance + ".reset()"
+}
+
+// Instance is an instance of a class held by another class.
+type Instance struct {
+	Name  string
+	Class string
+}
+
+// Class is the Obc translation of a node. The state of a class is made of
+// memories and instances of other classes, one per call site.
+type Class struct {
+	Name string
+	// Extern is true if the class is implemented outside of the program.
+	// Extern classes have no state and no methods, and are called directly.
+	Extern bool
+	In     []Param
+	Out    []Param
+	Locals []Param
+
+	Mems      []Param
+	Instances []Instance
+
+	// Reset initializes the state of the class. It writes constants to all
+	// memories and resets instances.
+	Reset []Stmt
+	// Step computes one cycle. It has access to the inputs, outputs and
+	// locals of the class.
+	Step []Stmt
+}
+
+// Stateless returns true if the class has no memories nor instances.
+func (c *Class) Stateless() bool {
+	return len(c.Mems) == 0 && len(c.Instances) == 0
+}
+
+func (c *Class) String() string {
+	var b strings.Builder
+	if c.Extern {
+		fmt.Fprintf(&b, "extern class %v (%v) returns (%v)\n", c.Name, FormatParams(c.In), FormatParams(c.Out))
+		return b.String()
+	}
+
+	fmt.Fprintf(&b, "class %v {\n", c.Name)
+	for _, g := range paramGroups(c.Mems) {
+		fmt.Fprintf(&b, "\tmem %v;\n", formatParamGroup(g))
+	}
+	for _, inst := range c.Instances {
+		fmt.Fprintf(&b, "\tinst %v: %v;\n", inst.Name, inst.Class)
+	}
+	if !c.Stateless() {
+		b.WriteString("\n")
+	}
+
+	b.WriteString("\treset() {\n")
+	for _, s := range c.Reset {
+		fmt.Fprintf(&b, "\t\t%v;\n", s)
+	}
+	b.WriteString("\t}\n\n")
+
+	fmt.Fprintf(&b, "\tstep(%v) returns (%v) {\n", FormatParams(c.In), FormatParams(c.Out))
+	for _, g := range paramGroups(c.Locals) {
+		fmt.Fprintf(&b, "\t\tvar %v;\n", formatParamGroup(g))
+	}
+	for _, s := range c.Step {
+		fmt.Fprintf(&b, "\t\t%v;\n", s)
+	}
+	b.WriteString("\t}\n}\n")
+	return b.String()
+}
+
+// Program is the Obc translation of a file: an imperative intermediate
+// language with one class per node.
+type Program struct {
+	Classes []Class
+}
+
+func (p *Program) String() string {
+	l := make([]string, len(p.Classes))
+	for i := range p.Classes {
+		l[i] = p.Classes[i].String()
+	}
+	return strings.Join(l, "\n")
+}
+
+type translator struct {
+	class *Class
+	// Nodes which can be called from the node being translated
+	defs  map[string]*Node
+	types map[string]Type
+	// Variable and instance names used in the node being translated
+	names map[string]bool
+	// Name of the local and memory holding the first cycle flag
+	first string
+	// Memory writes done at the end of the cycle
+	updates []Stmt
+}
+
+func (tr *translator) local(name string, t Type) string {
+	name = freshName(tr.names, name)
+	tr.class.Locals = append(tr.class.Locals, Param{Name: name, Type: t})
+	return name
+}
+
+func (tr *translator) call(a *Assign, e *ExprCall) {
+	callee, ok := tr.defs[e.Name]
+	if !ok || callee.Extern {
+		tr.class.Step = append(tr.class.Step, &StmtCall{Dst: a.Dst, Class: e.Name, Args: e.Args})
+		return
+	}
+
+	inst := freshName(tr.names, e.Name)
+	tr.class.Instances = append(tr.class.Instances, Instance{Name: inst, Class: e.Name})
+	tr.class.Reset = append(tr.class.Reset, &StmtReset{inst})
+	tr.class.Step = append(tr.class.Step, &StmtCall{Dst: a.Dst, Class: e.Name, Instance: inst, Args: e.Args})
+}
+
+// zeroValue returns the default value of a type.
+func zeroValue(t Type) interface{} {
+	switch t {
+	case TypeBool:
+		return false
+	case TypeInt:
+		return 0
+	case TypeFloat:
+		return float32(0)
+	case TypeString:
+		return ""
+	}
+	return nil
+}
+
+// fby translates x = e1 fby e2. The memory of x holds the value of e2 from
+// the previous cycle. If e1 is a constant, it's the initial value of the
+// memory. Otherwise, a flag is used to detect the first cycle.
+func (tr *translator) fby(a *Assign, e *ExprBinOp) {
+	x := a.Dst[0]
+	t := tr.types[x]
+	tr.class.Mems = append(tr.class.Mems, Param{Name: x, Type: t})
+	tr.updates = append(tr.updates, &StmtMemWrite{x, e.Right})
+
+	if c, ok := e.Left.(ExprConst); ok {
+		tr.class.Reset = append(tr.class.Reset, &StmtMemWrite{x, c})
+		tr.class.Step = append(tr.class.Step, &StmtMemRead{x, x})
+		return
+	}
+
+	// The memory is only read after the first cycle, initialize it anyway
+	tr.class.Reset = append(tr.class.Reset, &StmtMemWrite{x, ExprConst{Value: zeroValue(t)}})
+	if tr.first == "" {
+		tr.first = tr.local("first", TypeBool)
+		tr.class.Mems = append(tr.class.Mems, Param{Name: tr.first, Type: TypeBool})
+		tr.class.Reset = append(tr.class.Reset, &StmtMemWrite{tr.first, ExprConst{Value: true}})
+	}
+	prev := tr.local(x, t)
+	tr.class.Step = append(tr.class.Step,
+		&StmtMemRead{prev, x},
+		&StmtAssign{x, &ExprIf{Cond: ExprVar{Name: tr.first}, Body: e.Left, Else: ExprVar{Name: prev}}},
+	)
+}
+
+func (tr *translator) node(n *Node) {
+	for _, a := range n.Body {
+		switch e := a.Body.(type) {
+		case *ExprCall:
+			tr.call(&a, e)
+			continue
+		case *ExprBinOp:
+			if e.Op == BinOpFby {
+				tr.fby(&a, e)
+				continue
+			}
+		}
+		tr.class.Step = append(tr.class.Step, &StmtAssign{a.Dst[0], a.Body})
+	}
+
+	if tr.first != "" {
+		tr.class.Step = append([]Stmt{&StmtMemRead{tr.first, tr.first}}, tr.class.Step...)
+		tr.updates = append(tr.updates, &StmtMemWrite{tr.first, ExprConst{Value: false}})
+	}
+	tr.class.Step = append(tr.class.Step, tr.updates...)
+}
+
+// Translate translates a file to Obc. The file is normalized and scheduled
+// first, f itself is left untouched.
+//
+// Each fby equation x = e1 fby e2 gets a memory named x, and each call to a
+// node which isn't extern gets an instance. Classes are sorted so that each
+// class comes after the classes it instantiates.
+func Translate(f *File) (*Program, error) {
+	f = &File{Nodes: append([]Node(nil), f.Nodes...)}
+	if err := Normalize(f); err != nil {
+		return nil, err
+	}
+	if err := Schedule(f); err != nil {
+		return nil, err
+	}
+
+	// Recursive calls have been rejected by Check, in Normalize
+	order, _ := callOrder(f)
+	nodes := make([]Node, len(order))
+	for i, j := range order {
+		nodes[i] = f.Nodes[j]
+	}
+	f.Nodes = nodes
+
+	var p Program
+	defs := make(map[string]*Node)
+	for i := range f.Nodes {
+		n := &f.Nodes[i]
+		c := Class{
+			Name:   n.Name,
+			Extern: n.Extern,
+			In:     n.InParams,
+			Out:    n.OutParams,
+			Locals: append([]Param(nil), n.LocalParams...),
+		}
+		if !n.Extern {
+			tr := translator{
+				class: &c,
+				defs:  defs,
+				types: make(map[string]Type),
+				names: nodeNames(n),
+			}
+			for _, params := range [][]Param{n.InParams, n.OutParams, n.LocalParams} {
+				for _, param := range params {
+					tr.types[param.Name] = param.Type
+				}
+			}
+			tr.node(n)
+		}
+		p.Classes = append(p.Classes, c)
+		defs[n.Name] = n
+	}
+	return &p, nil
+}
@@ -0,0 +1,87 @@
+package minilustre
+
+import (
+	"strings"
+	"testing"
+)
+
+const obcSrc = `extern node sin (x: float) returns (y: float);
+
+node counter (x: int) returns (c: int);
+let
+  c = 0 fby c + x;
+tel
+
+node f (x: int; a: float) returns (o: int; s: float);
+var y: int;
+let
+  o = counter(y) + counter(x);
+  y = x fby o;
+  s = sin(a);
+tel
+`
+
+const obcWant = `extern class sin (x: float) returns (y: float)
+
+class counter {
+	mem c: int;
+
+	reset() {
+		state(c) := 0;
+	}
+
+	step(x: int) returns (c: int) {
+		c := state(c);
+		state(c) := c + x;
+	}
+}
+
+class f {
+	mem y: int;
+	mem first_1: bool;
+	inst counter_1: counter;
+	inst counter_2: counter;
+
+	reset() {
+		counter_1.reset();
+		state(y) := 0;
+		state(first_1) := true;
+		counter_2.reset();
+	}
+
+	step(x: int; a: float) returns (o: int; s: float) {
+		var y, counter_c_1, counter_c_2: int;
+		var first_1: bool;
+		var y_1: int;
+		first_1 := state(first_1);
+		counter_c_2 := counter_1.step(x);
+		y_1 := state(y);
+		y := if first_1 then x else y_1;
+		counter_c_1 := counter_2.step(y);
+		o := counter_c_1 + counter_c_2;
+		s := sin(a);
+		state(y) := o;
+		state(first_1) := false;
+	}
+}
+`
+
+func TestTranslate(t *testing.T) {
+	f, err := Parse(strings.NewReader(obcSrc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := f.String()
+
+	p, err := Translate(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := p.String(); got != obcWant {
+		t.Errorf("Translate() = \n%v\nwant:\n%v", got, obcWant)
+	}
+
+	if after := f.String(); after != before {
+		t.Errorf("Translate() modified its input: got\n%v\nwant:\n%v", after, before)
+	}
+}
@@ -1,69 +1,163 @@
 package minilustre
 
 import (
-	"bufio"
-	"fmt"
 	"io"
+	"sort"
 	"strconv"
+	"strings"
 )
 
 type parser struct {
-	in  <-chan item
-	cur *item
+	s   *Scanner
+	cur *Token
+	// I/O error returned by the scanner, if any. Once the scanner has failed,
+	// the parser only sees EOF tokens.
+	err    error
+	errors ErrorList
+
+	comments []Comment
+	// Last line of the previous token, used to detect end-of-line comments
+	line int
 }
 
-func (p *parser) peek() item {
-	if p.cur == nil {
-		it := <-p.in
-		p.cur = &it
+func (p *parser) peek() Token {
+	for p.cur == nil {
+		if p.err != nil {
+			return Token{Kind: TokenEOF, Pos: p.s.pos}
+		}
+
+		tok, err := p.s.Next()
+		if e, ok := err.(*Error); ok {
+			// Syntax errors don't prevent the scanner from reading the next
+			// token
+			p.addError(e)
+		} else if err != nil {
+			p.err = err
+		} else if tok.Kind == TokenComment {
+			p.comments = append(p.comments, Comment{
+				Pos:       tok.Pos,
+				Text:      tok.Value,
+				EndOfLine: tok.Pos.Line == p.line,
+			})
+			p.line = tok.Pos.Line + strings.Count(tok.Value, "\n")
+		} else {
+			p.cur = &tok
+			p.line = tok.Pos.Line + strings.Count(tok.Value, "\n")
+		}
 	}
 
 	return *p.cur
 }
 
 func (p *parser) accept() {
-	if p.cur == nil {
-		panic("accepted a nil item")
-	}
-	// fmt.Println(p.cur)
+	p.peek()
 	p.cur = nil
 }
 
-func (p *parser) peekItem(t itemType) (string, error) {
-	it := p.peek()
-	if it.typ != t {
-		return "", fmt.Errorf("minilustre: expected token %v, got %v", t, it)
+// addError records an error. Only the first error of each line is kept, the
+// other ones are likely to be consequences of the first one.
+func (p *parser) addError(err error) {
+	e, ok := err.(*Error)
+	if !ok {
+		e = &Error{p.peek().Pos, err.Error()}
+	}
+
+	if n := len(p.errors); n > 0 && p.errors[n-1].Pos.Line == e.Pos.Line {
+		return
+	}
+	p.errors = append(p.errors, e)
+}
+
+func (p *parser) isKeyword(tok *Token, keywords []string) bool {
+	if tok.Kind != TokenKeyword {
+		return false
+	}
+	for _, kw := range keywords {
+		if tok.Value == kw {
+			return true
+		}
+	}
+	return false
+}
+
+// nodeKeywords are the keywords which can start a node.
+var nodeKeywords = []string{keywordNode, keywordInline, keywordUnsafe, keywordExtern}
+
+// declKeywords are the keywords which can start or end a top-level
+// declaration.
+var declKeywords = []string{keywordNode, keywordInline, keywordUnsafe, keywordExtern, keywordInclude, keywordPackage, keywordEnd}
+
+// skipTo skips tokens until one of the keywords, the start or end of a
+// declaration or EOF is reached. If semi is true, it also stops right after a
+// semicolon which isn't enclosed in parentheses, and returns true in that
+// case.
+func (p *parser) skipTo(semi bool, keywords ...string) bool {
+	depth := 0
+	for {
+		tok := p.peek()
+		if tok.Kind == TokenEOF || p.isKeyword(&tok, keywords) || p.isKeyword(&tok, declKeywords) {
+			return false
+		}
+		p.accept()
+
+		switch tok.Kind {
+		case TokenLparen:
+			depth++
+		case TokenRparen:
+			if depth > 0 {
+				depth--
+			}
+		case TokenSemi:
+			if semi && depth == 0 {
+				return true
+			}
+		}
+	}
+}
+
+func (p *parser) peekToken(k TokenKind) (Token, error) {
+	tok := p.peek()
+	if tok.Kind != k {
+		return tok, errorf(tok.Pos, "expected token %v, got %v", k, &tok)
 	}
-	return p.cur.value, nil
+	return tok, nil
 }
 
-func (p *parser) acceptItem(t itemType) (string, error) {
-	s, err := p.peekItem(t)
+func (p *parser) acceptToken(k TokenKind) (Token, error) {
+	tok, err := p.peekToken(k)
 	if err != nil {
-		return "", err
+		return tok, err
 	}
 	p.accept()
-	return s, nil
+	return tok, nil
 }
 
-func (p *parser) acceptKeyword(keyword string) error {
-	s, err := p.peekItem(itemKeyword)
-	if err != nil {
-		return fmt.Errorf("minilustre: expected keyword %v, got %v", keyword, p.cur)
-	} else if s != keyword {
-		return fmt.Errorf("minilustre: expected keyword %v, got %v", keyword, s)
+// acceptName accepts an identifier which names a node, a parameter or a
+// package. Qualified names are reported as errors.
+func (p *parser) acceptName() (Token, error) {
+	tok, err := p.acceptToken(TokenIdent)
+	if err == nil && strings.Contains(tok.Value, "::") {
+		p.addError(errorf(tok.Pos, "unexpected qualified name '%v'", tok.Value))
+	}
+	return tok, err
+}
+
+func (p *parser) acceptKeyword(keyword string) (Token, error) {
+	tok := p.peek()
+	if tok.Kind != TokenKeyword || tok.Value != keyword {
+		return tok, errorf(tok.Pos, "expected keyword %v, got %v", keyword, &tok)
 	}
 	p.accept()
-	return nil
+	return tok, nil
 }
 
 func (p *parser) typ() (Type, error) {
-	s, err := p.acceptItem(itemKeyword)
+	tok, err := p.acceptToken(TokenKeyword)
 	if err != nil {
 		return 0, err
 	}
 
-	switch s {
+	switch tok.Value {
 	case keywordUnit:
 		return TypeUnit, nil
 	case keywordBool:
@@ -75,56 +169,62 @@ func (p *parser) typ() (Type, error) {
 	case keywordString:
 		return TypeString, nil
 	default:
-		return 0, fmt.Errorf("minilustre: expected a type, got '%v'", s)
+		return 0, errorf(tok.Pos, "expected a type, got '%v'", tok.Value)
 	}
 }
 
-func (p *parser) param(params map[string]Type) (bool, error) {
-	var names []string
+func (p *parser) param(params []Param) ([]Param, bool, error) {
+	var names []Token
 	for {
-		name, err := p.acceptItem(itemIdent)
+		name, err := p.acceptName()
 		if err != nil {
 			break
 		}
 		names = append(names, name)
 
-		if _, err := p.acceptItem(itemComma); err != nil {
+		if _, err := p.acceptToken(TokenComma); err != nil {
 			break
 		}
 	}
 	if len(names) == 0 {
-		return false, nil
+		return params, false, nil
 	}
 
-	if _, err := p.acceptItem(itemColon); err != nil {
-		return true, err
+	if _, err := p.acceptToken(TokenColon); err != nil {
+		return params, true, err
 	}
 
 	t, err := p.typ()
 	if err != nil {
-		return true, err
+		return params, true, err
 	}
 
+NAMES:
 	for _, name := range names {
-		if _, ok := params[name]; ok {
-			return true, fmt.Errorf("minilustre: duplicate parameter name '%v'", name)
+		for _, param := range params {
+			if param.Name == name.Value {
+				p.addError(errorf(name.Pos, "duplicate parameter name '%v'", name.Value))
+				continue NAMES
+			}
 		}
-		params[name] = t
+		params = append(params, Param{Name: name.Value, Type: t, Pos: name.Pos})
 	}
 
-	return true, nil
+	return params, true, nil
 }
 
-func (p *parser) paramList() (map[string]Type, error) {
-	params := make(map[string]Type)
+func (p *parser) paramList() ([]Param, error) {
+	var params []Param
 	for {
-		if more, err := p.param(params); err != nil {
+		var more bool
+		var err error
+		if params, more, err = p.param(params); err != nil {
 			return nil, err
 		} else if !more {
 			break
 		}
 
-		if _, err := p.acceptItem(itemSemi); err != nil {
+		if _, err := p.acceptToken(TokenSemi); err != nil {
 			break
 		}
 	}
@@ -132,19 +232,42 @@ func (p *parser) paramList() (map[string]Type, error) {
 	return params, nil
 }
 
+// localParamList parses the parameters of a var section. On error, it skips
+// to the next parameter.
+func (p *parser) localParamList() []Param {
+	var params []Param
+	for {
+		var more bool
+		var err error
+		if params, more, err = p.param(params); err != nil {
+			p.addError(err)
+			if p.skipTo(true, keywordLet, keywordTel) {
+				continue
+			}
+			break
+		} else if !more {
+			break
+		}
+
+		if _, err := p.acceptToken(TokenSemi); err != nil {
+			break
+		}
+	}
+
+	return params
+}
+
 func (p *parser) exprList() ([]Expr, error) {
 	var l []Expr
 	for {
 		e, err := p.expr()
 		if err != nil {
 			return nil, err
-		} else if e == nil {
-			break
 		}
 
 		l = append(l, e)
 
-		if _, err := p.acceptItem(itemComma); err != nil {
+		if _, err := p.acceptToken(TokenComma); err != nil {
 			break
 		}
 	}
@@ -153,43 +276,33 @@ func (p *parser) exprList() ([]Expr, error) {
 }
 
 func (p *parser) exprMember() (Expr, error) {
-	if _, err := p.acceptItem(itemLparen); err == nil {
-		e, err := p.expr()
+	if lparen, err := p.acceptToken(TokenLparen); err == nil {
+		if _, err := p.acceptToken(TokenRparen); err == nil {
+			return ExprConst{nil, lparen.Pos}, nil
+		}
+
+		l, err := p.exprList()
 		if err != nil {
 			return nil, err
 		}
 
-		if _, err := p.acceptItem(itemComma); err == nil {
-			l := []Expr{e}
-			for {
-				e, err := p.expr()
-				if err != nil {
-					return nil, err
-				}
-				l = append(l, e)
-
-				if _, err := p.acceptItem(itemComma); err != nil {
-					break
-				}
-			}
-
-			if _, err := p.acceptItem(itemRparen); err != nil {
-				return nil, err
-			}
+		if _, err := p.acceptToken(TokenRparen); err != nil {
+			return nil, err
+		}
 
-			return ExprTuple(l), nil
-		} else {
-			return e, nil
+		if len(l) == 1 {
+			return l[0], nil
 		}
+		return ExprTuple(l), nil
 	}
 
-	if err := p.acceptKeyword(keywordIf); err == nil {
+	if tok, err := p.acceptKeyword(keywordIf); err == nil {
 		cond, err := p.expr()
 		if err != nil {
 			return nil, err
 		}
 
-		if err := p.acceptKeyword(keywordThen); err != nil {
+		if _, err := p.acceptKeyword(keywordThen); err != nil {
 			return nil, err
 		}
 
@@ -198,7 +311,7 @@ func (p *parser) exprMember() (Expr, error) {
 			return nil, err
 		}
 
-		if err := p.acceptKeyword(keywordElse); err != nil {
+		if _, err := p.acceptKeyword(keywordElse); err != nil {
 			return nil, err
 		}
 
@@ -207,120 +320,236 @@ func (p *parser) exprMember() (Expr, error) {
 			return nil, err
 		}
 
-		return &ExprIf{cond, body, els}, nil
+		return &ExprIf{tok.Pos, cond, body, els}, nil
 	}
 
-	if name, err := p.acceptItem(itemIdent); err == nil {
-		if _, err := p.acceptItem(itemLparen); err == nil {
-			args, err := p.exprList()
-			if err != nil {
-				return nil, err
-			}
+	if name, err := p.acceptToken(TokenIdent); err == nil {
+		if _, err := p.acceptToken(TokenLparen); err == nil {
+			var args []Expr
+			if _, err := p.acceptToken(TokenRparen); err != nil {
+				args, err = p.exprList()
+				if err != nil {
+					return nil, err
+				}
 
-			if _, err := p.acceptItem(itemRparen); err != nil {
-				return nil, err
+				if _, err := p.acceptToken(TokenRparen); err != nil {
+					return nil, err
+				}
 			}
 
+			if pkg, node := splitQualified(name.Value); strings.Contains(name.Value, "::") && (pkg == "" || node == "") {
+				return nil, errorf(name.Pos, "invalid qualified name '%v'", name.Value)
+			}
 			return &ExprCall{
-				Name: name,
-				Args: args,
+				Name:    name.Value,
+				NamePos: name.Pos,
+				Args:    args,
 			}, nil
+		} else if strings.Contains(name.Value, "::") {
+			return nil, errorf(name.Pos, "qualified name '%v' doesn't refer to a variable", name.Value)
 		} else {
-			return ExprVar(name), nil
+			return ExprVar{name.Value, name.Pos}, nil
 		}
 	}
 
-	if s, err := p.acceptItem(itemNumber); err == nil {
-		// TODO: float
-		i, err := strconv.Atoi(s)
+	if tok, err := p.acceptToken(TokenInt); err == nil {
+		i, err := strconv.ParseInt(tok.Value, 10, 32)
 		if err != nil {
-			return nil, err
+			return nil, errorf(tok.Pos, "invalid integer '%v'", tok.Value)
+		}
+
+		return ExprConst{int(i), tok.Pos}, nil
+	}
+
+	if tok, err := p.acceptToken(TokenFloat); err == nil {
+		f, err := strconv.ParseFloat(tok.Value, 32)
+		if err != nil {
+			return nil, errorf(tok.Pos, "invalid float '%v'", tok.Value)
 		}
 
-		return ExprConst{i}, nil
+		return ExprConst{float32(f), tok.Pos}, nil
 	}
 
-	if err := p.acceptKeyword(keywordTrue); err == nil {
-		return ExprConst{true}, nil
-	} else if err := p.acceptKeyword(keywordFalse); err == nil {
-		return ExprConst{false}, nil
+	if tok, err := p.acceptKeyword(keywordTrue); err == nil {
+		return ExprConst{true, tok.Pos}, nil
+	} else if tok, err := p.acceptKeyword(keywordFalse); err == nil {
+		return ExprConst{false, tok.Pos}, nil
 	}
 
-	if s, err := p.acceptItem(itemString); err == nil {
-		return ExprConst{s}, nil
+	if tok, err := p.acceptToken(TokenString); err == nil {
+		return ExprConst{unquote(tok.Value), tok.Pos}, nil
 	}
 
-	return nil, fmt.Errorf("minilustre: expected an expression, got %v", p.cur)
+	tok := p.peek()
+	return nil, errorf(tok.Pos, "expected an expression, got %v", &tok)
 }
 
-func (p *parser) expr() (Expr, error) {
-	e1, err := p.exprMember()
-	if err != nil {
-		return nil, err
+func (p *parser) exprUnary() (Expr, error) {
+	tok := p.peek()
+
+	var op UnOp
+	switch {
+	case tok.Kind == TokenKeyword && tok.Value == keywordNot:
+		op = UnOpNot
+	case tok.Kind == TokenOp && tok.Value == "-":
+		op = UnOpMinus
+	case tok.Kind == TokenOp && tok.Value == "-.":
+		op = UnOpFMinus
+	default:
+		return p.exprMember()
 	}
+	p.accept()
 
-	if err := p.acceptKeyword(keywordFby); err == nil {
-		e2, err := p.expr()
-		if err != nil {
+	// A minus sign directly followed by a number is part of the constant
+	if op == UnOpMinus || op == UnOpFMinus {
+		if c, ok, err := p.negativeConst(op, tok.Pos); err != nil {
 			return nil, err
+		} else if ok {
+			return c, nil
 		}
+	}
 
-		return &ExprBinOp{BinOpFby, e1, e2}, nil
+	e, err := p.exprUnary()
+	if err != nil {
+		return nil, err
 	}
 
-	if s, err := p.acceptItem(itemOp); err == nil {
-		e2, err := p.expr()
+	return &ExprUnOp{op, tok.Pos, e}, nil
+}
+
+// negativeConst parses a number preceded by a minus sign at pos. Integers can
+// only be negated with "-", floats with both "-" and "-.".
+func (p *parser) negativeConst(op UnOp, pos Pos) (Expr, bool, error) {
+	tok := p.peek()
+	switch {
+	case tok.Kind == TokenInt && op == UnOpMinus:
+		p.accept()
+		i, err := strconv.ParseInt("-"+tok.Value, 10, 32)
 		if err != nil {
-			return nil, err
+			return nil, false, errorf(tok.Pos, "invalid integer '-%v'", tok.Value)
+		}
+		return ExprConst{int(i), pos}, true, nil
+	case tok.Kind == TokenFloat:
+		p.accept()
+		f, err := strconv.ParseFloat("-"+tok.Value, 32)
+		if err != nil {
+			return nil, false, errorf(tok.Pos, "invalid float '-%v'", tok.Value)
 		}
+		return ExprConst{float32(f), pos}, true, nil
+	}
+	return nil, false, nil
+}
 
-		var op BinOp
-		switch s {
-		case "+":
-			op = BinOpPlus
+// binOp returns the binary operator for a token, if any.
+func binOp(tok *Token) (BinOp, bool) {
+	switch tok.Kind {
+	case TokenEq:
+		return BinOpEq, true
+	case TokenKeyword:
+		switch tok.Value {
+		case keywordFby:
+			return BinOpFby, true
+		case keywordAnd:
+			return BinOpAnd, true
+		case keywordOr:
+			return BinOpOr, true
+		}
+	case TokenOp:
+		switch tok.Value {
 		case "-":
-			op = BinOpMinus
+			return BinOpMinus, true
+		case "+":
+			return BinOpPlus, true
 		case ">":
-			op = BinOpGt
+			return BinOpGt, true
 		case "<":
-			op = BinOpLt
-		default:
-			panic("unknown binary operation '" + s + "'")
+			return BinOpLt, true
+		case "*":
+			return BinOpMul, true
+		case "/":
+			return BinOpDiv, true
+		case "-.":
+			return BinOpFMinus, true
+		case "+.":
+			return BinOpFPlus, true
+		case "*.":
+			return BinOpFMul, true
+		case "/.":
+			return BinOpFDiv, true
+		case ">=":
+			return BinOpGe, true
+		case "<=":
+			return BinOpLe, true
+		case "<>":
+			return BinOpNe, true
+		}
+	}
+	return 0, false
+}
+
+// exprBinary parses an expression made of binary operators whose precedence
+// is at least prec.
+func (p *parser) exprBinary(prec int) (Expr, error) {
+	left, err := p.exprUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		tok := p.peek()
+		op, ok := binOp(&tok)
+		if !ok || op.Precedence() < prec {
+			return left, nil
 		}
+		p.accept()
 
-		return &ExprBinOp{op, e1, e2}, nil
+		rightPrec := op.Precedence() + 1
+		if op.RightAssoc() {
+			rightPrec = op.Precedence()
+		}
+
+		right, err := p.exprBinary(rightPrec)
+		if err != nil {
+			return nil, err
+		}
+
+		left = &ExprBinOp{op, tok.Pos, left, right}
 	}
+}
 
-	return e1, nil
+func (p *parser) expr() (Expr, error) {
+	return p.exprBinary(0)
 }
 
 func (p *parser) assign() (*Assign, error) {
+	pos := p.peek().Pos
+
 	var dst []string
-	if _, err := p.acceptItem(itemLparen); err == nil {
+	if _, err := p.acceptToken(TokenLparen); err == nil {
 		for {
-			name, err := p.acceptItem(itemIdent)
+			name, err := p.acceptName()
 			if err != nil {
 				return nil, err
 			}
-			dst = append(dst, name)
+			dst = append(dst, name.Value)
 
-			if _, err := p.acceptItem(itemComma); err != nil {
+			if _, err := p.acceptToken(TokenComma); err != nil {
 				break
 			}
 		}
 
-		if _, err := p.acceptItem(itemRparen); err != nil {
+		if _, err := p.acceptToken(TokenRparen); err != nil {
 			return nil, err
 		}
 	} else {
-		name, err := p.acceptItem(itemIdent)
+		name, err := p.acceptName()
 		if err != nil {
 			return nil, nil
 		}
-		dst = []string{name}
+		dst = []string{name.Value}
 	}
 
-	if _, err := p.acceptItem(itemEq); err != nil {
+	if _, err := p.acceptToken(TokenEq); err != nil {
 		return nil, err
 	}
 
@@ -330,144 +559,286 @@ func (p *parser) assign() (*Assign, error) {
 	}
 
 	return &Assign{
+		Pos:  pos,
 		Dst:  dst,
 		Body: expr,
 	}, nil
 }
 
-func (p *parser) assignList() ([]Assign, error) {
+// assignList parses a list of equations. On error, it skips to the next
+// equation.
+func (p *parser) assignList() []Assign {
 	var l []Assign
 	for {
 		assign, err := p.assign()
 		if err != nil {
-			return nil, err
+			p.addError(err)
+			if p.skipTo(true, keywordTel) {
+				continue
+			}
+			break
 		} else if assign == nil {
 			break
 		}
 
 		l = append(l, *assign)
 
-		if _, err := p.acceptItem(itemSemi); err != nil {
+		if _, err := p.acceptToken(TokenSemi); err != nil {
 			break
 		}
 	}
 
-	return l, nil
+	return l
 }
 
-func (p *parser) node() (*Node, error) {
-	if err := p.acceptKeyword(keywordNode); err != nil {
-		return nil, err
-	}
-
-	name, err := p.acceptItem(itemIdent)
+// nodeHeader parses the name and parameters of a node, up to the semicolon
+// following the out parameters.
+func (p *parser) nodeHeader(n *Node) error {
+	name, err := p.acceptName()
 	if err != nil {
-		return nil, err
+		return err
 	}
+	n.Name = name.Value
 
-	if _, err := p.acceptItem(itemLparen); err != nil {
-		return nil, err
+	if _, err := p.acceptToken(TokenLparen); err != nil {
+		return err
 	}
-	inParams, err := p.paramList()
-	if err != nil {
-		return nil, err
+	if n.InParams, err = p.paramList(); err != nil {
+		return err
 	}
-	if _, err := p.acceptItem(itemRparen); err != nil {
-		return nil, err
+	if _, err := p.acceptToken(TokenRparen); err != nil {
+		return err
 	}
 
-	if err := p.acceptKeyword(keywordReturns); err != nil {
-		return nil, err
+	if _, err := p.acceptKeyword(keywordReturns); err != nil {
+		return err
 	}
 
-	if _, err := p.acceptItem(itemLparen); err != nil {
-		return nil, err
+	if _, err := p.acceptToken(TokenLparen); err != nil {
+		return err
 	}
-	outParams, err := p.paramList()
-	if err != nil {
-		return nil, err
-	} else if len(outParams) == 0 {
-		return nil, fmt.Errorf("minilustre: '%v' doesn't have any out parameter", name)
+	if n.OutParams, err = p.paramList(); err != nil {
+		return err
+	} else if len(n.OutParams) == 0 {
+		p.addError(errorf(name.Pos, "'%v' doesn't have any out parameter", name.Value))
 	}
-	if _, err := p.acceptItem(itemRparen); err != nil {
-		return nil, err
+	if _, err := p.acceptToken(TokenRparen); err != nil {
+		return err
 	}
 
-	if _, err := p.acceptItem(itemSemi); err != nil {
-		return nil, err
+	_, err = p.acceptToken(TokenSemi)
+	return err
+}
+
+// node parses a node. On error, the partially parsed node is returned. If the
+// node doesn't have a name, nil is returned.
+func (p *parser) node() *Node {
+	pos := p.peek().Pos
+	var inline, unsafe, extern bool
+	for {
+		tok := p.peek()
+		var modifier *bool
+		switch {
+		case p.isKeyword(&tok, []string{keywordInline}):
+			modifier = &inline
+		case p.isKeyword(&tok, []string{keywordUnsafe}):
+			modifier = &unsafe
+		case p.isKeyword(&tok, []string{keywordExtern}):
+			modifier = &extern
+		}
+		if modifier == nil {
+			break
+		}
+		p.accept()
+
+		if *modifier {
+			p.addError(errorf(tok.Pos, "duplicate keyword %v", tok.Value))
+		}
+		*modifier = true
+		if inline && extern {
+			p.addError(errorf(tok.Pos, "extern nodes can't be inline"))
+		}
 	}
 
-	var localParams map[string]Type
-	if err := p.acceptKeyword(keywordVar); err == nil {
-		localParams, err = p.paramList()
-		if err != nil {
-			return nil, err
+	if _, err := p.acceptKeyword(keywordNode); err != nil {
+		p.addError(err)
+		return nil
+	}
+
+	n := &Node{Pos: pos, Inline: inline, Unsafe: unsafe, Extern: extern}
+	if err := p.nodeHeader(n); err != nil {
+		p.addError(err)
+		p.skipTo(false, keywordVar, keywordLet, keywordTel)
+
+		// Don't report missing parts if the next node starts here
+		if tok := p.peek(); tok.Kind == TokenEOF || p.isKeyword(&tok, declKeywords) {
+			n = nil
 		}
 	}
+	if n == nil || n.Name == "" {
+		p.skipTo(false)
+		return n
+	} else if n.Extern {
+		// Extern nodes don't have a body
+		return n
+	}
 
-	if err := p.acceptKeyword(keywordLet); err != nil {
-		return nil, err
+	if _, err := p.acceptKeyword(keywordVar); err == nil {
+		n.LocalParams = p.localParamList()
 	}
-	body, err := p.assignList()
-	if err != nil {
-		return nil, err
+
+	if tok, err := p.acceptKeyword(keywordLet); err != nil {
+		p.addError(err)
+		p.skipTo(false, keywordTel)
+	} else {
+		n.Let = tok.Pos
+		n.Body = p.assignList()
 	}
-	if err := p.acceptKeyword(keywordTel); err != nil {
-		return nil, err
+
+	if tok, err := p.acceptKeyword(keywordTel); err != nil {
+		p.addError(err)
+		p.skipTo(false, keywordTel)
+		if tok, err := p.acceptKeyword(keywordTel); err == nil {
+			n.Tel = tok.Pos
+		}
+	} else {
+		n.Tel = tok.Pos
 	}
 
-	return &Node{
-		Name:        name,
-		InParams:    inParams,
-		OutParams:   outParams,
-		LocalParams: localParams,
-		Body:        body,
-	}, nil
+	return n
 }
 
-func (p *parser) parse() (*File, error) {
-	f := File{}
+// nodes parses nodes until EOF or one of the keywords is reached.
+func (p *parser) nodes(keywords ...string) []Node {
+	var nodes []Node
 	for {
-		n, err := p.node()
-		if err != nil {
-			return nil, err
+		tok := p.peek()
+		if tok.Kind == TokenEOF || p.isKeyword(&tok, keywords) {
+			return nodes
+		} else if !p.isKeyword(&tok, nodeKeywords) {
+			p.addError(errorf(tok.Pos, "expected keyword %v, got %v", keywordNode, &tok))
+			p.accept()
+			p.skipTo(false)
+			continue
 		}
 
-		f.Nodes = append(f.Nodes, *n)
-
-		if _, err := p.acceptItem(itemEOF); err == nil {
-			break
+		if n := p.node(); n != nil {
+			nodes = append(nodes, *n)
 		}
 	}
-
-	return &f, nil
 }
 
-func Parse(r io.Reader) (*File, error) {
-	items := make(chan item, 2)
-	done := make(chan error, 1)
+// pkg parses a package. On error, the partially parsed package is returned.
+func (p *parser) pkg() *Package {
+	tok, _ := p.acceptKeyword(keywordPackage)
+	pkg := &Package{Pos: tok.Pos}
 
-	l := lexer{in: bufio.NewReader(r), out: items}
-	p := parser{items, nil}
+	if err := p.pkgHeader(pkg); err != nil {
+		p.addError(err)
+		p.skipTo(false, keywordBody)
+	}
+	if tok, err := p.acceptKeyword(keywordBody); err != nil {
+		p.addError(err)
+	} else {
+		pkg.Body = tok.Pos
+	}
 
-	var f *File
-	go func() {
-		var err error
-		f, err = p.parse()
-		done <- err
+	pkg.Nodes = p.nodes(keywordEnd, keywordPackage, keywordInclude)
+
+	if tok, err := p.acceptKeyword(keywordEnd); err != nil {
+		p.addError(err)
+	} else {
+		pkg.End = tok.Pos
+		p.acceptToken(TokenSemi)
+	}
+	return pkg
+}
+
+// pkgHeader parses the name and the used packages of a package, up to the
+// body keyword.
+func (p *parser) pkgHeader(pkg *Package) error {
+	name, err := p.acceptName()
+	if err != nil {
+		return err
+	}
+	pkg.Name = name.Value
 
-		// Consume all tokens
-		for range items {
+	if _, err := p.acceptKeyword(keywordUses); err != nil {
+		return nil
+	}
+	for {
+		name, err := p.acceptName()
+		if err != nil {
+			return err
 		}
-	}()
+		pkg.Uses = append(pkg.Uses, name.Value)
 
-	if err := l.lex(); err != nil {
-		return nil, err
+		if _, err := p.acceptToken(TokenComma); err != nil {
+			break
+		}
 	}
+	_, err = p.acceptToken(TokenSemi)
+	return err
+}
 
-	if err := <-done; err != nil {
-		return nil, err
+func (p *parser) parse() *File {
+	f := File{}
+	for {
+		tok := p.peek()
+		switch {
+		case tok.Kind == TokenEOF:
+			return &f
+		case p.isKeyword(&tok, []string{keywordInclude}):
+			p.accept()
+			if len(f.Nodes) > 0 || len(f.Packages) > 0 {
+				p.addError(errorf(tok.Pos, "include directives must come before nodes and packages"))
+			}
+			if path, err := p.acceptToken(TokenString); err != nil {
+				p.addError(err)
+				p.skipTo(true)
+			} else {
+				f.Includes = append(f.Includes, Include{tok.Pos, unquote(path.Value)})
+				p.acceptToken(TokenSemi)
+			}
+		case p.isKeyword(&tok, []string{keywordPackage}):
+			if len(f.Nodes) > 0 {
+				p.addError(errorf(tok.Pos, "a file can't contain both packages and top-level nodes"))
+			}
+			f.Packages = append(f.Packages, *p.pkg())
+		default:
+			nodes := p.nodes(keywordInclude, keywordPackage, keywordEnd)
+			if len(nodes) > 0 && len(f.Packages) > 0 {
+				p.addError(errorf(nodes[0].Pos, "a file can't contain both packages and top-level nodes"))
+			}
+			f.Nodes = append(f.Nodes, nodes...)
+			if tok, err := p.acceptKeyword(keywordEnd); err == nil {
+				p.addError(errorf(tok.Pos, "unexpected keyword %v outside of a package", keywordEnd))
+			}
+		}
+	}
+}
+
+// Parse parses a source file.
+//
+// If the source file contains syntax errors, an ErrorList is returned along
+// with a partial file containing the constructs which could be parsed.
+func Parse(r io.Reader) (*File, error) {
+	return ParseFile("", r)
+}
+
+// ParseFile is like Parse, but records filename in positions.
+func ParseFile(filename string, r io.Reader) (*File, error) {
+	p := parser{s: NewScanner(r)}
+	p.s.pos.Filename = filename
+
+	f := p.parse()
+	f.Comments = p.comments
+	if p.err != nil {
+		return f, p.err
 	}
 
-	return f, nil
+	sort.SliceStable(p.errors, func(i, j int) bool {
+		return p.errors[i].Pos.Offset < p.errors[j].Pos.Offset
+	})
+	return f, p.errors.Err()
 }
@@ -0,0 +1,420 @@
+package minilustre
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"strings"
+	"unicode/utf8"
+)
+
+// printerLine is a line of formatted source code. The left-hand sides of
+// consecutive equations are aligned.
+type printerLine struct {
+	indent  string
+	lhs     string
+	text    string
+	comment string
+}
+
+func (l *printerLine) blank() bool {
+	return l.lhs == "" && l.text == "" && l.comment == ""
+}
+
+type printer struct {
+	lines    []printerLine
+	comments []Comment
+	// Last source line printed, used to preserve blank lines. Zero if blank
+	// lines shouldn't be preserved.
+	srcLine int
+}
+
+func (p *printer) print(indent, text string) {
+	p.lines = append(p.lines, printerLine{indent: indent, text: text})
+}
+
+// blankLine prints a blank line if there is one in the source before line.
+func (p *printer) blankLine(line int) {
+	if p.srcLine == 0 || line <= p.srcLine+1 {
+		return
+	}
+	if n := len(p.lines); n > 0 && !p.lines[n-1].blank() {
+		p.lines = append(p.lines, printerLine{})
+	}
+}
+
+// flushEndOfLine prints the comments located before offset which follow the
+// last printed line in the source.
+func (p *printer) flushEndOfLine(offset int) {
+	for len(p.comments) > 0 && p.comments[0].EndOfLine && p.comments[0].Pos.Offset < offset {
+		p.flush(p.comments[0].Pos.Offset+1, "")
+	}
+}
+
+// flush prints the comments located before offset.
+func (p *printer) flush(offset int, indent string) {
+	for len(p.comments) > 0 && p.comments[0].Pos.Offset < offset {
+		c := p.comments[0]
+		p.comments = p.comments[1:]
+
+		text := strings.TrimRight(c.Text, " \t\r")
+		if n := len(p.lines); c.EndOfLine && n > 0 && !p.lines[n-1].blank() {
+			l := &p.lines[n-1]
+			if l.comment != "" {
+				l.comment += " "
+			}
+			l.comment += text
+		} else {
+			p.blankLine(c.Pos.Line)
+			p.print(indent, text)
+		}
+
+		p.srcLine = c.Pos.Line + strings.Count(c.Text, "\n")
+	}
+}
+
+// node prints a node. next is the offset of the next node.
+func (p *printer) node(n *Node, next int) {
+	p.flush(n.Pos.Offset, "")
+	p.blankLine(n.Pos.Line)
+	header := "node "
+	if n.Extern {
+		header = "extern " + header
+	}
+	if n.Unsafe {
+		header = "unsafe " + header
+	}
+	if n.Inline {
+		header = "inline " + header
+	}
+	p.print("", header+n.Name+" ("+FormatParams(n.InParams)+") returns ("+FormatParams(n.OutParams)+");")
+	if n.Extern {
+		p.flushEndOfLine(next)
+		p.srcLine = n.Pos.Line
+		return
+	}
+	switch {
+	case len(n.LocalParams) > 0:
+		p.flushEndOfLine(n.LocalParams[0].Pos.Offset)
+	case n.Let.IsValid():
+		p.flushEndOfLine(n.Let.Offset)
+	}
+	p.srcLine = 0
+
+	if len(n.LocalParams) > 0 {
+		p.print("", "var")
+		for _, g := range paramGroups(n.LocalParams) {
+			p.flush(g[0].Pos.Offset, "\t")
+			p.print("\t", formatParamGroup(g)+";")
+		}
+	}
+
+	if n.Let.IsValid() {
+		p.flush(n.Let.Offset, "")
+	}
+	p.print("", "let")
+	p.srcLine = 0
+
+	for i := range n.Body {
+		a := &n.Body[i]
+		if a.Pos.IsValid() {
+			p.flush(a.Pos.Offset, "\t")
+			p.blankLine(a.Pos.Line)
+		}
+
+		lhs := strings.Join(a.Dst, ", ")
+		if len(a.Dst) > 1 {
+			lhs = "(" + lhs + ")"
+		}
+		p.lines = append(p.lines, printerLine{
+			indent: "\t",
+			lhs:    lhs,
+			text:   " = " + formatExpr(a.Body) + ";",
+		})
+		p.srcLine = assignEndLine(a)
+	}
+
+	if n.Tel.IsValid() {
+		p.flush(n.Tel.Offset, "\t")
+	}
+	p.print("", "tel")
+	p.flushEndOfLine(next)
+	p.srcLine = n.Tel.Line
+}
+
+// nodes prints a list of nodes. end is the offset following the last node.
+func (p *printer) nodes(nodes []Node, end int) {
+	for i := range nodes {
+		// Consecutive extern nodes can be grouped together
+		if i > 0 && !(nodes[i-1].Extern && nodes[i].Extern) {
+			p.lines = append(p.lines, printerLine{})
+		}
+		next := end
+		if i+1 < len(nodes) && nodes[i+1].Pos.IsValid() {
+			next = nodes[i+1].Pos.Offset
+		}
+		p.node(&nodes[i], next)
+	}
+}
+
+// pkg prints a package. next is the offset of the next package.
+func (p *printer) pkg(pkg *Package, next int) {
+	p.flush(pkg.Pos.Offset, "")
+	p.blankLine(pkg.Pos.Line)
+	header := keywordPackage + " " + pkg.Name
+	if len(pkg.Uses) > 0 {
+		header += " " + keywordUses + " " + strings.Join(pkg.Uses, ", ") + ";"
+	}
+	p.print("", header)
+	if pkg.Body.IsValid() {
+		p.flushEndOfLine(pkg.Body.Offset)
+		p.flush(pkg.Body.Offset, "")
+	}
+	p.print("", keywordBody)
+
+	end := next
+	if pkg.End.IsValid() {
+		end = pkg.End.Offset
+	}
+	if len(pkg.Nodes) > 0 {
+		p.lines = append(p.lines, printerLine{})
+		p.nodes(pkg.Nodes, end)
+		p.lines = append(p.lines, printerLine{})
+	}
+	p.flush(end, "")
+	p.print("", keywordEnd)
+	p.flushEndOfLine(next)
+	p.srcLine = pkg.End.Line
+}
+
+func (p *printer) file(f *File) {
+	// Offset of the first declaration
+	decl := math.MaxInt
+	if len(f.Packages) > 0 && f.Packages[0].Pos.IsValid() {
+		decl = f.Packages[0].Pos.Offset
+	} else if len(f.Nodes) > 0 && f.Nodes[0].Pos.IsValid() {
+		decl = f.Nodes[0].Pos.Offset
+	}
+
+	for i, inc := range f.Includes {
+		p.flush(inc.Pos.Offset, "")
+		p.print("", keywordInclude+" "+quote(inc.Path)+";")
+		next := decl
+		if i+1 < len(f.Includes) && f.Includes[i+1].Pos.IsValid() {
+			next = f.Includes[i+1].Pos.Offset
+		}
+		p.flushEndOfLine(next)
+		p.srcLine = inc.Pos.Line
+	}
+	if len(f.Includes) > 0 && (len(f.Packages) > 0 || len(f.Nodes) > 0) {
+		p.lines = append(p.lines, printerLine{})
+	}
+
+	for i := range f.Packages {
+		if i > 0 {
+			p.lines = append(p.lines, printerLine{})
+		}
+		next := decl
+		if i+1 < len(f.Packages) && f.Packages[i+1].Pos.IsValid() {
+			next = f.Packages[i+1].Pos.Offset
+		} else if i+1 == len(f.Packages) {
+			next = math.MaxInt
+			if len(f.Nodes) > 0 && f.Nodes[0].Pos.IsValid() {
+				next = f.Nodes[0].Pos.Offset
+			}
+		}
+		p.pkg(&f.Packages[i], next)
+	}
+	if len(f.Packages) > 0 && len(f.Nodes) > 0 {
+		p.lines = append(p.lines, printerLine{})
+	}
+
+	p.nodes(f.Nodes, math.MaxInt)
+
+	p.flush(math.MaxInt, "")
+}
+
+func (p *printer) writeTo(w io.Writer) error {
+	var b bytes.Buffer
+	for i := 0; i < len(p.lines); {
+		// Find the group of equations to align
+		j, width := i, 0
+		for ; j < len(p.lines) && p.lines[j].lhs != ""; j++ {
+			if n := utf8.RuneCountInString(p.lines[j].lhs); n > width {
+				width = n
+			}
+		}
+		if j == i {
+			j++
+		}
+
+		for _, l := range p.lines[i:j] {
+			b.WriteString(l.indent)
+			b.WriteString(l.lhs)
+			if l.lhs != "" {
+				b.WriteString(strings.Repeat(" ", width-utf8.RuneCountInString(l.lhs)))
+			}
+			b.WriteString(l.text)
+			if l.comment != "" {
+				if l.lhs != "" || l.text != "" {
+					b.WriteString(" ")
+				}
+				b.WriteString(l.comment)
+			}
+			b.WriteString("\n")
+		}
+		i = j
+	}
+
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// assignEndLine returns the last source line of an equation.
+func assignEndLine(a *Assign) int {
+	line := a.Pos.Line
+	Inspect(a.Body, func(e Expr) bool {
+		if e != nil && e.Pos().Line > line {
+			line = e.Pos().Line
+		}
+		return true
+	})
+	return line
+}
+
+// paramGroups splits a parameter list into groups of consecutive parameters
+// having the same type.
+func paramGroups(params []Param) [][]Param {
+	var groups [][]Param
+	for i := 0; i < len(params); {
+		j := i + 1
+		for j < len(params) && params[j].Type == params[i].Type {
+			j++
+		}
+		groups = append(groups, params[i:j])
+		i = j
+	}
+	return groups
+}
+
+func formatParamGroup(params []Param) string {
+	names := make([]string, len(params))
+	for i, param := range params {
+		names[i] = param.Name
+	}
+	return strings.Join(names, ", ") + ": " + params[0].Type.String()
+}
+
+// FormatParams formats a parameter list as in node declarations, e.g.
+// "x, y: int; b: bool".
+func FormatParams(params []Param) string {
+	groups := paramGroups(params)
+	l := make([]string, len(groups))
+	for i, g := range groups {
+		l[i] = formatParamGroup(g)
+	}
+	return strings.Join(l, "; ")
+}
+
+// needParens returns true if the operand of a binary operator needs to be
+// parenthesized.
+func needParens(operand Expr, op BinOp, right bool) bool {
+	// The else branch of an if expression extends as far as possible
+	if !right && endsWithIf(operand) {
+		return true
+	}
+
+	e, ok := operand.(*ExprBinOp)
+	if !ok {
+		return false
+	}
+	if prec := e.Op.Precedence(); prec != op.Precedence() {
+		return prec < op.Precedence()
+	}
+	return right != op.RightAssoc()
+}
+
+// endsWithIf returns true if the formatted expression ends with an if
+// expression which isn't parenthesized.
+func endsWithIf(e Expr) bool {
+	switch e := e.(type) {
+	case *ExprIf:
+		return true
+	case *ExprBinOp:
+		return !needParens(e.Right, e.Op, true) && endsWithIf(e.Right)
+	case *ExprUnOp:
+		if _, ok := e.Expr.(*ExprBinOp); ok {
+			return false
+		}
+		return endsWithIf(e.Expr)
+	}
+	return false
+}
+
+func formatExprList(l []Expr) string {
+	s := make([]string, len(l))
+	for i, e := range l {
+		s[i] = formatExpr(e)
+	}
+	return strings.Join(s, ", ")
+}
+
+// formatExpr formats an expression, adding parentheses where required by
+// operator precedence.
+func formatExpr(e Expr) string {
+	switch e := e.(type) {
+	case *ExprCall:
+		return e.Name + "(" + formatExprList(e.Args) + ")"
+	case ExprTuple:
+		return "(" + formatExprList(e) + ")"
+	case *ExprBinOp:
+		left := formatExpr(e.Left)
+		if needParens(e.Left, e.Op, false) {
+			left = "(" + left + ")"
+		}
+		right := formatExpr(e.Right)
+		if needParens(e.Right, e.Op, true) {
+			right = "(" + right + ")"
+		}
+		return left + " " + e.Op.String() + " " + right
+	case *ExprUnOp:
+		s := formatExpr(e.Expr)
+		if e.Op == UnOpNot {
+			if _, ok := e.Expr.(*ExprBinOp); ok {
+				s = "(" + s + ")"
+			}
+			return "not " + s
+		}
+		// Avoid starting a "--" comment
+		if _, ok := e.Expr.(*ExprBinOp); ok || strings.HasPrefix(s, "-") {
+			s = "(" + s + ")"
+		}
+		return e.Op.String() + s
+	case *ExprIf:
+		return "if " + formatExpr(e.Cond) + " then " + formatExpr(e.Body) + " else " + formatExpr(e.Else)
+	default:
+		return e.String()
+	}
+}
+
+// Fprint writes f to w as canonically formatted source code. Comments are
+// preserved.
+func Fprint(w io.Writer, f *File) error {
+	p := printer{comments: f.Comments}
+	p.file(f)
+	return p.writeTo(w)
+}
+
+// Format parses a source file and returns it canonically formatted.
+func Format(src []byte) ([]byte, error) {
+	f, err := Parse(bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+
+	var b bytes.Buffer
+	if err := Fprint(&b, f); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
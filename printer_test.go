@@ -0,0 +1,217 @@
+package minilustre
+
+import (
+	"bytes"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var posType = reflect.TypeOf(Pos{})
+
+// withoutPos returns a deep copy of v with all positions cleared.
+func withoutPos(v reflect.Value) reflect.Value {
+	if v.Type() == posType {
+		return reflect.Zero(posType)
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.New(v.Type().Elem())
+		c.Elem().Set(withoutPos(v.Elem()))
+		return c
+	case reflect.Interface:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.New(v.Type()).Elem()
+		c.Set(withoutPos(v.Elem()))
+		return c
+	case reflect.Struct:
+		c := reflect.New(v.Type()).Elem()
+		for i := 0; i < v.NumField(); i++ {
+			c.Field(i).Set(withoutPos(v.Field(i)))
+		}
+		return c
+	case reflect.Slice:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		for i := 0; i < v.Len(); i++ {
+			c.Index(i).Set(withoutPos(v.Index(i)))
+		}
+		return c
+	default:
+		return v
+	}
+}
+
+// equalNodes checks whether two lists of nodes are structurally equal,
+// ignoring positions.
+func equalNodes(a, b []Node) bool {
+	return reflect.DeepEqual(withoutPos(reflect.ValueOf(a)).Interface(), withoutPos(reflect.ValueOf(b)).Interface())
+}
+
+func TestRoundTrip(t *testing.T) {
+	filenames, err := filepath.Glob("testdata/*.mls")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, filename := range filenames {
+		filename := filename
+		t.Run(filepath.Base(filename), func(t *testing.T) {
+			b, err := os.ReadFile(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			f, err := Parse(bytes.NewReader(b))
+			if err != nil {
+				t.Fatalf("Parse() = %v", err)
+			}
+
+			s := f.String()
+			f2, err := Parse(strings.NewReader(s))
+			if err != nil {
+				t.Fatalf("Parse(String()) = %v\n%v", err, s)
+			}
+			if !equalNodes(f.Nodes, f2.Nodes) {
+				t.Errorf("Parse(String()) differs from the original file:\n%v", s)
+			}
+
+			var out bytes.Buffer
+			if err := Fprint(&out, f); err != nil {
+				t.Fatal(err)
+			}
+			f3, err := Parse(&out)
+			if err != nil {
+				t.Fatalf("Parse(Fprint()) = %v", err)
+			}
+			if !equalNodes(f.Nodes, f3.Nodes) {
+				t.Errorf("Parse(Fprint()) differs from the original file")
+			}
+		})
+	}
+}
+
+func TestConstRoundTrip(t *testing.T) {
+	values := []interface{}{
+		nil,
+		true,
+		false,
+		0,
+		42,
+		-7,
+		math.MinInt32,
+		math.MaxInt32,
+		float32(1),
+		float32(0.5),
+		float32(-1),
+		float32(-0.25),
+		float32(math.Copysign(0, -1)),
+		float32(1e10),
+		float32(-1.5e-8),
+		float32(math.MaxFloat32),
+		float32(math.Inf(1)),
+		float32(math.Inf(-1)),
+		float32(math.NaN()),
+		"a \"quoted\" string",
+	}
+
+	for _, v := range values {
+		s := ExprConst{Value: v}.String()
+		f, err := Parse(strings.NewReader("node n () returns (o: int); let o = " + s + "; tel"))
+		if err != nil {
+			t.Errorf("Parse(%q) = %v", s, err)
+			continue
+		}
+
+		// Infinities and NaN are printed as constant expressions
+		var got interface{}
+		switch e := f.Nodes[0].Body[0].Body.(type) {
+		case ExprConst:
+			got = e.Value
+		case *ExprBinOp:
+			left, leftOk := e.Left.(ExprConst)
+			right, rightOk := e.Right.(ExprConst)
+			if !leftOk || !rightOk {
+				t.Errorf("Parse(%q) = %v, want a constant expression", s, e)
+				continue
+			}
+			if got, err = evalBinOp(e.Op, left.Value, right.Value); err != nil {
+				t.Errorf("evaluating %q: %v", s, err)
+				continue
+			}
+		default:
+			t.Errorf("Parse(%q) = %v, want a constant", s, e)
+			continue
+		}
+
+		want, isFloat := v.(float32)
+		if g, ok := got.(float32); ok && isFloat {
+			if math.IsNaN(float64(want)) && math.IsNaN(float64(g)) {
+				continue
+			}
+			if g != want || math.Signbit(float64(g)) != math.Signbit(float64(want)) {
+				t.Errorf("Parse(%q) = %v, want %v", s, g, want)
+			}
+		} else if got != v {
+			t.Errorf("Parse(%q) = %#v, want %#v", s, got, v)
+		}
+	}
+}
+
+func TestFormatPackages(t *testing.T) {
+	src := `-- header
+include "lib.mls"; -- eol
+include "other.mls"
+
+package p uses q, r; -- uses
+body
+-- first
+node f (x: int) returns (y: int);
+let
+  y = q::g(x);
+tel
+end;
+
+package empty body end
+`
+	want := `-- header
+include "lib.mls"; -- eol
+include "other.mls";
+
+package p uses q, r; -- uses
+body
+
+-- first
+node f (x: int) returns (y: int);
+let
+	y = q::g(x);
+tel
+
+end
+
+package empty
+body
+end
+`
+	out, err := Format([]byte(src))
+	if err != nil {
+		t.Fatalf("Format() = %v", err)
+	}
+	if string(out) != want {
+		t.Errorf("Format() = \n%v\nwant:\n%v", string(out), want)
+	}
+	if out2, err := Format(out); err != nil || string(out2) != string(out) {
+		t.Errorf("Format() isn't idempotent: got\n%v", string(out2))
+	}
+}
@@ -0,0 +1,114 @@
+package minilustre
+
+// instantVars calls f for each variable needed to evaluate an expression
+// during the current cycle. The right operand of fby operators is only needed
+// for the next cycle, so its variables are skipped.
+func instantVars(e Expr, f func(name string)) {
+	Inspect(e, func(e Expr) bool {
+		switch e := e.(type) {
+		case ExprVar:
+			f(e.Name)
+		case *ExprBinOp:
+			if e.Op == BinOpFby {
+				instantVars(e.Left, f)
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// scheduleNode sorts the equations of a node. It returns the index of an
+// equation which depends on itself on failure.
+func scheduleNode(n *Node) ([]Assign, int) {
+	defs := make(map[string]int)
+	for j, a := range n.Body {
+		for _, dst := range a.Dst {
+			defs[dst] = j
+		}
+	}
+
+	deps := make([][]int, len(n.Body))
+	for j, a := range n.Body {
+		instantVars(a.Body, func(name string) {
+			if k, ok := defs[name]; ok {
+				deps[j] = append(deps[j], k)
+			}
+		})
+	}
+
+	// Pick the first equation whose dependencies are satisfied, so that
+	// source order is kept when possible
+	done := make([]bool, len(n.Body))
+	body := make([]Assign, 0, len(n.Body))
+	for len(body) < len(n.Body) {
+		next := -1
+		for j := range n.Body {
+			if done[j] {
+				continue
+			}
+			ready := true
+			for _, k := range deps[j] {
+				if !done[k] {
+					ready = false
+					break
+				}
+			}
+			if ready {
+				next = j
+				break
+			}
+		}
+
+		if next < 0 {
+			// Follow dependencies from the first remaining equation until
+			// an equation is visited twice: it's part of a loop
+			visited := make([]bool, len(n.Body))
+			for j := range n.Body {
+				if done[j] {
+					continue
+				}
+				for !visited[j] {
+					visited[j] = true
+					for _, k := range deps[j] {
+						if !done[k] {
+							j = k
+							break
+						}
+					}
+				}
+				return nil, j
+			}
+		}
+
+		done[next] = true
+		body = append(body, n.Body[next])
+	}
+	return body, -1
+}
+
+// Schedule sorts the equations of each node so that variables are computed
+// before they're used during a cycle. The right operand of a fby operator
+// doesn't need to be computed before the operator, since its value is only
+// used in the next cycle. Source order is kept when possible.
+//
+// Nodes with a causality loop, where a variable depends on itself during a
+// cycle, can't be scheduled: errors are returned in an ErrorList and these
+// nodes are left unchanged.
+func Schedule(f *File) error {
+	var errs ErrorList
+	for i := range f.Nodes {
+		n := &f.Nodes[i]
+		if n.Extern {
+			continue
+		}
+		body, loop := scheduleNode(n)
+		if loop >= 0 {
+			a := &n.Body[loop]
+			errs = append(errs, errorf(a.Pos, "variable '%v' depends on itself", a.Dst[0]))
+			continue
+		}
+		n.Body = body
+	}
+	return errs.Err()
+}
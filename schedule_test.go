@@ -0,0 +1,61 @@
+package minilustre
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSchedule(t *testing.T) {
+	src := `node f (x: int) returns (o: int);
+var a, b, c: int;
+let
+  o = a + b;
+  c = 0 fby o;
+  a = x fby c;
+  b = a * 2;
+tel
+`
+	f, err := Parse(strings.NewReader(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Schedule(f); err != nil {
+		t.Fatal(err)
+	}
+
+	var eqs []string
+	for _, a := range f.Nodes[0].Body {
+		eqs = append(eqs, a.String())
+	}
+	want := []string{"c = 0 fby o", "a = x fby c", "b = a * 2", "o = a + b"}
+	if strings.Join(eqs, "; ") != strings.Join(want, "; ") {
+		t.Errorf("Schedule() = %v, want %v", strings.Join(eqs, "; "), strings.Join(want, "; "))
+	}
+}
+
+func TestScheduleLoop(t *testing.T) {
+	for _, tc := range []struct {
+		body string
+		err  string
+	}{
+		// fby operators delay their right operand: a and b depend on
+		// each other, but not during the same cycle
+		{"o = a; a = b + x; b = 0 fby x + a;", ""},
+		{"o = a; a = b + x; b = x + a;", "5:3: variable 'a' depends on itself"},
+		{"o = a + 1; a = if x > 0 then o else x;", "4:3: variable 'o' depends on itself"},
+	} {
+		src := "node f (x: int) returns (o: int);\nvar a, b: int;\nlet\n  " + strings.ReplaceAll(tc.body, "; ", ";\n  ") + "\ntel\n"
+		f, err := Parse(strings.NewReader(src))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = Schedule(f)
+		if tc.err == "" && err != nil {
+			t.Errorf("Schedule(%q) = %v, want no error", tc.body, err)
+		} else if tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)) {
+			t.Errorf("Schedule(%q) = %v, want %q", tc.body, err, tc.err)
+		}
+	}
+}
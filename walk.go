@@ -0,0 +1,98 @@
+package minilustre
+
+import (
+	"fmt"
+)
+
+// A Visitor's Visit method is invoked for each expression encountered by
+// Walk. If the result visitor w is not nil, Walk visits each of the children
+// of the expression with the visitor w, followed by a call of w.Visit(nil).
+type Visitor interface {
+	Visit(e Expr) (w Visitor)
+}
+
+// Walk traverses an expression in depth-first order. It starts by calling
+// v.Visit(e); e must not be nil.
+func Walk(v Visitor, e Expr) {
+	if v = v.Visit(e); v == nil {
+		return
+	}
+
+	switch e := e.(type) {
+	case *ExprCall:
+		for _, arg := range e.Args {
+			Walk(v, arg)
+		}
+	case ExprConst, ExprVar:
+		// Leaves
+	case ExprTuple:
+		for _, e := range e {
+			Walk(v, e)
+		}
+	case *ExprBinOp:
+		Walk(v, e.Left)
+		Walk(v, e.Right)
+	case *ExprUnOp:
+		Walk(v, e.Expr)
+	case *ExprIf:
+		Walk(v, e.Cond)
+		Walk(v, e.Body)
+		Walk(v, e.Else)
+	default:
+		panic(fmt.Sprintf("minilustre: Walk: unexpected expression type %T", e))
+	}
+
+	v.Visit(nil)
+}
+
+type inspector func(Expr) bool
+
+func (f inspector) Visit(e Expr) Visitor {
+	if f(e) {
+		return f
+	}
+	return nil
+}
+
+// Inspect traverses an expression in depth-first order. It starts by calling
+// f(e); e must not be nil. If f returns true, Inspect invokes f recursively
+// for each of the children of e, followed by a call of f(nil).
+func Inspect(e Expr, f func(Expr) bool) {
+	Walk(inspector(f), e)
+}
+
+func rewriteList(l []Expr, f func(Expr) Expr) []Expr {
+	if l == nil {
+		return nil
+	}
+	out := make([]Expr, len(l))
+	for i, e := range l {
+		out[i] = Rewrite(e, f)
+	}
+	return out
+}
+
+// Rewrite traverses an expression in depth-first order and replaces each
+// expression with the result of f. The children of an expression are
+// rewritten before the expression itself is passed to f.
+//
+// The original expression isn't modified: a copy of each visited expression
+// is passed to f.
+func Rewrite(e Expr, f func(Expr) Expr) Expr {
+	switch e := e.(type) {
+	case *ExprCall:
+		return f(&ExprCall{Name: e.Name, NamePos: e.NamePos, Args: rewriteList(e.Args, f)})
+	case ExprConst, ExprVar:
+		return f(e)
+	case ExprTuple:
+		return f(ExprTuple(rewriteList(e, f)))
+	case *ExprBinOp:
+		return f(&ExprBinOp{e.Op, e.OpPos, Rewrite(e.Left, f), Rewrite(e.Right, f)})
+	case *ExprUnOp:
+		return f(&ExprUnOp{e.Op, e.OpPos, Rewrite(e.Expr, f)})
+	case *ExprIf:
+		return f(&ExprIf{e.If, Rewrite(e.Cond, f), Rewrite(e.Body, f), Rewrite(e.Else, f)})
+	default:
+		panic(fmt.Sprintf("minilustre: Rewrite: unexpected expression type %T", e))
+	}
+}
@@ -0,0 +1,64 @@
+package minilustre
+
+import (
+	"strings"
+	"testing"
+)
+
+func parseExpr(t *testing.T, s string) Expr {
+	f, err := Parse(strings.NewReader("node f () returns (o: int); let o = " + s + "; tel"))
+	if err != nil {
+		t.Fatalf("Parse() = %v", err)
+	}
+	return f.Nodes[0].Body[0].Body
+}
+
+func TestInspect(t *testing.T) {
+	e := parseExpr(t, "if a then g(b, -c) else (d, 1) fby e")
+
+	var vars []string
+	depth, maxDepth := 0, 0
+	Inspect(e, func(e Expr) bool {
+		if e == nil {
+			depth--
+			return false
+		}
+		depth++
+		if depth > maxDepth {
+			maxDepth = depth
+		}
+		if v, ok := e.(ExprVar); ok {
+			vars = append(vars, v.Name)
+		}
+		return true
+	})
+
+	if got, want := strings.Join(vars, " "), "a b c d e"; got != want {
+		t.Errorf("visited variables %q, want %q", got, want)
+	}
+	if depth != 0 {
+		t.Errorf("got %v more visits than calls with nil", depth)
+	}
+	if maxDepth != 4 {
+		t.Errorf("max depth = %v, want 4", maxDepth)
+	}
+}
+
+func TestRewrite(t *testing.T) {
+	e := parseExpr(t, "if a then g(b, -c) else (d, 1) fby e")
+
+	got := Rewrite(e, func(e Expr) Expr {
+		if v, ok := e.(ExprVar); ok {
+			v.Name = strings.ToUpper(v.Name)
+			return v
+		}
+		return e
+	})
+
+	if s, want := got.String(), "if A then g(B, -C) else (D, 1) fby E"; s != want {
+		t.Errorf("Rewrite() = %q, want %q", s, want)
+	}
+	if s, want := e.String(), "if a then g(b, -c) else (d, 1) fby e"; s != want {
+		t.Errorf("Rewrite() modified the original expression: %q", s)
+	}
+}
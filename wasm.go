@@ -0,0 +1,704 @@
+package minilustre
+
+import (
+	"fmt"
+	"io"
+	"math"
+)
+
+// WebAssembly value types and opcodes
+const (
+	wasmI32 byte = 0x7f
+	wasmF32 byte = 0x7d
+
+	wasmOpIf          = 0x04
+	wasmOpElse        = 0x05
+	wasmOpEnd         = 0x0b
+	wasmOpCall        = 0x10
+	wasmOpSelect      = 0x1b
+	wasmOpLocalGet    = 0x20
+	wasmOpLocalSet    = 0x21
+	wasmOpI32Load     = 0x28
+	wasmOpF32Load     = 0x2a
+	wasmOpI32Store    = 0x36
+	wasmOpF32Store    = 0x38
+	wasmOpI32Const    = 0x41
+	wasmOpF32Const    = 0x43
+	wasmOpI32Eqz      = 0x45
+	wasmOpI32Eq       = 0x46
+	wasmOpI32Ne       = 0x47
+	wasmOpI32LtS      = 0x48
+	wasmOpI32GtS      = 0x4a
+	wasmOpI32LeS      = 0x4c
+	wasmOpI32GeS      = 0x4e
+	wasmOpF32Eq       = 0x5b
+	wasmOpF32Ne       = 0x5c
+	wasmOpF32Lt       = 0x5d
+	wasmOpF32Gt       = 0x5e
+	wasmOpF32Le       = 0x5f
+	wasmOpF32Ge       = 0x60
+	wasmOpI32Add      = 0x6a
+	wasmOpI32Sub      = 0x6b
+	wasmOpI32Mul      = 0x6c
+	wasmOpI32DivS     = 0x6d
+	wasmOpI32And      = 0x71
+	wasmOpI32Or       = 0x72
+	wasmOpF32Neg      = 0x8c
+	wasmOpF32Add      = 0x92
+	wasmOpF32Sub      = 0x93
+	wasmOpF32Mul      = 0x94
+	wasmOpF32Div      = 0x95
+	wasmExportFunc    = 0x00
+	wasmExportMemory  = 0x02
+	wasmPageSize      = 65536
+	wasmDataOffset    = 16
+	wasmFieldSize     = 4
+	wasmSectionType   = 1
+	wasmSectionImport = 2
+	wasmSectionFunc   = 3
+	wasmSectionMemory = 5
+	wasmSectionExport = 7
+	wasmSectionStart  = 8
+	wasmSectionCode   = 10
+	wasmSectionData   = 11
+)
+
+func appendU32(b []byte, v uint32) []byte {
+	for {
+		c := byte(v & 0x7f)
+		v >>= 7
+		if v == 0 {
+			return append(b, c)
+		}
+		b = append(b, c|0x80)
+	}
+}
+
+func appendS32(b []byte, v int32) []byte {
+	for {
+		c := byte(v & 0x7f)
+		v >>= 7
+		if (v == 0 && c&0x40 == 0) || (v == -1 && c&0x40 != 0) {
+			return append(b, c)
+		}
+		b = append(b, c|0x80)
+	}
+}
+
+func appendName(b []byte, s string) []byte {
+	b = appendU32(b, uint32(len(s)))
+	return append(b, s...)
+}
+
+// appendVec appends a vector made of the concatenation of n encoded items.
+func appendVec(b []byte, n int, items []byte) []byte {
+	b = appendU32(b, uint32(n))
+	return append(b, items...)
+}
+
+func wasmType(t Type) byte {
+	if t == TypeFloat {
+		return wasmF32
+	}
+	return wasmI32
+}
+
+// wasmTypes returns the value types of parameters. Unit parameters are
+// omitted.
+func wasmTypes(params []Param) []byte {
+	var l []byte
+	for _, param := range params {
+		if param.Type != TypeUnit {
+			l = append(l, wasmType(param.Type))
+		}
+	}
+	return l
+}
+
+type wasmInstance struct {
+	offset uint32
+	class  *wasmClass
+}
+
+// wasmClass holds the WebAssembly definitions of a class. The state of an
+// instance is stored in linear memory: each memory takes one 4-byte field,
+// followed by the states of instances.
+type wasmClass struct {
+	class *Class
+	size  uint32
+	mems  map[string]uint32
+	insts map[string]wasmInstance
+	// Function indices. Extern classes only have a step function, which is
+	// imported.
+	reset, step uint32
+	// Offset of the global instance
+	state uint32
+}
+
+type wasmFunc struct {
+	typ  uint32
+	code []byte
+}
+
+type wasmExport struct {
+	name  string
+	kind  byte
+	index uint32
+}
+
+type wasmCompiler struct {
+	classes map[string]*wasmClass
+
+	sigs    [][]byte
+	nimport int
+	funcs   []wasmFunc
+	exports []wasmExport
+	// Strings are stored after the global instances, from dataOffset
+	data       []byte
+	dataOffset uint32
+	strings    map[string]uint32
+	div        uint32
+
+	// Function being compiled
+	class  *wasmClass
+	vars   map[string]Type
+	locals map[string]uint32
+	code   []byte
+}
+
+// funcType returns the index of a function type, adding it if necessary.
+func (c *wasmCompiler) funcType(params, results []byte) uint32 {
+	t := append([]byte{0x60}, appendVec(nil, len(params), params)...)
+	t = appendVec(t, len(results), results)
+	for i, other := range c.sigs {
+		if string(other) == string(t) {
+			return uint32(i)
+		}
+	}
+	c.sigs = append(c.sigs, t)
+	return uint32(len(c.sigs) - 1)
+}
+
+func (c *wasmCompiler) funcIndex() uint32 {
+	return uint32(c.nimport + len(c.funcs))
+}
+
+func (c *wasmCompiler) op(ops ...byte) {
+	c.code = append(c.code, ops...)
+}
+
+func (c *wasmCompiler) i32(v int32) {
+	c.code = appendS32(append(c.code, wasmOpI32Const), v)
+}
+
+func (c *wasmCompiler) call(f uint32) {
+	c.code = appendU32(append(c.code, wasmOpCall), f)
+}
+
+func (c *wasmCompiler) local(op byte, name string) error {
+	index, ok := c.locals[name]
+	if !ok {
+		return fmt.Errorf("minilustre: referring to unknown variable '%v'", name)
+	}
+	c.code = appendU32(append(c.code, op), index)
+	return nil
+}
+
+// mem loads or stores a field at an offset from the self pointer.
+func (c *wasmCompiler) mem(op byte, offset uint32) {
+	c.code = appendU32(appendU32(append(c.code, op), 2), offset)
+}
+
+// field pushes a pointer to a field of the current instance.
+func (c *wasmCompiler) field(offset uint32) {
+	c.op(wasmOpLocalGet, 0)
+	if offset != 0 {
+		c.i32(int32(offset))
+		c.op(wasmOpI32Add)
+	}
+}
+
+// str returns the address of a NUL-terminated string in the data segment.
+func (c *wasmCompiler) str(s string) uint32 {
+	if addr, ok := c.strings[s]; ok {
+		return addr
+	}
+	addr := c.dataOffset + uint32(len(c.data))
+	c.data = append(append(c.data, s...), 0)
+	c.strings[s] = addr
+	return addr
+}
+
+// expr pushes the value of an expression. Unit values aren't stored, nothing
+// is pushed for them.
+func (c *wasmCompiler) expr(e Expr) error {
+	switch e := e.(type) {
+	case ExprConst:
+		switch v := e.Value.(type) {
+		case bool:
+			if v {
+				c.i32(1)
+			} else {
+				c.i32(0)
+			}
+		case int:
+			c.i32(int32(v))
+		case float32:
+			bits := math.Float32bits(v)
+			c.op(wasmOpF32Const, byte(bits), byte(bits>>8), byte(bits>>16), byte(bits>>24))
+		case string:
+			c.i32(int32(c.str(v)))
+		case nil:
+			// Unit
+		default:
+			panic(fmt.Sprintf("unknown const type %T", v))
+		}
+	case ExprVar:
+		if t, ok := c.vars[e.Name]; ok && t == TypeUnit {
+			return nil
+		}
+		return c.local(wasmOpLocalGet, e.Name)
+	case *ExprBinOp:
+		if err := c.expr(e.Left); err != nil {
+			return err
+		}
+		if err := c.expr(e.Right); err != nil {
+			return err
+		}
+
+		t, _ := typeOf(e.Left, c.vars, nil)
+		isFloat := t == TypeFloat
+		var i32, f32 byte
+		switch e.Op {
+		case BinOpMinus:
+			i32 = wasmOpI32Sub
+		case BinOpPlus:
+			i32 = wasmOpI32Add
+		case BinOpMul:
+			i32 = wasmOpI32Mul
+		case BinOpDiv:
+			c.call(c.div)
+			return nil
+		case BinOpFMinus:
+			f32 = wasmOpF32Sub
+		case BinOpFPlus:
+			f32 = wasmOpF32Add
+		case BinOpFMul:
+			f32 = wasmOpF32Mul
+		case BinOpFDiv:
+			f32 = wasmOpF32Div
+		case BinOpGt:
+			i32, f32 = wasmOpI32GtS, wasmOpF32Gt
+		case BinOpLt:
+			i32, f32 = wasmOpI32LtS, wasmOpF32Lt
+		case BinOpGe:
+			i32, f32 = wasmOpI32GeS, wasmOpF32Ge
+		case BinOpLe:
+			i32, f32 = wasmOpI32LeS, wasmOpF32Le
+		case BinOpEq:
+			i32, f32 = wasmOpI32Eq, wasmOpF32Eq
+		case BinOpNe:
+			i32, f32 = wasmOpI32Ne, wasmOpF32Ne
+		case BinOpAnd:
+			i32 = wasmOpI32And
+		case BinOpOr:
+			i32 = wasmOpI32Or
+		default:
+			panic(fmt.Sprintf("unknown binary operation %v", e.Op))
+		}
+		if f32 != 0 && (isFloat || i32 == 0) {
+			c.op(f32)
+		} else {
+			c.op(i32)
+		}
+	case *ExprUnOp:
+		if e.Op == UnOpMinus {
+			c.i32(0)
+		}
+		if err := c.expr(e.Expr); err != nil {
+			return err
+		}
+		switch e.Op {
+		case UnOpNot:
+			c.op(wasmOpI32Eqz)
+		case UnOpMinus:
+			c.op(wasmOpI32Sub)
+		case UnOpFMinus:
+			c.op(wasmOpF32Neg)
+		default:
+			panic(fmt.Sprintf("unknown unary operation %v", e.Op))
+		}
+	case *ExprIf:
+		if t, ok := typeOf(e, c.vars, nil); ok && t == TypeUnit {
+			return nil
+		}
+		for _, ee := range []Expr{e.Body, e.Else, e.Cond} {
+			if err := c.expr(ee); err != nil {
+				return err
+			}
+		}
+		c.op(wasmOpSelect)
+	default:
+		panic(fmt.Sprintf("minilustre: unexpected expression %T in Obc", e))
+	}
+	return nil
+}
+
+func (c *wasmCompiler) stmt(s Stmt) error {
+	switch s := s.(type) {
+	case *StmtAssign:
+		if t, ok := c.vars[s.Dst]; ok && t == TypeUnit {
+			return nil
+		}
+		if err := c.expr(s.Expr); err != nil {
+			return err
+		}
+		return c.local(wasmOpLocalSet, s.Dst)
+	case *StmtMemRead:
+		offset, ok := c.class.mems[s.Mem]
+		if !ok {
+			// Unit memories aren't stored
+			return nil
+		}
+		c.op(wasmOpLocalGet, 0)
+		if c.vars[s.Dst] == TypeFloat {
+			c.mem(wasmOpF32Load, offset)
+		} else {
+			c.mem(wasmOpI32Load, offset)
+		}
+		return c.local(wasmOpLocalSet, s.Dst)
+	case *StmtMemWrite:
+		offset, ok := c.class.mems[s.Mem]
+		if !ok {
+			return nil
+		}
+		c.op(wasmOpLocalGet, 0)
+		if err := c.expr(s.Expr); err != nil {
+			return err
+		}
+		if t, _ := typeOf(s.Expr, c.vars, nil); t == TypeFloat {
+			c.mem(wasmOpF32Store, offset)
+		} else {
+			c.mem(wasmOpI32Store, offset)
+		}
+	case *StmtCall:
+		callee, ok := c.classes[s.Class]
+		if !ok {
+			return fmt.Errorf("minilustre: undefined node '%v'", s.Class)
+		}
+		if s.Instance != "" {
+			inst := c.class.insts[s.Instance]
+			callee = inst.class
+			c.field(inst.offset)
+		}
+		for _, arg := range s.Args {
+			if err := c.expr(arg); err != nil {
+				return err
+			}
+		}
+		c.call(callee.step)
+
+		// Results are popped from the stack in reverse order
+		out := callee.class.Out
+		if len(s.Dst) != len(out) {
+			return fmt.Errorf("minilustre: node '%v' has %v outputs, got %v variables", callee.class.Name, len(out), len(s.Dst))
+		}
+		for i := len(s.Dst) - 1; i >= 0; i-- {
+			if out[i].Type == TypeUnit {
+				continue
+			}
+			if err := c.local(wasmOpLocalSet, s.Dst[i]); err != nil {
+				return err
+			}
+		}
+	case *StmtReset:
+		inst := c.class.insts[s.Instance]
+		c.field(inst.offset)
+		c.call(inst.class.reset)
+	default:
+		panic(fmt.Sprintf("unknown statement %T", s))
+	}
+	return nil
+}
+
+// define adds a function. Its parameters and locals are the provided
+// variables, the first parameter being the self pointer for methods.
+func (c *wasmCompiler) define(params []byte, results []byte, locals []Param) wasmFunc {
+	var decls []byte
+	n := 0
+	for _, param := range locals {
+		if param.Type == TypeUnit {
+			continue
+		}
+		c.locals[param.Name] = uint32(len(params) + n)
+		decls = append(decls, 1, wasmType(param.Type))
+		n++
+	}
+	body := appendVec(nil, n, decls)
+	c.code = nil
+	return wasmFunc{typ: c.funcType(params, results), code: body}
+}
+
+// finish completes the function being compiled and adds it to the module.
+func (c *wasmCompiler) finish(f wasmFunc) {
+	f.code = append(append(f.code, c.code...), wasmOpEnd)
+	c.funcs = append(c.funcs, f)
+	c.code = nil
+}
+
+func (c *wasmCompiler) method(in, out, locals []Param, stmts []Stmt) (uint32, error) {
+	c.locals = make(map[string]uint32)
+	params := []byte{wasmI32}
+	for _, param := range in {
+		if param.Type != TypeUnit {
+			c.locals[param.Name] = uint32(len(params))
+			params = append(params, wasmType(param.Type))
+		}
+	}
+	f := c.define(params, wasmTypes(out), append(append([]Param(nil), out...), locals...))
+	for _, s := range stmts {
+		if err := c.stmt(s); err != nil {
+			return 0, fmt.Errorf("failed to compile node '%v': %v", c.class.class.Name, err)
+		}
+	}
+	for _, param := range out {
+		if param.Type == TypeUnit {
+			continue
+		}
+		if err := c.local(wasmOpLocalGet, param.Name); err != nil {
+			return 0, fmt.Errorf("failed to compile node '%v': %v", c.class.class.Name, err)
+		}
+	}
+	index := c.funcIndex()
+	c.finish(f)
+	return index, nil
+}
+
+// layout computes the layout of the state of a class.
+func (c *wasmCompiler) layout(class *Class) (*wasmClass, error) {
+	wc := &wasmClass{
+		class: class,
+		mems:  make(map[string]uint32),
+		insts: make(map[string]wasmInstance),
+	}
+	for _, param := range class.Mems {
+		if param.Type != TypeUnit {
+			wc.mems[param.Name] = wc.size
+			wc.size += wasmFieldSize
+		}
+	}
+	for _, inst := range class.Instances {
+		callee, ok := c.classes[inst.Class]
+		if !ok || callee.class.Extern {
+			return nil, fmt.Errorf("minilustre: undefined node '%v'", inst.Class)
+		}
+		wc.insts[inst.Name] = wasmInstance{wc.size, callee}
+		wc.size += callee.size
+	}
+	return wc, nil
+}
+
+// compile defines the methods of a class, and the exported functions
+// operating on its global instance.
+func (c *wasmCompiler) compile(wc *wasmClass) error {
+	class := wc.class
+	c.class = wc
+	c.vars = make(map[string]Type)
+	for _, params := range [][]Param{class.In, class.Out, class.Locals} {
+		for _, param := range params {
+			c.vars[param.Name] = param.Type
+		}
+	}
+
+	var err error
+	if wc.reset, err = c.method(nil, nil, nil, class.Reset); err != nil {
+		return err
+	}
+	if wc.step, err = c.method(class.In, class.Out, class.Locals, class.Step); err != nil {
+		return err
+	}
+
+	c.locals = make(map[string]uint32)
+	f := c.define(nil, nil, nil)
+	c.i32(int32(wc.state))
+	c.call(wc.reset)
+	c.exports = append(c.exports, wasmExport{class.Name + "_init", wasmExportFunc, c.funcIndex()})
+	c.finish(f)
+
+	in := wasmTypes(class.In)
+	f = c.define(in, wasmTypes(class.Out), nil)
+	c.i32(int32(wc.state))
+	for i := range in {
+		c.code = appendU32(append(c.code, wasmOpLocalGet), uint32(i))
+	}
+	c.call(wc.step)
+	c.exports = append(c.exports, wasmExport{class.Name + "_step", wasmExportFunc, c.funcIndex()})
+	c.finish(f)
+	return nil
+}
+
+func appendSection(b []byte, id byte, content []byte) []byte {
+	b = append(b, id)
+	b = appendU32(b, uint32(len(content)))
+	return append(b, content...)
+}
+
+// CompileWasm compiles a file to a WebAssembly binary module. The file is
+// translated to Obc first.
+//
+// The state of nodes is stored in the exported linear memory "memory". Each
+// node f has a global instance, which is reset by the exported function
+// f_init and stepped by f_step. Global instances are reset when the module is
+// instantiated. Extern nodes which are called are imported from the "env"
+// module, like the print node. Booleans are represented as 32-bit integers and
+// strings as pointers to NUL-terminated UTF-8 in the linear memory.
+func CompileWasm(f *File, w io.Writer) error {
+	p, err := Translate(f)
+	if err != nil {
+		return err
+	}
+
+	c := wasmCompiler{
+		classes: make(map[string]*wasmClass),
+		strings: make(map[string]uint32),
+	}
+
+	// Import called extern nodes first, imported functions come first in the
+	// index space
+	externs := map[string]*Class{
+		"print": {
+			Name:   "print",
+			Extern: true,
+			In:     []Param{{Name: "str", Type: TypeString}},
+			Out:    []Param{{Name: "u", Type: TypeUnit}},
+		},
+	}
+	for i := range p.Classes {
+		class := &p.Classes[i]
+		if class.Extern {
+			externs[class.Name] = class
+		}
+	}
+	var imports []byte
+	for i := range p.Classes {
+		for _, s := range p.Classes[i].Step {
+			call, ok := s.(*StmtCall)
+			if !ok || call.Instance != "" || c.classes[call.Class] != nil {
+				continue
+			}
+			class, ok := externs[call.Class]
+			if !ok {
+				return fmt.Errorf("minilustre: undefined node '%v'", call.Class)
+			}
+			wc := &wasmClass{class: class, step: uint32(c.nimport)}
+			typ := c.funcType(wasmTypes(class.In), wasmTypes(class.Out))
+			imports = appendName(imports, "env")
+			imports = appendName(imports, class.Name)
+			imports = appendU32(append(imports, wasmExportFunc), typ)
+			c.classes[class.Name] = wc
+			c.nimport++
+		}
+	}
+
+	// Integer division, with INT32_MIN / -1 wrapping around instead of
+	// trapping
+	c.locals = make(map[string]uint32)
+	div := c.define([]byte{wasmI32, wasmI32}, []byte{wasmI32}, nil)
+	c.op(wasmOpLocalGet, 1)
+	c.i32(-1)
+	c.op(wasmOpI32Eq)
+	c.op(wasmOpIf, wasmI32)
+	c.i32(0)
+	c.op(wasmOpLocalGet, 0, wasmOpI32Sub)
+	c.op(wasmOpElse)
+	c.op(wasmOpLocalGet, 0, wasmOpLocalGet, 1, wasmOpI32DivS)
+	c.op(wasmOpEnd)
+	c.div = c.funcIndex()
+	c.finish(div)
+
+	// Global instances are allocated first, strings are appended to the data
+	// segment as they're found
+	var classes []*wasmClass
+	offset := uint32(wasmDataOffset)
+	for i := range p.Classes {
+		class := &p.Classes[i]
+		if class.Extern {
+			continue
+		}
+		wc, err := c.layout(class)
+		if err != nil {
+			return err
+		}
+		wc.state = offset
+		offset += wc.size
+		c.classes[class.Name] = wc
+		classes = append(classes, wc)
+	}
+	c.dataOffset = offset
+
+	for _, wc := range classes {
+		if err := c.compile(wc); err != nil {
+			return err
+		}
+	}
+
+	// Reset all global instances on instantiation
+	c.locals = make(map[string]uint32)
+	start := c.define(nil, nil, nil)
+	for _, wc := range classes {
+		c.i32(int32(wc.state))
+		c.call(wc.reset)
+	}
+	startIndex := c.funcIndex()
+	c.finish(start)
+
+	var b []byte
+	b = append(b, 0x00, 'a', 's', 'm', 1, 0, 0, 0)
+
+	var sec []byte
+	for _, sig := range c.sigs {
+		sec = append(sec, sig...)
+	}
+	b = appendSection(b, wasmSectionType, appendVec(nil, len(c.sigs), sec))
+	if c.nimport > 0 {
+		b = appendSection(b, wasmSectionImport, appendVec(nil, c.nimport, imports))
+	}
+
+	sec = nil
+	for _, f := range c.funcs {
+		sec = appendU32(sec, f.typ)
+	}
+	b = appendSection(b, wasmSectionFunc, appendVec(nil, len(c.funcs), sec))
+
+	size := c.dataOffset + uint32(len(c.data))
+	pages := (size + wasmPageSize - 1) / wasmPageSize
+	b = appendSection(b, wasmSectionMemory, appendU32([]byte{1, 0x00}, pages))
+
+	sec = nil
+	c.exports = append([]wasmExport{{"memory", wasmExportMemory, 0}}, c.exports...)
+	for _, export := range c.exports {
+		sec = appendName(sec, export.name)
+		sec = appendU32(append(sec, export.kind), export.index)
+	}
+	b = appendSection(b, wasmSectionExport, appendVec(nil, len(c.exports), sec))
+
+	b = appendSection(b, wasmSectionStart, appendU32(nil, startIndex))
+
+	sec = nil
+	for _, f := range c.funcs {
+		sec = appendU32(sec, uint32(len(f.code)))
+		sec = append(sec, f.code...)
+	}
+	b = appendSection(b, wasmSectionCode, appendVec(nil, len(c.funcs), sec))
+
+	if len(c.data) > 0 {
+		sec = []byte{0x00}
+		sec = appendS32(append(sec, wasmOpI32Const), int32(c.dataOffset))
+		sec = append(sec, wasmOpEnd)
+		sec = appendVec(sec, len(c.data), c.data)
+		b = appendSection(b, wasmSectionData, appendVec(nil, 1, sec))
+	}
+
+	_, err = w.Write(b)
+	return err
+}
@@ -0,0 +1,30 @@
+package minilustre
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWasmExpr(t *testing.T) {
+	c := wasmCompiler{
+		vars:   map[string]Type{"x": TypeInt, "u": TypeUnit},
+		locals: map[string]uint32{"x": 1},
+	}
+
+	for _, e := range []Expr{ExprConst{}, ExprVar{Name: "u"}, &ExprIf{Cond: ExprVar{Name: "x"}, Body: ExprConst{}, Else: ExprVar{Name: "u"}}} {
+		if err := c.expr(e); err != nil {
+			t.Errorf("expr(%v) = %v", formatExpr(e), err)
+		}
+	}
+	if len(c.code) != 0 {
+		t.Errorf("unit values pushed code %v", c.code)
+	}
+
+	err := c.expr(&ExprBinOp{Op: BinOpPlus, Left: ExprVar{Name: "x"}, Right: ExprVar{Name: "y"}})
+	if err == nil || !strings.Contains(err.Error(), "unknown variable 'y'") {
+		t.Errorf("expr(x + y) = %v, want an unknown variable error", err)
+	}
+	if err := c.stmt(&StmtAssign{Dst: "z", Expr: ExprVar{Name: "x"}}); err == nil {
+		t.Errorf("stmt(z := x) didn't fail")
+	}
+}